@@ -0,0 +1,84 @@
+package main
+
+import (
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// activeSet tracks, per tenancy, the resources that stored a value in each of the
+// last cycles, so that series of resources idle for longer can be dropped.
+type activeSet struct {
+    cycles int
+    size   *prometheus.GaugeVec
+
+    mu sync.Mutex
+    // cycle counts the tenancy's completed cycles; lastSeen maps each of its
+    // active resources to the cycle it last reported in.
+    cycle    map[string]int
+    lastSeen map[string]map[string]int
+}
+
+func newActiveSet(cycles int, self *selfMetrics) *activeSet {
+    return &activeSet{
+        cycles:   cycles,
+        size:     self.gaugeVec("active_resources", "Resources of the tenancy that reported a value within the last -active-resource-cycles cycles.", "tenancy"),
+        cycle:    make(map[string]int),
+        lastSeen: make(map[string]map[string]int),
+    }
+}
+
+// Seen marks resourceID as reporting in the tenancy's current cycle.
+func (a *activeSet) Seen(tenancy, resourceID string) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    seen := a.lastSeen[tenancy]
+    if seen == nil {
+        seen = make(map[string]int)
+        a.lastSeen[tenancy] = seen
+    }
+    seen[resourceID] = a.cycle[tenancy]
+}
+
+// EndCycle closes the tenancy's current cycle and returns the resources that
+// have not reported in any of the last cycles, which it forgets.
+func (a *activeSet) EndCycle(tenancy string) map[string]bool {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    current := a.cycle[tenancy]
+    a.cycle[tenancy] = current + 1
+    idle := make(map[string]bool)
+    seen := a.lastSeen[tenancy]
+    for id, at := range seen {
+        if current-at >= a.cycles {
+            idle[id] = true
+            delete(seen, id)
+        }
+    }
+    a.size.WithLabelValues(tenancy).Set(float64(len(seen)))
+    return idle
+}
+
+// forget drops everything known about the tenancy.
+func (a *activeSet) forget(tenancy string) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    delete(a.cycle, tenancy)
+    delete(a.lastSeen, tenancy)
+    a.size.DeleteLabelValues(tenancy)
+}
+
+// dropIdleResources removes every series of the tenancy's idle resources.
+func (c *collector) dropIdleResources(tenancy string, idle map[string]bool) int {
+    if len(idle) == 0 {
+        return 0
+    }
+    n := c.store.DeleteResources(tenancy, idle)
+    for _, s := range []*sampleStore{c.seriesState, c.coverage, c.resolution, c.resourceInfo, c.compat} {
+        if s != nil {
+            s.DeleteResources(tenancy, idle)
+        }
+    }
+    c.histograms.DeleteResources(tenancy, idle)
+    return n
+}
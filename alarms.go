@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// alarmSuppressions exports the suppression state of OCI Monitoring alarms so
+// Prometheus alerts can be inhibited while OCI suppresses the matching alarm.
+type alarmSuppressions struct {
+    active *prometheus.GaugeVec
+    start  *prometheus.GaugeVec
+    end    *prometheus.GaugeVec
+}
+
+func newAlarmSuppressions(reg prometheus.Registerer) *alarmSuppressions {
+    labels := []string{"tenancy", "region", "alarm_id", "alarm_name"}
+    a := &alarmSuppressions{
+        active: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_alarm_suppression_active", Help: "1 if the OCI alarm is suppressed now, 0 otherwise"}, labels),
+        start:  prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_alarm_suppression_start_timestamp_seconds", Help: "Start of the OCI alarm's suppression window"}, labels),
+        end:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_alarm_suppression_end_timestamp_seconds", Help: "End of the OCI alarm's suppression window"}, labels),
+    }
+    reg.MustRegister(a.active, a.start, a.end)
+    return a
+}
+
+// forget deletes every series of the tenancy.
+func (a *alarmSuppressions) forget(tenancy string) {
+    match := prometheus.Labels{"tenancy": tenancy}
+    a.active.DeletePartialMatch(match)
+    a.start.DeletePartialMatch(match)
+    a.end.DeletePartialMatch(match)
+}
+
+// collectAlarmSuppressions lists the active alarms in the tenancy's compartments
+// and replaces the tenancy's suppression series. Whether a suppression is active
+// is evaluated against the current time on every call, so an expired window flips
+// to 0 on the next cycle. If listing fails the previous series are kept.
+func (c *collector) collectAlarmSuppressions(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartments []string) {
+    var alarms []monitoring.AlarmSummary
+    for _, compartmentID := range compartments {
+        req := monitoring.ListAlarmsRequest{
+            CompartmentId:  common.String(compartmentID),
+            LifecycleState: monitoring.AlarmLifecycleStateActive,
+        }
+        for {
+            resp, err := client.ListAlarms(ctx, req)
+            c.self.apiCalls.WithLabelValues(ten.Label, "ListAlarms").Inc()
+            if err != nil {
+                log.Printf("Error listing alarms for tenancy %s (compartment %s), keeping previous suppression state: %v", ten.Name, compartmentID, err)
+                return
+            }
+            alarms = append(alarms, resp.Items...)
+            if resp.OpcNextPage == nil {
+                break
+            }
+            req.Page = resp.OpcNextPage
+        }
+    }
+
+    now := time.Now()
+    a := c.alarms
+    a.forget(ten.Label)
+    for _, alarm := range alarms {
+        if alarm.Id == nil {
+            continue
+        }
+        name := *alarm.Id
+        if alarm.DisplayName != nil {
+            name = *alarm.DisplayName
+        }
+        labels := []string{ten.Label, ten.Region, *alarm.Id, name}
+        active := 0.0
+        if s := alarm.Suppression; s != nil && s.TimeSuppressFrom != nil && s.TimeSuppressUntil != nil {
+            from, until := s.TimeSuppressFrom.Time, s.TimeSuppressUntil.Time
+            if !now.Before(from) && now.Before(until) {
+                active = 1
+            }
+            a.start.WithLabelValues(labels...).Set(float64(from.Unix()))
+            a.end.WithLabelValues(labels...).Set(float64(until.Unix()))
+        }
+        a.active.WithLabelValues(labels...).Set(active)
+    }
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "log"
+    "strings"
+    "sync"
+)
+
+// standardDimensions are the dimensions the exporter itself turns into its
+// standard labels; the allowlist never blocks them.
+var standardDimensions = map[string]bool{
+    "resourceId":          true,
+    "resourceDisplayName": true,
+    "compartmentId":       true,
+}
+
+// dimensionAllowlist limits which dimensions config entries may promote to
+// labels, set by -allowed-label-dimensions. A nil allowlist allows every
+// dimension.
+type dimensionAllowlist struct {
+    keys map[string]bool
+    // logged holds the tenancy, namespace and dimension triples already logged
+    // as blocked, so each is logged once.
+    logged sync.Map
+}
+
+// newDimensionAllowlist parses a comma-separated list of dimension keys, or
+// returns nil for an empty list.
+func newDimensionAllowlist(list string) *dimensionAllowlist {
+    keys := make(map[string]bool)
+    for _, key := range strings.Split(list, ",") {
+        if key = strings.TrimSpace(key); key != "" {
+            keys[key] = true
+        }
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return &dimensionAllowlist{keys: keys}
+}
+
+// allowed reports whether the dimension key of namespace may become a label.
+func (a *dimensionAllowlist) allowed(namespace, key string) bool {
+    if a == nil || a.keys[key] || standardDimensions[key] {
+        return true
+    }
+    for _, dl := range builtinDimensionLabels[namespace] {
+        for _, dim := range dl.dimensions {
+            if dim == key {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// blocked logs, once per tenancy, namespace and key, that the entry asked for a
+// dimension the allowlist does not allow.
+func (a *dimensionAllowlist) blocked(ten Tenancy, ns MetricNamespace, key string) {
+    if _, dup := a.logged.LoadOrStore(ten.Label+"\xff"+ns.Namespace+"\xff"+key, true); dup {
+        return
+    }
+    log.Printf("Tenancy %s: dimension %q of namespace %s is not in -allowed-label-dimensions, not exporting it as a label", ten.Name, key, ns.Namespace)
+}
+
+// groupBy returns the entry with the group_by keys the allowlist blocks
+// removed. If none is left the streams are aggregated into one.
+func (a *dimensionAllowlist) groupBy(ten Tenancy, ns MetricNamespace) MetricNamespace {
+    if a == nil || len(ns.GroupBy) == 0 {
+        return ns
+    }
+    var keys []string
+    for _, key := range ns.GroupBy {
+        if a.allowed(ns.Namespace, key) {
+            keys = append(keys, key)
+        } else {
+            a.blocked(ten, ns, key)
+        }
+    }
+    if len(keys) == 0 {
+        ns.groupAll = true
+    }
+    ns.GroupBy = keys
+    return ns
+}
+
+// dimensions returns the dimensions of a returned stream the allowlist allows,
+// for custom and pack_dimensions entries, which export them all.
+func (a *dimensionAllowlist) dimensions(ten Tenancy, ns MetricNamespace, dims map[string]string) map[string]string {
+    if a == nil || !(ns.Custom || ns.PackDimensions) {
+        return dims
+    }
+    out := make(map[string]string, len(dims))
+    for key, value := range dims {
+        if a.allowed(ns.Namespace, key) {
+            out[key] = value
+        } else {
+            a.blocked(ten, ns, key)
+        }
+    }
+    return out
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "sort"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+// auditTenancy returns the tenancy as authenticated with its audit_profile, read
+// from its config_file or -config.
+func (ten Tenancy) auditTenancy() Tenancy {
+    audit := ten
+    audit.Profile = ten.AuditProfile
+    audit.AuditProfile = ""
+    return audit
+}
+
+// runAudit queries every metric of every tenancy with an audit_profile once with
+// its own credentials and once with the audit profile, and writes the queries
+// whose streams differ to w: streams only one of them sees, or a query only one
+// of them may run. It returns how many discrepancies it found. Wildcard
+// entries are left out, since listing their metrics would itself differ.
+func runAudit(ctx context.Context, w io.Writer, clients *regionClients, identityClient identity.IdentityClient, tenants TenancyConfig, global MetricConfig, endOffset, metricWindow time.Duration) (int, error) {
+    audited, discrepancies := 0, 0
+    for _, ten := range tenants.Tenancies {
+        if ten.AuditProfile == "" {
+            continue
+        }
+        audited++
+        primary, err := clients.For(ten)
+        if err != nil {
+            return discrepancies, fmt.Errorf("tenancy %s: %v", ten.Name, err)
+        }
+        audit, err := clients.For(ten.auditTenancy())
+        if err != nil {
+            return discrepancies, fmt.Errorf("tenancy %s: audit profile %s: %v", ten.Name, ten.AuditProfile, err)
+        }
+
+        var discovered []string
+        if ten.DiscoverCompartments {
+            ic := identityClient
+            if set, ok := clients.Profile(ten); ok {
+                ic = set.identity
+            }
+            ic.SetRegion(ten.Region)
+            if discovered, err = discoverCompartments(ctx, ic, ten); err != nil {
+                fmt.Fprintf(w, "Tenancy %s: compartment discovery failed, using the configured compartments: %v\n", ten.Name, err)
+            }
+        }
+        compartments := ten.queryCompartments(discovered)
+        queries, differ := 0, 0
+        now := time.Now().UTC()
+        for _, ns := range ten.metrics(global).Metrics {
+            offset, _ := ns.endOffset(endOffset)
+            window, _ := ns.window(metricWindow)
+            for _, name := range ns.Names {
+                if name == wildcardName {
+                    continue
+                }
+                for _, compartmentID := range compartments {
+                    if ctx.Err() != nil {
+                        return discrepancies, ctx.Err()
+                    }
+                    req := newSummarizeRequest(ten, ns, name, compartmentID, now.Add(-offset), window)
+                    queries++
+                    if problem := compareProfiles(ctx, primary, audit, req); problem != "" {
+                        differ++
+                        fmt.Fprintf(w, "Tenancy %s: %s %s in %s: %s\n", ten.Name, ns.Namespace, name, compartmentID, problem)
+                    }
+                    sleepCtx(ctx, 100*time.Millisecond)
+                }
+            }
+        }
+        fmt.Fprintf(w, "Tenancy %s: %d queries compared with audit profile %s, %d differ\n", ten.Name, queries, ten.AuditProfile, differ)
+        discrepancies += differ
+    }
+    if audited == 0 {
+        return 0, fmt.Errorf("no tenancy sets audit_profile")
+    }
+    return discrepancies, nil
+}
+
+// compareProfiles sends req with both clients and describes how the answers
+// differ, or returns "" if they see the same streams.
+func compareProfiles(ctx context.Context, primary, audit monitoring.MonitoringClient, req monitoring.SummarizeMetricsDataRequest) string {
+    primaryResp, primaryErr := summarizeWithRetry(ctx, primary, req, nil, nil)
+    auditResp, auditErr := summarizeWithRetry(ctx, audit, req, nil, nil)
+    switch {
+    case primaryErr != nil && auditErr != nil:
+        return ""
+    case auditErr != nil:
+        return fmt.Sprintf("the audit profile cannot query it (%s): %v", errorClass(auditErr), auditErr)
+    case primaryErr != nil:
+        return fmt.Sprintf("only the audit profile can query it; the tenancy's own credentials fail (%s): %v", errorClass(primaryErr), primaryErr)
+    }
+    primaryStreams, auditStreams := streamSet(primaryResp.Items), streamSet(auditResp.Items)
+    missing, extra := setDifference(primaryStreams, auditStreams), setDifference(auditStreams, primaryStreams)
+    if len(missing) == 0 && len(extra) == 0 {
+        return ""
+    }
+    problem := fmt.Sprintf("%d streams with the tenancy's credentials, %d with the audit profile", len(primaryStreams), len(auditStreams))
+    if len(missing) > 0 {
+        problem += fmt.Sprintf("; the audit profile misses %d, e.g. %s", len(missing), missing[0])
+    }
+    if len(extra) > 0 {
+        problem += fmt.Sprintf("; only the audit profile sees %d, e.g. %s", len(extra), extra[0])
+    }
+    return problem
+}
+
+// streamSet identifies the returned streams by their dimensions.
+func streamSet(items []monitoring.MetricData) map[string]bool {
+    set := make(map[string]bool, len(items))
+    for _, item := range items {
+        set[formatLabels(item.Dimensions)] = true
+    }
+    return set
+}
+
+// setDifference returns the sorted keys of a that b does not have.
+func setDifference(a, b map[string]bool) []string {
+    var out []string
+    for key := range a {
+        if !b[key] {
+            out = append(out, key)
+        }
+    }
+    sort.Strings(out)
+    return out
+}
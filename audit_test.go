@@ -0,0 +1,67 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+func TestCompareProfiles(t *testing.T) {
+    fixtures, err := fakemonitoring.DefaultFixtures()
+    if err != nil {
+        t.Fatalf("loading fixtures: %v", err)
+    }
+    // The audit profile sees every fixture but the first instance's CPU.
+    var partial []fakemonitoring.Series
+    for _, s := range fixtures {
+        if s.Name != "CpuUtilization" || s.Dimensions["resourceId"] != "ocid1.instance.oc1.iad.redacted0001" {
+            partial = append(partial, s)
+        }
+    }
+    _, fullURL := startFake(t, fixtures)
+    _, partialURL := startFake(t, partial)
+    denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, `{"code":"NotAuthorizedOrNotFound","message":"no"}`, http.StatusNotFound)
+    }))
+    t.Cleanup(denied.Close)
+
+    ten := testTenancy("acme")
+    req := newSummarizeRequest(ten, cpuConfig.Metrics[0], "CpuUtilization", ten.CompartmentID, time.Now(), queryWindow)
+    for _, tc := range []struct {
+        name, primary, audit string
+        // want is part of the problem reported, empty when there is none.
+        want string
+    }{
+        {"same streams", fullURL, fullURL, ""},
+        {"audit misses a stream", fullURL, partialURL, "the audit profile misses 1, e.g. {"},
+        {"audit sees more", partialURL, fullURL, "only the audit profile sees 1"},
+        {"audit denied", fullURL, denied.URL, "the audit profile cannot query it"},
+        {"both denied", denied.URL, denied.URL, ""},
+    } {
+        problem := compareProfiles(context.Background(), newFakeClient(t, tc.primary), newFakeClient(t, tc.audit), req)
+        if tc.want == "" && problem != "" || !strings.Contains(problem, tc.want) {
+            t.Errorf("%s: problem = %q, want %q", tc.name, problem, tc.want)
+        }
+    }
+}
+
+func TestAuditProfileWarning(t *testing.T) {
+    own, other := testTenancy("own"), testTenancy("other")
+    own.Profile, own.AuditProfile = "prod", "prod"
+    other.Profile, other.AuditProfile = "prod", "auditor"
+    warnings := configWarnings(TenancyConfig{Tenancies: []Tenancy{own, other}}, cpuConfig)
+    var found []string
+    for _, w := range warnings {
+        if strings.Contains(w, "audit_profile") {
+            found = append(found, w)
+        }
+    }
+    if len(found) != 1 || !strings.Contains(found[0], "tenancy own:") {
+        t.Errorf("audit_profile warnings %q, want one for tenancy own", found)
+    }
+}
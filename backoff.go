@@ -0,0 +1,84 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+)
+
+// queryBackoffBase is the delay after a query's first failure; it doubles with
+// every further consecutive failure, up to the configured maximum.
+const queryBackoffBase = time.Minute
+
+type backoffEntry struct {
+    failures int
+    next     time.Time
+}
+
+// queryBackoff delays queries that keep failing, such as ones with invalid MQL,
+// so broken config does not spend API quota every cycle. Queries are keyed by
+// tenancy, compartment, namespace and query text, so editing a query retries
+// it at once. A success forgets the query.
+type queryBackoff struct {
+    max time.Duration
+
+    mu      sync.Mutex
+    entries map[string]*backoffEntry
+}
+
+func newQueryBackoff(max time.Duration) *queryBackoff {
+    return &queryBackoff{max: max, entries: make(map[string]*backoffEntry)}
+}
+
+func backoffKey(tenancy, compartmentID, namespace, query string) string {
+    return strings.Join([]string{tenancy, compartmentID, namespace, query}, "\xff")
+}
+
+// Allow reports whether the query may be sent at now.
+func (b *queryBackoff) Allow(key string, now time.Time) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    e, ok := b.entries[key]
+    return !ok || !now.Before(e.next)
+}
+
+// Failure records a failure of the query and returns how many failed in a row
+// and when the query may be sent next.
+func (b *queryBackoff) Failure(key string, now time.Time) (int, time.Time) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    e, ok := b.entries[key]
+    if !ok {
+        e = &backoffEntry{}
+        b.entries[key] = e
+    }
+    e.failures++
+    delay := b.max
+    if e.failures <= 30 {
+        if d := queryBackoffBase << (e.failures - 1); d < b.max {
+            delay = d
+        }
+    }
+    e.next = now.Add(delay)
+    return e.failures, e.next
+}
+
+// Success forgets the query and reports whether it had been failing.
+func (b *queryBackoff) Success(key string) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    _, ok := b.entries[key]
+    delete(b.entries, key)
+    return ok
+}
+
+// forget drops the entries of the tenancy.
+func (b *queryBackoff) forget(tenancy string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for key := range b.entries {
+        if strings.HasPrefix(key, tenancy+"\xff") {
+            delete(b.entries, key)
+        }
+    }
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestQueryBackoff(t *testing.T) {
+    b := newQueryBackoff(3 * time.Minute)
+    key := backoffKey("acme", "ocid1.compartment.oc1..test", "oci_computeagent", "CpuUtilization[1m].mean()")
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    if !b.Allow(key, now) {
+        t.Fatal("a query that never failed is backing off")
+    }
+    // The delay doubles from a minute and stops at the maximum.
+    for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+        failures, next := b.Failure(key, now)
+        if failures != i+1 || next.Sub(now) != want {
+            t.Errorf("failure %d: got %d failures, next in %v, want %d and %v", i+1, failures, next.Sub(now), i+1, want)
+        }
+        if b.Allow(key, next.Add(-time.Second)) || !b.Allow(key, next) {
+            t.Errorf("failure %d: query not held back until %v", i+1, next)
+        }
+    }
+    if !b.Allow(backoffKey("acme", "ocid1.compartment.oc1..test", "oci_computeagent", "CpuUtilization[5m].mean()"), now) {
+        t.Error("an edited query is backing off")
+    }
+    if !b.Success(key) || b.Success(key) {
+        t.Error("Success did not report the query as failing exactly once")
+    }
+    if !b.Allow(key, now) {
+        t.Error("query still backing off after a success")
+    }
+
+    b.Failure(key, now)
+    b.Failure(backoffKey("other", "ocid1.compartment.oc1..test", "oci_computeagent", "CpuUtilization[1m].mean()"), now)
+    b.forget("acme")
+    if len(b.entries) != 1 {
+        t.Errorf("%d entries after forgetting acme, want only the other tenancy's", len(b.entries))
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesBudgets enforces the max_resources of metric entries. It remembers
+// when each resource of a budgeted metric last got a datapoint, and evicts the
+// least recently updated resources of a metric over its budget, so a fleet that
+// churns keeps its most active resources instead of the first ones seen.
+type seriesBudgets struct {
+    mu sync.Mutex
+    // updated maps a tenancy, then a namespace and metric, then a resource ID to
+    // the time of the resource's latest stored datapoint.
+    updated   map[string]map[string]map[string]time.Time
+    evictions *prometheus.CounterVec
+}
+
+func newSeriesBudgets(self *selfMetrics) *seriesBudgets {
+    return &seriesBudgets{
+        updated:   make(map[string]map[string]map[string]time.Time),
+        evictions: self.counterVec("evicted_series_total", "Series dropped because their metric had more resources than the entry's max_resources, least recently updated first.", "tenancy", "namespace"),
+    }
+}
+
+// budgetKey identifies a metric of a namespace within a tenancy's budgets.
+func budgetKey(namespace, metric string) string {
+    return namespace + "\xff" + metric
+}
+
+// touch records that a series of the resource was stored with a datapoint taken at.
+func (b *seriesBudgets) touch(tenancy, namespace, metric, resourceID string, at time.Time) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    metrics := b.updated[tenancy]
+    if metrics == nil {
+        metrics = make(map[string]map[string]time.Time)
+        b.updated[tenancy] = metrics
+    }
+    key := budgetKey(namespace, metric)
+    if metrics[key] == nil {
+        metrics[key] = make(map[string]time.Time)
+    }
+    if prev, ok := metrics[key][resourceID]; !ok || at.After(prev) {
+        metrics[key][resourceID] = at
+    }
+}
+
+// evict forgets the least recently updated resources of every metric of the
+// namespace with more than budget resources, and returns them by metric. Ties
+// go by resource ID so the same resources are kept every cycle.
+func (b *seriesBudgets) evict(tenancy, namespace string, budget int) map[string]map[string]bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    var out map[string]map[string]bool
+    prefix := namespace + "\xff"
+    for key, resources := range b.updated[tenancy] {
+        if len(resources) <= budget || !strings.HasPrefix(key, prefix) {
+            continue
+        }
+        ids := make([]string, 0, len(resources))
+        for id := range resources {
+            ids = append(ids, id)
+        }
+        sort.Slice(ids, func(i, j int) bool {
+            ti, tj := resources[ids[i]], resources[ids[j]]
+            if !ti.Equal(tj) {
+                return ti.Before(tj)
+            }
+            return ids[i] < ids[j]
+        })
+        evicted := make(map[string]bool, len(ids)-budget)
+        for _, id := range ids[:len(ids)-budget] {
+            evicted[id] = true
+            delete(resources, id)
+        }
+        if out == nil {
+            out = make(map[string]map[string]bool)
+        }
+        out[strings.TrimPrefix(key, prefix)] = evicted
+    }
+    return out
+}
+
+// retain forgets the tenancy's metrics of namespaces no entry of config budgets.
+func (b *seriesBudgets) retain(tenancy string, config MetricConfig) {
+    budgeted := make(map[string]bool)
+    for _, ns := range config.Metrics {
+        if ns.MaxResources > 0 {
+            budgeted[ns.Namespace] = true
+        }
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for key := range b.updated[tenancy] {
+        namespace, _, _ := strings.Cut(key, "\xff")
+        if !budgeted[namespace] {
+            delete(b.updated[tenancy], key)
+        }
+    }
+}
+
+// forget drops the budgets of a tenancy.
+func (b *seriesBudgets) forget(tenancy string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    delete(b.updated, tenancy)
+}
+
+// enforceBudget drops the series of the resources evicted from the entry's
+// metrics and returns how many value series it removed.
+func (c *collector) enforceBudget(ten Tenancy, ns MetricNamespace) int {
+    removed := 0
+    for metric, ids := range c.budgets.evict(ten.Label, ns.Namespace, ns.MaxResources) {
+        n := c.store.DeleteMetricResources(ten.Label, ns.Namespace, metric, ids)
+        for _, s := range []*sampleStore{c.seriesState, c.coverage, c.resolution, c.compat} {
+            if s != nil {
+                s.DeleteMetricResources(ten.Label, ns.Namespace, metric, ids)
+            }
+        }
+        c.histograms.DeleteMetricResources(ten.Label, ns.Namespace, metric, ids)
+        c.budgets.evictions.WithLabelValues(ten.Label, ns.Namespace).Add(float64(n))
+        debugf("Tenancy %s: %s in %s has more than %d resources, evicted %d least recently updated (%d series)", ten.Name, metric, ns.Namespace, ns.MaxResources, len(ids), n)
+        removed += n
+    }
+    return removed
+}
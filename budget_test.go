@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBudgetEvictsLeastRecentlyUpdated(t *testing.T) {
+    b := newSeriesBudgets(newSelfMetrics(prometheus.NewRegistry(), defaultSelfMetricsPrefix))
+    at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    b.touch("acme", "oci_computeagent", "CpuUtilization", "a", at)
+    b.touch("acme", "oci_computeagent", "CpuUtilization", "b", at.Add(2*time.Minute))
+    b.touch("acme", "oci_computeagent", "CpuUtilization", "c", at.Add(time.Minute))
+    b.touch("acme", "oci_computeagent", "CpuUtilization", "d", at.Add(time.Minute))
+    // An older datapoint does not make a resource look less recent.
+    b.touch("acme", "oci_computeagent", "CpuUtilization", "b", at)
+    b.touch("acme", "oci_vcn", "VnicToNetworkBytes", "e", at)
+    b.touch("other", "oci_computeagent", "CpuUtilization", "f", at)
+
+    // Of c and d, updated at the same time, c goes first by ID.
+    want := map[string]map[string]bool{"CpuUtilization": {"a": true, "c": true}}
+    if got := b.evict("acme", "oci_computeagent", 2); !reflect.DeepEqual(got, want) {
+        t.Errorf("evicted %v, want %v", got, want)
+    }
+    if got := b.evict("acme", "oci_computeagent", 2); got != nil {
+        t.Errorf("second eviction = %v, want nothing", got)
+    }
+    if got := b.evict("acme", "oci_vcn", 0); !reflect.DeepEqual(got, map[string]map[string]bool{"VnicToNetworkBytes": {"e": true}}) {
+        t.Errorf("other namespace evicted %v, want e", got)
+    }
+}
+
+func TestCollectMaxResources(t *testing.T) {
+    _, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    metrics := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}, MaxResources: 1}}}
+
+    stats, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, metrics)
+    if err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    if found := findSamples(c.store, map[string]string{"tenancy": "acme", "metric": "CpuUtilization"}); len(found) != 1 {
+        t.Errorf("stored %v, want the one resource of the budget", found)
+    }
+    if stats.removed != 1 {
+        t.Errorf("cycle removed %d series, want 1", stats.removed)
+    }
+    if got := testutil.ToFloat64(c.budgets.evictions.WithLabelValues("acme", "oci_computeagent")); got != 1 {
+        t.Errorf("evicted_series_total = %v, want 1", got)
+    }
+}
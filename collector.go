@@ -0,0 +1,830 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "text/template"
+    "time"
+    "unicode/utf8"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// collector holds the state shared by the collection cycles of every tenancy loop.
+type collector struct {
+    store     *sampleStore
+    endOffset time.Duration
+    // limiter, when set, adapts how many requests are in flight to the 429 rate.
+    limiter *adaptiveLimiter
+    // rootQuery is the -root-query default, see rootScope.
+    rootQuery bool
+    // metricWindow is the window of entries that set none (-metric-window).
+    metricWindow time.Duration
+    // maxItems, when positive, truncates responses with more items.
+    maxItems int
+    // allowedDimensions limits the dimensions entries may export as labels.
+    allowedDimensions *dimensionAllowlist
+    // explain, when set, is told the verdict on every returned stream (-explain).
+    explain func(streamVerdict)
+    // resolutionChoices remembers which resolution served each stream of
+    // entries with resolutions.
+    resolutionChoices *resolutionCache
+    // budgets evicts resources of entries over their max_resources.
+    budgets *seriesBudgets
+    // maxLabelLength, when positive, truncates label values taken from dimensions.
+    maxLabelLength int
+    resolutions    *resolutionDetector
+    // pacers space each tenancy's queries.
+    pacers *tenancyPacers
+    // resourceInfo, when set, receives an oci_resource_info series per resource.
+    resourceInfo *sampleStore
+    // seriesState, when set, receives oci_metric_state for every returned stream.
+    seriesState *sampleStore
+    // queryDump, when set, receives every query of each cycle.
+    queryDump *queryDump
+    // queryInfo, when set, adds a query_hash label to every series and exports
+    // the queries behind the hashes.
+    queryInfo *queryInfo
+    // coverage, when set, receives oci_metric_coverage for every stored series
+    // whose response item reports a coverage.
+    coverage *sampleStore
+    // resolution receives oci_metric_resolution_seconds for every stored
+    // series of entries with resolutions.
+    resolution *sampleStore
+    // heartbeat, when set, is told the outcome of every cycle.
+    heartbeat *heartbeatPusher
+    // backoff, when set, delays queries that keep failing.
+    backoff *queryBackoff
+    // compat, when set, receives the compat_metric_names copies of value series.
+    compat *sampleStore
+    // active, when set, limits series to resources that reported recently.
+    active *activeSet
+    // alarms, when set, receives the suppression state of OCI alarms.
+    alarms *alarmSuppressions
+    // lbHealth, when set, receives oci_lb_backend_healthy series.
+    lbHealth *sampleStore
+    // tenancyInfo has one oci_tenancy_info series per configured tenancy.
+    tenancyInfo *prometheus.GaugeVec
+    // collecting holds oci_namespace_collecting; collectingNamespaces the
+    // namespaces last set for each tenancy.
+    collecting           *prometheus.GaugeVec
+    collectingNamespaces sync.Map
+    // tenancyUp is 1 for collected tenancies and 0, with the reason, for ones
+    // whose client could not be created and for removed ones until they are
+    // purged, when tenancyRemoved records the removal time.
+    tenancyUp      *prometheus.GaugeVec
+    tenancyRemoved *prometheus.GaugeVec
+    histograms     *histogramStore
+    throttles      *throttleTracker
+    regions        *regionHealth
+    self           *selfMetrics
+    // lastErrors keeps the last error of every failing entry.
+    lastErrors *entryErrors
+    // dnsWarned holds the tenancies whose endpoint resolution failure was logged.
+    dnsWarned sync.Map
+}
+
+// queryVars are the variables available to a query template.
+type queryVars struct {
+    Name          string
+    Namespace     string
+    ResourceGroup string
+    Interval      string
+    Tenancy       string
+    Region        string
+}
+
+// renderQuery executes the query template text with vars. Referencing a variable
+// that queryVars does not define is an error.
+func renderQuery(text string, vars queryVars) (string, error) {
+    tmpl, err := template.New("query").Option("missingkey=error").Parse(text)
+    if err != nil {
+        return "", err
+    }
+    var b strings.Builder
+    if err := tmpl.Execute(&b, vars); err != nil {
+        return "", err
+    }
+    return b.String(), nil
+}
+
+// query builds the MQL query for one metric name of the namespace, aggregated over
+// window. An entry with a query template renders it instead; templates are checked
+// at load, so a render error only falls back to the default query.
+func (ns MetricNamespace) query(ten Tenancy, name string, window time.Duration) string {
+    if ns.Query != "" {
+        q, err := renderQuery(ns.Query, queryVars{
+            Name:          name,
+            Namespace:     ns.Namespace,
+            ResourceGroup: ns.ResourceGroup,
+            Interval:      mqlInterval(window),
+            Tenancy:       ten.Label,
+            Region:        ten.Region,
+        })
+        if err == nil {
+            return q
+        }
+        log.Printf("Rendering query template of %s in %s for tenancy %s: %v", name, ns.Namespace, ten.Name, err)
+    }
+    stat := "mean"
+    if ns.statistic != "" {
+        stat = ns.statistic
+    }
+    if ns.AggregationScope == scopeCompartment {
+        return fmt.Sprintf("%s[%s].groupBy(compartmentId).%s()%s", name, mqlInterval(window), stat, ns.QuerySuffix)
+    }
+    if len(ns.GroupBy) > 0 {
+        return fmt.Sprintf("%s[%s].groupBy(%s).%s()%s", name, mqlInterval(window), strings.Join(ns.GroupBy, ", "), stat, ns.QuerySuffix)
+    }
+    if ns.groupAll {
+        return fmt.Sprintf("%s[%s].grouping().%s()%s", name, mqlInterval(window), stat, ns.QuerySuffix)
+    }
+    return fmt.Sprintf("%s[%s].%s()%s", name, mqlInterval(window), stat, ns.QuerySuffix)
+}
+
+// mqlInterval formats d as an MQL interval such as 1m, 2h or 1d.
+func mqlInterval(d time.Duration) string {
+    switch {
+    case d%(24*time.Hour) == 0:
+        return fmt.Sprintf("%dd", d/(24*time.Hour))
+    case d%time.Hour == 0:
+        return fmt.Sprintf("%dh", d/time.Hour)
+    default:
+        return fmt.Sprintf("%dm", d/time.Minute)
+    }
+}
+
+// seriesLabels returns the labels for one returned metric stream. Compartment-scoped
+// entries carry compartment_id in place of the per-resource labels; custom entries
+// carry every returned dimension instead, and group_by entries exactly their
+// grouping keys. window, if not empty, is added as a label.
+func seriesLabels(ten Tenancy, ns MetricNamespace, metric, window string, item monitoring.MetricData) prometheus.Labels {
+    labels := prometheus.Labels{
+        "tenancy":   ten.Label,
+        "region":    ten.Region,
+        "namespace": ns.Namespace,
+        "metric":    metric,
+    }
+    if window != "" {
+        labels["window"] = window
+    }
+    if ns.statistic != "" {
+        labels["statistic"] = ns.statistic
+    }
+    if ns.Custom {
+        addDimensionLabels(labels, item.Dimensions)
+        return labels
+    }
+    if len(ns.GroupBy) > 0 || ns.groupAll {
+        for _, key := range ns.GroupBy {
+            labels[groupByLabel(key)] = item.Dimensions[key]
+        }
+        return labels
+    }
+    var used []string
+    if ns.AggregationScope == scopeCompartment {
+        labels["compartment_id"] = itemCompartment(item)
+        used = []string{"compartmentId"}
+    } else {
+        labels["resource_id"] = item.Dimensions["resourceId"]
+        labels["resource_display_name"] = item.Dimensions["resourceDisplayName"]
+        used = []string{"resourceId", "resourceDisplayName"}
+        if ns.rootQuery {
+            // One query covers every compartment, so tell them apart.
+            labels["compartment_id"] = itemCompartment(item)
+        }
+    }
+    used = append(used, addBuiltinDimensionLabels(labels, ns.Namespace, item.Dimensions)...)
+    if ns.PackDimensions {
+        labels["dimensions"] = packDimensions(item.Dimensions, used)
+    }
+    return labels
+}
+
+// groupByLabel returns the label of a group_by key: the sanitized key, with a
+// "dimension_" prefix if it would take the name of a label the exporter sets.
+func groupByLabel(key string) string {
+    name := sanitizeLabelName(key)
+    switch name {
+    case "tenancy", "region", "namespace", "metric", "window", "statistic", "query_hash":
+        return "dimension_" + name
+    }
+    return name
+}
+
+// addDimensionLabels adds every dimension as a label named after its sanitized key.
+// Keys are visited in sorted order, and a name that is already taken, by a standard
+// label or an earlier dimension, gets a "dimension_" prefix and if needed a numeric
+// suffix, so the same dimension set always maps to the same labels.
+func addDimensionLabels(labels prometheus.Labels, dims map[string]string) {
+    keys := make([]string, 0, len(dims))
+    for k := range dims {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        name := sanitizeLabelName(k)
+        if _, taken := labels[name]; taken {
+            name = "dimension_" + name
+        }
+        base := name
+        for i := 2; ; i++ {
+            if _, taken := labels[name]; !taken {
+                break
+            }
+            name = fmt.Sprintf("%s_%d", base, i)
+        }
+        labels[name] = dims[k]
+    }
+}
+
+// sanitizeLabelName maps s to a valid Prometheus label name: characters outside
+// [a-zA-Z0-9_] become underscores, a leading digit gets an underscore prefix, and
+// the reserved "__" prefix is avoided.
+func sanitizeLabelName(s string) string {
+    b := []byte(s)
+    for i, c := range b {
+        if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+            b[i] = '_'
+        }
+    }
+    name := string(b)
+    if name == "" || name[0] >= '0' && name[0] <= '9' {
+        name = "_" + name
+    }
+    if strings.HasPrefix(name, "__") {
+        name = "dimension" + name[1:]
+    }
+    return name
+}
+
+// resourceInfoLabels returns the oci_resource_info labels of the resource a series belongs to.
+func resourceInfoLabels(ten Tenancy, labels prometheus.Labels) prometheus.Labels {
+    return prometheus.Labels{
+        "tenancy":               ten.Label,
+        "region":                ten.Region,
+        "resource_id":           labels["resource_id"],
+        "resource_display_name": labels["resource_display_name"],
+        "console_url":           consoleURL(labels["resource_id"], ten.Region),
+    }
+}
+
+// packDimensions encodes the dimensions not listed in used as compact JSON with
+// sorted keys, so the same dimension set always yields the same label value.
+func packDimensions(dims map[string]string, used []string) string {
+    rest := make(map[string]string, len(dims))
+    for k, v := range dims {
+        rest[k] = v
+    }
+    for _, k := range used {
+        delete(rest, k)
+    }
+    b, err := json.Marshal(rest)
+    if err != nil {
+        return "{}"
+    }
+    return string(b)
+}
+
+// summarizeWithRetry retries up to 3 times on HTTP 429 with exponential backoff.
+// It gives up early when ctx is cancelled. observe, if not nil, sees every attempt.
+// Every attempt holds a slot of limiter while in flight.
+func summarizeWithRetry(ctx context.Context, client monitoring.MonitoringClient, req monitoring.SummarizeMetricsDataRequest, observe attemptObserver, limiter *adaptiveLimiter) (monitoring.SummarizeMetricsDataResponse, error) {
+    var resp monitoring.SummarizeMetricsDataResponse
+    var err error
+    for attempt := 0; attempt < 3; attempt++ {
+        if err := limiter.Acquire(ctx); err != nil {
+            return resp, err
+        }
+        resp, err = client.SummarizeMetricsData(ctx, req)
+        limiter.Release(isThrottled(err))
+        if observe != nil {
+            observe(resp, err)
+        }
+        if !isThrottled(err) {
+            return resp, err
+        }
+        backoff := time.Duration(1<<attempt) * time.Second
+        log.Printf("TooManyRequests, backing off %v", backoff)
+        if !sleepCtx(ctx, backoff) {
+            return resp, ctx.Err()
+        }
+    }
+    return resp, err
+}
+
+// sleepCtx sleeps for d and reports whether it did so without ctx being cancelled.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-ctx.Done():
+        return false
+    case <-t.C:
+        return true
+    }
+}
+
+// queryWindow is the default -metric-window, the span each query aggregates
+// over unless the entry picks its own.
+const queryWindow = time.Minute
+
+// newSummarizeRequest builds the SummarizeMetricsData request for one metric of ns
+// in one compartment, over the window ending at end. Times are sent in UTC, so the
+// host time zone and its DST changes never affect the window.
+func newSummarizeRequest(ten Tenancy, ns MetricNamespace, name, compartmentID string, end time.Time, window time.Duration) monitoring.SummarizeMetricsDataRequest {
+    end = end.UTC()
+    startTime := common.SDKTime{Time: end.Add(-window)}
+    endTime := common.SDKTime{Time: end}
+    req := monitoring.SummarizeMetricsDataRequest{
+        CompartmentId:          common.String(compartmentID),
+        CompartmentIdInSubtree: common.Bool(inSubtree(ten, ns)),
+        SummarizeMetricsDataDetails: monitoring.SummarizeMetricsDataDetails{
+            Namespace: common.String(ns.Namespace),
+            Query:     common.String(ns.query(ten, name, window)),
+            StartTime: &startTime,
+            EndTime:   &endTime,
+        },
+    }
+    if ns.ResourceGroup != "" {
+        req.SummarizeMetricsDataDetails.ResourceGroup = common.String(ns.ResourceGroup)
+    }
+    if resolution := ns.requestResolution(window); resolution != "" {
+        req.SummarizeMetricsDataDetails.Resolution = common.String(resolution)
+    }
+    return req
+}
+
+// collectTenancy queries each metric in each of the tenancy's compartments and records
+// the latest values in the store. client must already be set to the tenancy's region.
+// The query window ends endOffset before now so that it only covers data OCI has already ingested.
+// Each query first waits for its turn from the pacers.
+// It returns what the cycle did, and the last query error if no query succeeded.
+func (c *collector) collectTenancy(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartments []string, config MetricConfig) (cycleStats, error) {
+    now := time.Now().UTC()
+    stats := cycleStats{
+        Errors:  make(map[string]int),
+        queried: make(map[string]int),
+        empty:   make(map[string]int),
+        stored:  make(map[string]int),
+        failed:  make(map[string]int),
+        schemas: make(labelSchemas),
+    }
+    track := c.throttles.observer(ten.Label)
+    apiCalls := c.self.apiCalls.WithLabelValues(ten.Label, "SummarizeMetricsData")
+    throttled := c.self.throttled.WithLabelValues(ten.Label)
+    retries := c.self.retries.WithLabelValues(ten.Label)
+    observe := func(resp monitoring.SummarizeMetricsDataResponse, err error) {
+        stats.Requests++
+        apiCalls.Inc()
+        c.regions.record(ten, err, time.Now())
+        if isThrottled(err) {
+            stats.Throttled++
+            throttled.Inc()
+        }
+        track(resp, err)
+    }
+    var lastErr error
+    succeeded := false
+    var dumps []dumpedQuery
+    var namer *compatNamer
+    if c.compat != nil {
+        if config.CompatMetricNames != "" {
+            namer, _ = newCompatNamer(config.CompatMetricNames)
+        } else {
+            // The option was removed on reload, if it was ever set.
+            c.compat.DeleteTenancy(ten.Label)
+        }
+    }
+
+    var entries []MetricNamespace
+    for _, ns := range config.Metrics {
+        entries = append(entries, ns.perStatistic()...)
+    }
+    queryIn, keep := c.rootScope(ten, compartments)
+    for _, ns := range entries {
+        ns.rootQuery = keep != nil
+        ns = c.allowedDimensions.groupBy(ten, ns)
+        offset, _ := ns.endOffset(c.endOffset)
+        windows, _ := ns.queryWindows()
+        resolutions, _ := ns.queryResolutions()
+        resources := make(map[string]map[string]bool, len(ns.Names))
+
+        for _, compartmentID := range queryIn {
+            for _, name := range ns.Names {
+                if ctx.Err() != nil {
+                    return stats, ctx.Err()
+                }
+                // Each window is a separate request, paced and counted like any other.
+                queryWindows := windows
+                var pass *resolutionPass
+                if len(resolutions) > 0 {
+                    queryWindows = resolutions
+                    pass = c.resolutionChoices.start(ten.Label, ns.Namespace, name, compartmentID, len(resolutions)-1, now)
+                } else if len(queryWindows) == 0 {
+                    queryWindows = []time.Duration{c.window(ctx, client, ten, compartmentID, ns, name, observe)}
+                }
+                for i, window := range queryWindows {
+                    if ctx.Err() != nil {
+                        return stats, ctx.Err()
+                    }
+                    if pass != nil {
+                        if !pass.query(i) {
+                            continue
+                        }
+                        ns.queriedResolution = window
+                    }
+                    windowLabel := ""
+                    if len(windows) > 0 {
+                        windowLabel = mqlInterval(window)
+                    }
+                    req := newSummarizeRequest(ten, ns, name, compartmentID, now.Add(-offset), window)
+                    hash := ""
+                    if c.queryInfo != nil {
+                        hash = c.queryInfo.Observe(ten.Label, ns, *req.SummarizeMetricsDataDetails.Query, ns.requestResolution(window))
+                    }
+                    backoffKey := backoffKey(ten.Label, compartmentID, ns.Namespace, *req.SummarizeMetricsDataDetails.Query)
+                    if c.backoff != nil && !c.backoff.Allow(backoffKey, now) {
+                        stats.BackedOff++
+                        continue
+                    }
+
+                    if err := c.pacers.wait(ctx, ten.Label); err != nil {
+                        return stats, err
+                    }
+                    attempts := stats.Requests
+                    // resp is not kept past this iteration, so at most one response
+                    // per tenancy loop is held in memory at a time.
+                    resp, err := summarizeWithRetry(ctx, client, req, observe, c.limiter)
+                    if n := stats.Requests - attempts - 1; n > 0 {
+                        retries.Add(float64(n))
+                        stats.retries += n
+                    }
+                    if c.queryDump != nil {
+                        dumped := dumpedQuery{
+                            Time:          time.Now().UTC(),
+                            Tenancy:       ten.Label,
+                            CompartmentID: compartmentID,
+                            Namespace:     ns.Namespace,
+                            Query:         *req.SummarizeMetricsDataDetails.Query,
+                            Resolution:    ns.requestResolution(window),
+                            Items:         len(resp.Items),
+                        }
+                        if err != nil {
+                            dumped.Error = err.Error()
+                        }
+                        dumps = append(dumps, dumped)
+                    }
+                    if err != nil {
+                        if id := requestID(err); id != "" {
+                            log.Printf("Error querying %s in %s for tenancy %s (compartment %s, opc-request-id %s): %v", name, ns.Namespace, ten.Name, compartmentID, id, err)
+                            c.self.setLastErrorRequestID(ten.Label, ns.Namespace, id)
+                        } else {
+                            log.Printf("Error querying %s in %s for tenancy %s (compartment %s): %v", name, ns.Namespace, ten.Name, compartmentID, err)
+                        }
+                        lastErr = err
+                        c.lastErrors.Failed(ten, ns.Namespace, name, compartmentID, err, time.Now())
+                        class := errorClass(err)
+                        stats.Errors[class]++
+                        stats.failed[ns.Namespace]++
+                        c.self.queryErrors.WithLabelValues(ten.Label, ns.Namespace, class).Inc()
+                        if class == errorClassDNS {
+                            if _, logged := c.dnsWarned.LoadOrStore(ten.Label, true); !logged {
+                                log.Printf("ERROR: tenancy %s: the Monitoring endpoint for region %s cannot be resolved (%v). Check the region and any endpoint override; every query of this tenancy will fail until it is fixed.", ten.Name, ten.Region, err)
+                            }
+                        }
+                        // Throttling has its own handling, and a cancel is not the query's fault.
+                        if c.backoff != nil && class != "throttled" && class != "canceled" {
+                            failures, next := c.backoff.Failure(backoffKey, now)
+                            if failures > 1 {
+                                log.Printf("Query for %s in %s for tenancy %s (compartment %s) failed %d times in a row, next attempt after %s",
+                                    name, ns.Namespace, ten.Name, compartmentID, failures, next.Format(time.RFC3339))
+                            }
+                        }
+                    } else {
+                        if c.backoff != nil && c.backoff.Success(backoffKey) {
+                            log.Printf("Query for %s in %s for tenancy %s (compartment %s) succeeded again", name, ns.Namespace, ten.Name, compartmentID)
+                        }
+                        succeeded = true
+                        c.lastErrors.Succeeded(ten, ns.Namespace, name, compartmentID)
+                        stats.queried[ns.Namespace]++
+                        if len(resp.Items) == 0 {
+                            stats.empty[ns.Namespace]++
+                        }
+                        c.self.countRetrieval(ten.Label, countDatapoints(resp.Items))
+                        items := resp.Items
+                        if pass != nil {
+                            items = pass.filter(i, items)
+                        }
+                        // Grouped streams span compartments, so they cannot be split.
+                        if keep != nil && len(ns.GroupBy) == 0 && !ns.groupAll {
+                            items = c.keepCompartments(ten, ns, name, items, keep)
+                        }
+                        returned, n, added := c.record(ten, ns, name, compartmentID, windowLabel, hash, items, resources, stats.schemas, namer)
+                        stats.Series += n
+                        stats.stored[ns.Namespace] += n
+                        stats.returned += returned
+                        stats.added += added
+                    }
+                }
+                if pass != nil {
+                    pass.finish()
+                }
+            }
+        }
+
+        if c.self.resources != nil {
+            for _, name := range ns.Names {
+                c.self.resources.WithLabelValues(ten.Label, ns.Namespace, name).Set(float64(len(resources[name])))
+            }
+        }
+        if ns.MaxResources > 0 {
+            stats.removed += c.enforceBudget(ten, ns)
+        }
+    }
+    c.lastErrors.Retain(ten.Label, config)
+    c.budgets.retain(ten.Label, config)
+    c.setCollecting(ten, config, stats)
+    if c.queryInfo != nil {
+        c.queryInfo.EndCycle(ten.Label)
+    }
+    if c.queryDump != nil {
+        c.queryDump.EndCycle(ten.Label, dumps)
+    }
+    if !succeeded {
+        if lastErr == nil && stats.BackedOff > 0 {
+            lastErr = fmt.Errorf("all %d queries are backing off after repeated failures", stats.BackedOff)
+        }
+        return stats, lastErr
+    }
+    // Only cycles that got data age the active set, so an outage does not
+    // empty it.
+    if c.active != nil {
+        if n := c.dropIdleResources(ten.Label, c.active.EndCycle(ten.Label)); n > 0 {
+            log.Printf("Dropped %d series of resources of tenancy %s idle for %d cycles", n, ten.Name, c.active.cycles)
+            stats.removed += n
+        }
+    }
+    return stats, nil
+}
+
+// Reasons of oci_tenancy_up 0.
+const (
+    downClientError = "client_error"
+    downRemoved     = "removed"
+)
+
+// setTenancyUp sets oci_tenancy_up of a tenancy to 1 if reason is empty, and
+// to 0 with the reason otherwise, replacing its series with another reason.
+func (c *collector) setTenancyUp(tenancy, reason string) {
+    c.tenancyUp.DeletePartialMatch(prometheus.Labels{"tenancy": tenancy})
+    up := 1.0
+    if reason != "" {
+        up = 0
+    }
+    c.tenancyUp.WithLabelValues(tenancy, reason).Set(up)
+}
+
+// countDatapoints returns the number of datapoints in items.
+func countDatapoints(items []monitoring.MetricData) int {
+    n := 0
+    for _, item := range items {
+        n += len(item.AggregatedDatapoints)
+    }
+    return n
+}
+
+// Values of oci_metric_state.
+const (
+    seriesPresent  = 0 // the latest datapoint has a value
+    seriesEmpty    = 1 // the stream was returned without datapoints
+    seriesNilValue = 2 // the latest datapoint has no value
+)
+
+// record stores the latest value of every returned series of one query, notes
+// each resource seen in resources, keyed by metric name, and the label names of
+// every series in schemas. It returns the number of streams it was given after
+// -max-response-items, of series stored and of those that are new. With a
+// namer, each value is also stored under its compat_metric_names name, and a
+// non-empty hash is added as the query_hash label. Only the latest value and
+// the labels of each item are copied out, so the response can be released as
+// soon as record returns.
+func (c *collector) record(ten Tenancy, ns MetricNamespace, name, compartmentID, window, hash string, items []monitoring.MetricData, resources map[string]map[string]bool, schemas labelSchemas, namer *compatNamer) (returned, stored, added int) {
+    if c.maxItems > 0 && len(items) > c.maxItems {
+        log.Printf("Warning: query for %s in %s for tenancy %s (compartment %s) returned %d series, keeping the first %d; narrow the compartment or the query",
+            name, ns.Namespace, ten.Name, compartmentID, len(items), c.maxItems)
+        c.self.oversizedResponses.WithLabelValues(ten.Label, ns.Namespace).Inc()
+        items = items[:c.maxItems]
+    }
+    returned = len(items)
+    var statistic string
+    var compatNames map[string]string
+    if namer != nil {
+        statistic = queryStatistic(ns.query(ten, name, queryWindow))
+        compatNames = make(map[string]string)
+    }
+    c.self.streamsReturned.WithLabelValues(ten.Label, ns.Namespace).Add(float64(returned))
+    exported := c.self.streamsExported.WithLabelValues(ten.Label, ns.Namespace)
+    seen := make(map[string]bool, len(items))
+    for _, item := range items {
+        if !ns.allowsState(item.Dimensions) {
+            c.skipStream(ten, ns, name, "filtered", fmt.Sprintf("lifecycle_states %v of the %s entry", ns.LifecycleStates, ns.Namespace), item)
+            continue
+        }
+        item.Dimensions = c.allowedDimensions.dimensions(ten, ns, item.Dimensions)
+        metricLabel := name
+        if item.Name != nil {
+            metricLabel = *item.Name
+        }
+        labels := seriesLabels(ten, ns, metricLabel, window, item)
+        c.truncateLabels(ten, ns, labels)
+        if hash != "" {
+            labels["query_hash"] = hash
+        }
+        schemas.add(ns.Namespace, metricLabel, labels)
+
+        state := seriesPresent
+        var latest monitoring.AggregatedDatapoint
+        if len(item.AggregatedDatapoints) == 0 {
+            state = seriesEmpty
+        } else if latest = item.AggregatedDatapoints[len(item.AggregatedDatapoints)-1]; latest.Value == nil {
+            state = seriesNilValue
+        }
+        if c.seriesState != nil {
+            c.seriesState.Set(labels, float64(state))
+        }
+        switch state {
+        case seriesEmpty:
+            c.skipStream(ten, ns, name, "no_datapoints", "OCI returned the stream without datapoints in the query window", item)
+            continue
+        case seriesNilValue:
+            c.skipStream(ten, ns, name, "nil_value", "the latest datapoint has no value", item)
+            continue
+        }
+        // Two streams of one response with the same labels, such as ones that
+        // differ only in dimensions not exported, would overwrite each other.
+        _, _, key := labelKey(labels)
+        if seen[key] {
+            c.skipStream(ten, ns, name, "collision", "an earlier stream of the response has the same labels; its other dimensions are not exported", item)
+            continue
+        }
+        seen[key] = true
+
+        var ts time.Time
+        if latest.Timestamp != nil {
+            ts = latest.Timestamp.Time
+        }
+        ok, isNew := c.store.SetAt(labels, *latest.Value, ts)
+        if !ok {
+            c.skipStream(ten, ns, name, "stale", "a later datapoint is already stored for the same labels, e.g. by an earlier query of the cycle", item)
+            continue
+        }
+        if isNew {
+            added++
+        }
+        if c.explain != nil {
+            c.explain(streamVerdict{Metric: name, Dimensions: item.Dimensions, Labels: labels, Value: latest.Value, Timestamp: ts})
+        }
+        stored++
+        exported.Inc()
+        if c.coverage != nil {
+            if cov, ok := itemCoverage(item); ok {
+                c.coverage.SetAt(labels, cov, ts)
+            }
+        }
+        if c.resolution != nil && ns.queriedResolution > 0 {
+            c.resolution.SetAt(labels, ns.queriedResolution.Seconds(), ts)
+        }
+        if namer != nil {
+            c.recordCompat(namer, ns.Namespace, metricLabel, statistic, labels, *latest.Value, ts, compatNames)
+        }
+        if len(ns.Buckets) > 0 {
+            c.histograms.Observe(labels, ns.Buckets, item.AggregatedDatapoints)
+        }
+        if resID := item.Dimensions["resourceId"]; resID != "" {
+            if resources[name] == nil {
+                resources[name] = make(map[string]bool)
+            }
+            resources[name][resID] = true
+        }
+        if c.active != nil && labels["resource_id"] != "" {
+            c.active.Seen(ten.Label, labels["resource_id"])
+        }
+        if ns.MaxResources > 0 && labels["resource_id"] != "" {
+            updated := ts
+            if updated.IsZero() {
+                updated = time.Now()
+            }
+            c.budgets.touch(ten.Label, ns.Namespace, metricLabel, labels["resource_id"], updated)
+        }
+        if c.resourceInfo != nil && labels["resource_id"] != "" {
+            c.resourceInfo.Set(resourceInfoLabels(ten, labels), 1)
+        }
+    }
+    return returned, stored, added
+}
+
+// untruncatedLabels are the labels -max-label-length leaves alone: those set by
+// the exporter rather than taken from dimensions, and the OCIDs that identify
+// the series.
+var untruncatedLabels = map[string]bool{
+    "tenancy": true, "region": true, "namespace": true, "metric": true,
+    "window": true, "statistic": true, "query_hash": true,
+    "resource_id": true, "compartment_id": true,
+    "function_id": true, "application_id": true, "cluster_id": true, "node_pool_id": true,
+}
+
+// truncateLabels shortens every dimension label value longer than
+// c.maxLabelLength to that many characters, the last being "…", and counts it.
+func (c *collector) truncateLabels(ten Tenancy, ns MetricNamespace, labels prometheus.Labels) {
+    if c.maxLabelLength <= 0 {
+        return
+    }
+    for name, value := range labels {
+        if untruncatedLabels[name] || utf8.RuneCountInString(value) <= c.maxLabelLength {
+            continue
+        }
+        labels[name] = string([]rune(value)[:c.maxLabelLength-1]) + "…"
+        c.self.truncatedLabels.WithLabelValues(ten.Label, ns.Namespace, name).Inc()
+    }
+}
+
+// setCollecting sets oci_namespace_collecting of every configured namespace of
+// the tenancy to whether the cycle stored at least one series for it, and
+// deletes the namespaces no longer configured.
+func (c *collector) setCollecting(ten Tenancy, config MetricConfig, stats cycleStats) {
+    current := make(map[string]bool)
+    for _, ns := range config.Metrics {
+        current[ns.Namespace] = true
+        v := 0.0
+        if stats.stored[ns.Namespace] > 0 {
+            v = 1
+        }
+        c.collecting.WithLabelValues(ten.Label, ns.Namespace).Set(v)
+    }
+    if prev, ok := c.collectingNamespaces.Load(ten.Label); ok {
+        for ns := range prev.(map[string]bool) {
+            if !current[ns] {
+                c.collecting.DeleteLabelValues(ten.Label, ns)
+            }
+        }
+    }
+    c.collectingNamespaces.Store(ten.Label, current)
+}
+
+// keepCompartments drops the streams of a root query from compartments the
+// tenancy does not collect, counting them as filtered.
+func (c *collector) keepCompartments(ten Tenancy, ns MetricNamespace, name string, items []monitoring.MetricData, keep map[string]bool) []monitoring.MetricData {
+    kept := make([]monitoring.MetricData, 0, len(items))
+    for _, item := range items {
+        if keep[itemCompartment(item)] {
+            kept = append(kept, item)
+        } else {
+            c.skipStream(ten, ns, name, "filtered", fmt.Sprintf("compartment %s is not collected for the tenancy (root query)", itemCompartment(item)), item)
+        }
+    }
+    return kept
+}
+
+// skipStream counts a returned stream that is not exported and logs it at debug
+// level with detail, which names the rule or condition that dropped it.
+func (c *collector) skipStream(ten Tenancy, ns MetricNamespace, name, reason, detail string, item monitoring.MetricData) {
+    c.self.streamsSkipped.WithLabelValues(ten.Label, ns.Namespace, reason).Inc()
+    debugf("Skipped stream of %s in %s for tenancy %s (resource %s): %s: %s", name, ns.Namespace, ten.Name, item.Dimensions["resourceId"], reason, detail)
+    if c.explain != nil {
+        c.explain(streamVerdict{Metric: name, Dimensions: item.Dimensions, Reason: reason, Detail: detail})
+    }
+}
+
+// coverageMetadataKey is the response item metadata key carrying the share of
+// the aggregation window the datapoints cover.
+const coverageMetadataKey = "coverage"
+
+// itemCoverage returns the coverage of item as a ratio between 0 and 1. It
+// accepts a ratio or a percentage such as "85%", and reports false when the
+// namespace does not provide one or it cannot be parsed.
+func itemCoverage(item monitoring.MetricData) (float64, bool) {
+    raw, ok := item.Metadata[coverageMetadataKey]
+    if !ok {
+        return 0, false
+    }
+    raw = strings.TrimSpace(raw)
+    percent := strings.HasSuffix(raw, "%")
+    v, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+    if err != nil || math.IsNaN(v) {
+        return 0, false
+    }
+    if percent {
+        v /= 100
+    }
+    return math.Max(0, math.Min(1, v)), true
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    _ "time/tzdata"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+// fixtureConfig collects every metric of the default fixtures.
+var fixtureConfig = MetricConfig{Metrics: []MetricNamespace{
+    {Namespace: "oci_computeagent", Names: []string{"CpuUtilization", "MemoryUtilization"}},
+    {Namespace: "oci_streaming", Names: []string{"GetMessages.Throughput.Bytes", "PutMessages.TotalThroughput"}},
+}}
+
+func TestCollectTenancyFixtures(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+
+    stats, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, fixtureConfig)
+    if err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    if stats.Requests != 4 || stats.Series != 3 || stats.Throttled != 0 || len(stats.Errors) != 0 {
+        t.Errorf("stats = %+v, want 4 requests, 3 series, no throttling or errors", stats)
+    }
+    if n := len(fake.Requests()); n != 4 {
+        t.Errorf("fake received %d requests, want 4", n)
+    }
+
+    for _, tc := range []struct {
+        metric, resource string
+        want             float64
+    }{
+        {"CpuUtilization", "ocid1.instance.oc1.iad.redacted0001", 13},
+        {"CpuUtilization", "ocid1.instance.oc1.iad.redacted0002", 70.75},
+        {"GetMessages.Throughput.Bytes", "ocid1.stream.oc1.iad.redacted0001", 4096},
+    } {
+        got := sampleValue(t, c.store, map[string]string{"tenancy": "acme", "metric": tc.metric, "resource_id": tc.resource})
+        if got != tc.want {
+            t.Errorf("%s of %s = %v, want the latest datapoint %v", tc.metric, tc.resource, got, tc.want)
+        }
+    }
+    for _, metric := range []string{"MemoryUtilization", "PutMessages.TotalThroughput"} {
+        if found := findSamples(c.store, map[string]string{"metric": metric}); len(found) != 0 {
+            t.Errorf("%s stored %v, want nothing", metric, found)
+        }
+    }
+    for _, tc := range []struct{ namespace, reason string }{
+        {"oci_computeagent", "nil_value"},
+        {"oci_streaming", "no_datapoints"},
+    } {
+        if got := testutil.ToFloat64(c.self.streamsSkipped.WithLabelValues("acme", tc.namespace, tc.reason)); got != 1 {
+            t.Errorf("streams_skipped_total{namespace=%q,reason=%q} = %v, want 1", tc.namespace, tc.reason, got)
+        }
+    }
+    if got := testutil.ToFloat64(c.self.apiCalls.WithLabelValues("acme", "SummarizeMetricsData")); got != 4 {
+        t.Errorf("api_calls_total = %v, want 4", got)
+    }
+}
+
+func TestCollectTenancyThrottled(t *testing.T) {
+    fake, url := startFake(t, nil)
+    fake.Throttle(1)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}}}}
+
+    stats, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, config)
+    if err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    if stats.Requests != 2 || stats.Throttled != 1 || stats.retries != 1 || stats.Series != 2 {
+        t.Errorf("stats = %+v, want 2 requests, 1 throttled, 1 retry and 2 series", stats)
+    }
+    if got := testutil.ToFloat64(c.self.throttled.WithLabelValues("acme")); got != 1 {
+        t.Errorf("throttled_requests_total = %v, want 1", got)
+    }
+    if got := testutil.ToFloat64(c.self.retries.WithLabelValues("acme")); got != 1 {
+        t.Errorf("retries_total = %v, want 1", got)
+    }
+    if got := sampleValue(t, c.store, map[string]string{"resource_id": "ocid1.instance.oc1.iad.redacted0002"}); got != 70.75 {
+        t.Errorf("value after the retry = %v, want 70.75", got)
+    }
+}
+
+func TestCollectTenancyQueryErrors(t *testing.T) {
+    _, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    // The fake rejects a query without an interval, as the service does.
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}, Query: "{{.Name}}.mean()"}}}
+
+    stats, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, config)
+    if err == nil {
+        t.Fatal("collectTenancy succeeded, want the query error")
+    }
+    if stats.Requests != 1 || stats.Series != 0 || len(stats.Errors) != 1 {
+        t.Errorf("stats = %+v, want 1 failed request", stats)
+    }
+    if n := len(c.store.Snapshot()); n != 0 {
+        t.Errorf("store has %d series after a failed cycle, want 0", n)
+    }
+}
+
+func TestWildcardExpansionPaging(t *testing.T) {
+    fake, url := startFake(t, nil)
+    fake.PageSize = 1
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    client := newFakeClient(t, url)
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{wildcardName}}}}
+
+    expanded := newWildcardCache(time.Hour, 0.5).Expand(context.Background(), c, client, ten, []string{ten.CompartmentID}, config)
+    if len(expanded.Metrics) != 1 {
+        t.Fatalf("expanded to %d entries, want 1", len(expanded.Metrics))
+    }
+    if want := []string{"CpuUtilization", "MemoryUtilization"}; !reflect.DeepEqual(expanded.Metrics[0].Names, want) {
+        t.Errorf("expanded names = %v, want %v", expanded.Metrics[0].Names, want)
+    }
+    // Three fixture streams at one per page.
+    if got := testutil.ToFloat64(c.self.apiCalls.WithLabelValues("acme", "ListMetrics")); got != 3 {
+        t.Errorf("ListMetrics api_calls_total = %v, want 3", got)
+    }
+
+    stats, err := c.collectTenancy(context.Background(), client, ten, []string{ten.CompartmentID}, expanded)
+    if err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    if stats.Requests != 2 || stats.Series != 2 {
+        t.Errorf("stats = %+v, want 2 requests and 2 series", stats)
+    }
+}
+
+func TestWildcardExpansionInCompartmentIDs(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    ten.CompartmentID = ""
+    ten.CompartmentIDs = []string{"ocid1.compartment.oc1..a", "ocid1.compartment.oc1..b"}
+    ten.CompartmentIDInSubtree = new(bool)
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{wildcardName}}}}
+
+    expanded := newWildcardCache(time.Hour, 0.5).Expand(context.Background(), c, newFakeClient(t, url), ten, ten.queryCompartments(nil), config)
+    if len(expanded.Metrics) != 1 {
+        t.Fatalf("expanded to %d entries, want 1", len(expanded.Metrics))
+    }
+    if want := []string{"CpuUtilization", "MemoryUtilization"}; !reflect.DeepEqual(expanded.Metrics[0].Names, want) {
+        t.Errorf("expanded names = %v, want %v", expanded.Metrics[0].Names, want)
+    }
+    listed := make(map[string]bool)
+    for _, r := range fake.ListRequests() {
+        if r.InSubtree {
+            t.Errorf("listed %s with its subtree, want without", r.CompartmentID)
+        }
+        listed[r.CompartmentID] = true
+    }
+    if want := map[string]bool{"ocid1.compartment.oc1..a": true, "ocid1.compartment.oc1..b": true}; !reflect.DeepEqual(listed, want) {
+        t.Errorf("listed compartments %v, want %v", listed, want)
+    }
+}
+
+// collectSameMinute runs collectTenancy until every query of the run ended in
+// the same minute, so the fake served the same datapoints to all of them.
+func collectSameMinute(t *testing.T, c *collector, fake *fakemonitoring.Server, url string, ten Tenancy, compartments []string, config MetricConfig, cycles int) {
+    t.Helper()
+    client := newFakeClient(t, url)
+    for attempt := 0; attempt < 3; attempt++ {
+        before := len(fake.Requests())
+        for i := 0; i < cycles; i++ {
+            if _, err := c.collectTenancy(context.Background(), client, ten, compartments, config); err != nil {
+                t.Fatalf("collectTenancy: %v", err)
+            }
+        }
+        reqs := fake.Requests()[before:]
+        same := true
+        for _, r := range reqs {
+            same = same && r.End.Truncate(time.Minute).Equal(reqs[0].End.Truncate(time.Minute))
+        }
+        if same {
+            return
+        }
+        c.store = newSampleStore(valueMetricName, "")
+        c.histograms = newHistogramStore("oci_metric_distribution", "")
+    }
+    t.Fatal("queries kept straddling a minute boundary")
+}
+
+func TestOverlappingQueriesDedupe(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    // A compartment and its parent queried with the subtree return the same
+    // streams, and every cycle's window overlaps the previous one.
+    compartments := []string{ten.CompartmentID, "ocid1.compartment.oc1..child"}
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}, Buckets: []float64{50, 100}}}}
+
+    collectSameMinute(t, c, fake, url, ten, compartments, config, 2)
+
+    if found := findSamples(c.store, map[string]string{"tenancy": "acme"}); len(found) != 2 {
+        t.Errorf("%d value series, want one per stream: %v", len(found), found)
+    }
+    if got := sampleValue(t, c.store, map[string]string{"resource_id": "ocid1.instance.oc1.iad.redacted0001"}); got != 13 {
+        t.Errorf("value = %v, want 13", got)
+    }
+    c.histograms.mu.Lock()
+    defer c.histograms.mu.Unlock()
+    if n := len(c.histograms.series); n != 2 {
+        t.Errorf("%d histograms, want 2", n)
+    }
+    for _, hs := range c.histograms.series {
+        // Four responses of three datapoints each, three distinct.
+        if hs.count != 3 {
+            t.Errorf("histogram %v counted %d datapoints, want 3", hs.values, hs.count)
+        }
+    }
+}
+
+func TestRecordIgnoresOlderDatapoint(t *testing.T) {
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    newer := time.Date(2026, 3, 1, 12, 5, 0, 0, time.UTC)
+    item := func(at time.Time, value float64) []monitoring.MetricData {
+        return []monitoring.MetricData{{
+            Name:       common.String("CpuUtilization"),
+            Dimensions: map[string]string{"resourceId": "ocid1.instance.oc1..r1"},
+            AggregatedDatapoints: []monitoring.AggregatedDatapoint{
+                {Timestamp: &common.SDKTime{Time: at}, Value: common.Float64(value)},
+            },
+        }}
+    }
+    match := map[string]string{"tenancy": "acme", "metric": "CpuUtilization"}
+    for _, step := range []struct {
+        name   string
+        at     time.Time
+        value  float64
+        stored int
+        // want is the stored value afterwards and stale the stale count.
+        want  float64
+        stale float64
+    }{
+        {"newer", newer, 2, 1, 2, 0},
+        {"older", newer.Add(-time.Minute), 1, 0, 2, 1},
+        {"same timestamp", newer, 3, 1, 3, 1},
+    } {
+        _, stored, _ := c.record(ten, ns, "CpuUtilization", ten.CompartmentID, "", "", item(step.at, step.value), map[string]map[string]bool{}, make(labelSchemas), nil)
+        if stored != step.stored {
+            t.Errorf("%s: stored %d, want %d", step.name, stored, step.stored)
+        }
+        if got := sampleValue(t, c.store, match); got != step.want {
+            t.Errorf("%s: value = %v, want %v", step.name, got, step.want)
+        }
+        if got := testutil.ToFloat64(c.self.streamsSkipped.WithLabelValues("acme", ns.Namespace, "stale")); got != step.stale {
+            t.Errorf("%s: stale streams = %v, want %v", step.name, got, step.stale)
+        }
+    }
+    if got := testutil.ToFloat64(c.self.streamsExported.WithLabelValues("acme", ns.Namespace)); got != 2 {
+        t.Errorf("exported streams = %v, want 2", got)
+    }
+}
+
+func TestSummarizeRequestWindowInUTC(t *testing.T) {
+    newYork, err := time.LoadLocation("America/New_York")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    for _, end := range []time.Time{
+        time.Date(2026, 6, 1, 12, 0, 30, 0, time.FixedZone("IST", 5*3600+1800)),
+        // An hour after the spring-forward and fall-back transitions, so
+        // that hour-long windows start on the other side of them.
+        time.Date(2026, 3, 8, 3, 30, 0, 0, newYork),
+        time.Date(2026, 11, 1, 1, 30, 0, 0, newYork).Add(time.Hour),
+    } {
+        for _, window := range []time.Duration{time.Minute, 5 * time.Minute, time.Hour} {
+            req := newSummarizeRequest(ten, ns, "CpuUtilization", ten.CompartmentID, end, window)
+            start, stop := req.StartTime.Time, req.EndTime.Time
+            if start.Location() != time.UTC || stop.Location() != time.UTC {
+                t.Errorf("end %v, window %v: times in %v and %v, want UTC", end, window, start.Location(), stop.Location())
+            }
+            if !stop.Equal(end) || stop.Sub(start) != window {
+                t.Errorf("end %v, window %v: got %v to %v", end, window, start, stop)
+            }
+            body, err := json.Marshal(req.SummarizeMetricsDataDetails)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if want := `"endTime":"` + end.UTC().Format(time.RFC3339); !strings.Contains(string(body), want) {
+                t.Errorf("request body %s does not contain %s", body, want)
+            }
+        }
+    }
+}
+
+func TestQueriesSpanTheirWindow(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    ns.Windows = []string{"1m", "5m", "1h"}
+    if _, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, MetricConfig{Metrics: []MetricNamespace{ns}}); err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    var spans []time.Duration
+    for _, r := range fake.Requests() {
+        if _, offset := r.End.Zone(); offset != 0 {
+            t.Errorf("endTime %v was not sent in UTC", r.End)
+        }
+        spans = append(spans, r.End.Sub(r.Start))
+    }
+    if want := []time.Duration{time.Minute, 5 * time.Minute, time.Hour}; !reflect.DeepEqual(spans, want) {
+        t.Errorf("query spans %v, want %v", spans, want)
+    }
+}
+
+// benchStreams is the response size of the hot-path benchmarks, a large
+// tenancy's wildcard namespace.
+const benchStreams = 100000
+
+// benchItems returns n streams of one metric with a single datapoint each,
+// all sharing at as their timestamp.
+func benchItems(n int, at *common.SDKTime) []monitoring.MetricData {
+    items := make([]monitoring.MetricData, n)
+    for i := range items {
+        items[i] = monitoring.MetricData{
+            Name: common.String("CpuUtilization"),
+            Dimensions: map[string]string{
+                "resourceId":          fmt.Sprintf("ocid1.instance.oc1.iad.%08d", i),
+                "resourceDisplayName": fmt.Sprintf("instance-%d", i),
+                "availabilityDomain":  "AD-1",
+            },
+            AggregatedDatapoints: []monitoring.AggregatedDatapoint{{Timestamp: at, Value: common.Float64(float64(i))}},
+        }
+    }
+    return items
+}
+
+func BenchmarkRecord(b *testing.B) {
+    c, _ := newTestCollector(b)
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    at := &common.SDKTime{Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+    items := benchItems(benchStreams, at)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        // Every cycle brings a newer datapoint, so each write is stored.
+        at.Time = at.Time.Add(time.Minute)
+        if _, stored, _ := c.record(ten, ns, "CpuUtilization", ten.CompartmentID, "", "", items, map[string]map[string]bool{}, make(labelSchemas), nil); stored != benchStreams {
+            b.Fatalf("stored %d of %d streams", stored, benchStreams)
+        }
+    }
+}
+
+func TestAddDimensionLabels(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        labels prometheus.Labels
+        dims   map[string]string
+        want   prometheus.Labels
+    }{
+        {
+            name: "names ending in digits",
+            dims: map[string]string{"http2": "h", "ipv4_addr0": "a"},
+            want: prometheus.Labels{"http2": "h", "ipv4_addr0": "a"},
+        },
+        {
+            name:   "standard label taken",
+            labels: prometheus.Labels{"tenancy": "acme"},
+            dims:   map[string]string{"tenancy": "t", "http2": "h"},
+            want:   prometheus.Labels{"tenancy": "acme", "dimension_tenancy": "t", "http2": "h"},
+        },
+        {
+            name: "sanitized keys collide",
+            dims: map[string]string{"ipv4.addr0": "a", "ipv4-addr0": "b", "ipv4_addr0": "c"},
+            want: prometheus.Labels{"ipv4_addr0": "b", "dimension_ipv4_addr0": "a", "dimension_ipv4_addr0_2": "c"},
+        },
+        {
+            name:   "prefixed name taken",
+            labels: prometheus.Labels{"http2": "x", "dimension_http2": "y"},
+            dims:   map[string]string{"http2": "h"},
+            want:   prometheus.Labels{"http2": "x", "dimension_http2": "y", "dimension_http2_2": "h"},
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            labels := prometheus.Labels{}
+            for k, v := range tc.labels {
+                labels[k] = v
+            }
+            addDimensionLabels(labels, tc.dims)
+            if !reflect.DeepEqual(labels, tc.want) {
+                t.Errorf("labels = %v, want %v", labels, tc.want)
+            }
+        })
+    }
+}
+
+func TestAddBuiltinDimensionLabels(t *testing.T) {
+    labels := prometheus.Labels{}
+    used := addBuiltinDimensionLabels(labels, "oci_streaming", map[string]string{
+        "resourceId":   "ocid1.stream.oc1.iad.redacted",
+        "streamName":   "orders",
+        "resourceName": "ignored",
+        "partitionId":  "0",
+        "streamPoolId": "",
+    })
+    want := prometheus.Labels{"stream_id": "ocid1.stream.oc1.iad.redacted", "stream_name": "orders", "partition": "0"}
+    if !reflect.DeepEqual(labels, want) {
+        t.Errorf("labels = %v, want %v", labels, want)
+    }
+    if want := []string{"resourceId", "streamName", "partitionId"}; !reflect.DeepEqual(used, want) {
+        t.Errorf("used dimensions = %v, want %v", used, want)
+    }
+    if used := addBuiltinDimensionLabels(labels, "oci_computeagent", map[string]string{"resourceId": "x"}); used != nil {
+        t.Errorf("namespace without built-in labels used %v", used)
+    }
+}
+
+func TestTruncateLabels(t *testing.T) {
+    c, _ := newTestCollector(t)
+    c.maxLabelLength = 6
+    ten, ns := testTenancy("acme"), MetricNamespace{Namespace: "oci_computeagent"}
+    labels := prometheus.Labels{
+        "resource_id":   "ocid1.instance.oc1.iad.redacted0001",
+        "resource_name": "instance-éé-long",
+        "shape":         "short",
+    }
+    c.truncateLabels(ten, ns, labels)
+    want := prometheus.Labels{
+        "resource_id":   "ocid1.instance.oc1.iad.redacted0001",
+        "resource_name": "insta…",
+        "shape":         "short",
+    }
+    if !reflect.DeepEqual(labels, want) {
+        t.Errorf("labels = %v, want %v", labels, want)
+    }
+    if got := testutil.ToFloat64(c.self.truncatedLabels.WithLabelValues("acme", "oci_computeagent", "resource_name")); got != 1 {
+        t.Errorf("truncated_label_values_total = %v, want 1", got)
+    }
+}
+
+func TestSetCollecting(t *testing.T) {
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    config := MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent"}, {Namespace: "oci_vcn"}}}
+    c.setCollecting(ten, config, cycleStats{stored: map[string]int{"oci_computeagent": 3}})
+    for ns, want := range map[string]float64{"oci_computeagent": 1, "oci_vcn": 0} {
+        if got := testutil.ToFloat64(c.collecting.WithLabelValues("acme", ns)); got != want {
+            t.Errorf("oci_namespace_collecting{namespace=%q} = %v, want %v", ns, got, want)
+        }
+    }
+
+    c.setCollecting(ten, MetricConfig{Metrics: config.Metrics[:1]}, cycleStats{})
+    if n := testutil.CollectAndCount(c.collecting); n != 1 {
+        t.Errorf("%d oci_namespace_collecting series after oci_vcn was dropped, want 1", n)
+    }
+}
+
+func TestGroupBy(t *testing.T) {
+    ns := MetricNamespace{Namespace: "oci_lbaas", GroupBy: []string{"backendSetName", "metric"}}
+    if got, want := ns.query(testTenancy("acme"), "HttpRequests", time.Minute), "HttpRequests[1m].groupBy(backendSetName, metric).mean()"; got != want {
+        t.Errorf("query = %q, want %q", got, want)
+    }
+    item := monitoring.MetricData{Dimensions: map[string]string{"backendSetName": "web", "metric": "x", "resourceId": "ocid1.loadbalancer.oc1..a"}}
+    labels := seriesLabels(testTenancy("acme"), ns, "HttpRequests", "", item)
+    for name, want := range map[string]string{"backendSetName": "web", "dimension_metric": "x", "metric": "HttpRequests"} {
+        if labels[name] != want {
+            t.Errorf("label %s = %q, want %q", name, labels[name], want)
+        }
+    }
+    if _, ok := labels["resource_id"]; ok {
+        t.Errorf("grouped series has resource_id: %v", labels)
+    }
+
+    for _, invalid := range []MetricNamespace{
+        {Namespace: "oci_lbaas", GroupBy: []string{"backendSetName"}, Custom: true},
+        {Namespace: "oci_lbaas", GroupBy: []string{"backendSetName"}, AggregationScope: scopeCompartment},
+        {Namespace: "oci_lbaas", GroupBy: []string{"backend set"}},
+    } {
+        if err := invalid.validateGroupBy(); err == nil {
+            t.Errorf("group_by of %+v accepted", invalid)
+        }
+    }
+}
+
+func TestDimensionAllowlist(t *testing.T) {
+    if a := newDimensionAllowlist(" , "); a != nil {
+        t.Errorf("empty list = %+v, want nil, which allows every dimension", a)
+    }
+    a := newDimensionAllowlist("faultDomain, shape")
+    ten := testTenancy("acme")
+    custom := MetricNamespace{Namespace: "custom_app", Custom: true}
+    got := a.dimensions(ten, custom, map[string]string{"faultDomain": "FD-1", "hostname": "h1", "resourceId": "r1"})
+    if want := map[string]string{"faultDomain": "FD-1", "resourceId": "r1"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("dimensions = %v, want %v", got, want)
+    }
+    if !a.allowed("oci_streaming", "streamName") {
+        t.Error("built-in dimension label of oci_streaming blocked")
+    }
+
+    grouped := a.groupBy(ten, MetricNamespace{Namespace: "oci_computeagent", GroupBy: []string{"shape", "hostname"}})
+    if !reflect.DeepEqual(grouped.GroupBy, []string{"shape"}) || grouped.groupAll {
+        t.Errorf("group_by = %v (all %v), want [shape]", grouped.GroupBy, grouped.groupAll)
+    }
+    if all := a.groupBy(ten, MetricNamespace{Namespace: "oci_computeagent", GroupBy: []string{"hostname"}}); len(all.GroupBy) != 0 || !all.groupAll {
+        t.Errorf("group_by = %v (all %v), want the streams aggregated into one", all.GroupBy, all.groupAll)
+    }
+}
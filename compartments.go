@@ -0,0 +1,140 @@
+package main
+
+import (
+    "context"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+const (
+    discoveryMerge   = "merge"
+    discoveryReplace = "replace"
+)
+
+// queryCompartments returns the compartments a tenancy is queried in. Explicit
+// compartment_ids take precedence over compartment_id. When discovery is enabled,
+// the discovered compartments are merged with that list (discovery_mode merge,
+// the default) or used in its place (replace; the explicit list is still used until
+// discovery first succeeds). Duplicates are dropped, order kept.
+func (ten Tenancy) queryCompartments(discovered []string) []string {
+    explicit := ten.CompartmentIDs
+    if len(explicit) == 0 && ten.CompartmentID != "" {
+        explicit = []string{ten.CompartmentID}
+    }
+    var ids []string
+    if !ten.DiscoverCompartments {
+        ids = explicit
+    } else if ten.DiscoveryMode == discoveryReplace && len(discovered) > 0 {
+        ids = discovered
+    } else {
+        ids = append(append([]string{}, explicit...), discovered...)
+    }
+
+    seen := make(map[string]bool, len(ids))
+    out := ids[:0:0]
+    for _, id := range ids {
+        if !seen[id] {
+            seen[id] = true
+            out = append(out, id)
+        }
+    }
+    return out
+}
+
+// inSubtree reports whether queries for ns in ten include each compartment's
+// subtree. The namespace setting wins over the tenancy setting. Without either,
+// subtree queries are on, unless compartment discovery is enabled: discovery
+// already enumerates the subtree, and querying it again would duplicate streams.
+func inSubtree(ten Tenancy, ns MetricNamespace) bool {
+    if ns.rootQuery {
+        return true
+    }
+    if ns.CompartmentIDInSubtree != nil {
+        return *ns.CompartmentIDInSubtree
+    }
+    if ten.CompartmentIDInSubtree != nil {
+        return *ten.CompartmentIDInSubtree
+    }
+    return !ten.DiscoverCompartments
+}
+
+// discoverCompartments lists the active compartments below the tenancy's
+// compartment_id, including itself. A subtree listing is only allowed from the
+// tenancy root, so other starting points are walked level by level.
+func discoverCompartments(ctx context.Context, client identity.IdentityClient, ten Tenancy) ([]string, error) {
+    ids := []string{ten.CompartmentID}
+    if ten.CompartmentID == ten.TenancyID {
+        children, err := listCompartments(ctx, client, ten.CompartmentID, true)
+        return append(ids, children...), err
+    }
+    for queue := []string{ten.CompartmentID}; len(queue) > 0; {
+        parent := queue[0]
+        queue = queue[1:]
+        children, err := listCompartments(ctx, client, parent, false)
+        if err != nil {
+            return nil, err
+        }
+        ids = append(ids, children...)
+        queue = append(queue, children...)
+    }
+    return ids, nil
+}
+
+func listCompartments(ctx context.Context, client identity.IdentityClient, parent string, subtree bool) ([]string, error) {
+    var ids []string
+    req := identity.ListCompartmentsRequest{
+        CompartmentId:          common.String(parent),
+        CompartmentIdInSubtree: common.Bool(subtree),
+        AccessLevel:            identity.ListCompartmentsAccessLevelAccessible,
+        LifecycleState:         identity.CompartmentLifecycleStateActive,
+    }
+    for {
+        resp, err := client.ListCompartments(ctx, req)
+        if err != nil {
+            return nil, err
+        }
+        for _, c := range resp.Items {
+            if c.Id != nil {
+                ids = append(ids, *c.Id)
+            }
+        }
+        if resp.OpcNextPage == nil {
+            return ids, nil
+        }
+        req.Page = resp.OpcNextPage
+    }
+}
+
+// rootScope returns where the tenancy's queries are issued. Normally that is
+// each of compartments. With -root-query or root_query, a tenancy that
+// discovers its compartments is queried once from the tenancy root with its
+// subtree instead, and keep lists the compartments whose series are kept, so
+// the result is the same for one request per metric instead of one per
+// compartment.
+func (c *collector) rootScope(ten Tenancy, compartments []string) (queryIn []string, keep map[string]bool) {
+    enabled := c.rootQuery
+    if ten.RootQuery != nil {
+        enabled = *ten.RootQuery
+    }
+    if !enabled || !ten.DiscoverCompartments || ten.TenancyID == "" {
+        return compartments, nil
+    }
+    keep = make(map[string]bool, len(compartments))
+    for _, id := range compartments {
+        keep[id] = true
+    }
+    return []string{ten.TenancyID}, keep
+}
+
+// itemCompartment returns the compartment a returned stream belongs to.
+func itemCompartment(item monitoring.MetricData) string {
+    if id := item.Dimensions["compartmentId"]; id != "" {
+        return id
+    }
+    if item.CompartmentId != nil {
+        return *item.CompartmentId
+    }
+    return ""
+}
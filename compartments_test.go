@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "sort"
+    "strconv"
+    "testing"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+)
+
+func TestQueryCompartments(t *testing.T) {
+    const (
+        root  = "ocid1.compartment.oc1..root"
+        a     = "ocid1.compartment.oc1..a"
+        b     = "ocid1.compartment.oc1..b"
+        child = "ocid1.compartment.oc1..child"
+    )
+    for _, tc := range []struct {
+        name       string
+        ten        Tenancy
+        discovered []string
+        want       []string
+    }{
+        {"compartment_id", Tenancy{CompartmentID: root}, nil, []string{root}},
+        {"compartment_ids win", Tenancy{CompartmentID: root, CompartmentIDs: []string{a, b}}, nil, []string{a, b}},
+        {"duplicates dropped", Tenancy{CompartmentIDs: []string{a, b, a}}, nil, []string{a, b}},
+        {"discovery off ignores discovered", Tenancy{CompartmentID: root}, []string{root, child}, []string{root}},
+        {"merge before discovery", Tenancy{CompartmentID: root, DiscoverCompartments: true}, nil, []string{root}},
+        {"merge by default", Tenancy{CompartmentIDs: []string{a}, DiscoverCompartments: true}, []string{root, a, child}, []string{a, root, child}},
+        {"explicit merge", Tenancy{CompartmentIDs: []string{a}, DiscoverCompartments: true, DiscoveryMode: discoveryMerge}, []string{root}, []string{a, root}},
+        {"replace before discovery", Tenancy{CompartmentIDs: []string{a}, DiscoverCompartments: true, DiscoveryMode: discoveryReplace}, nil, []string{a}},
+        {"replace", Tenancy{CompartmentIDs: []string{a}, DiscoverCompartments: true, DiscoveryMode: discoveryReplace}, []string{root, child}, []string{root, child}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := tc.ten.queryCompartments(tc.discovered); !reflect.DeepEqual(got, tc.want) {
+                t.Errorf("queryCompartments = %v, want %v", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestInSubtree(t *testing.T) {
+    on, off := true, false
+    for _, tc := range []struct {
+        ns, ten  *bool
+        discover bool
+        want     bool
+    }{
+        {nil, nil, false, true},
+        {nil, nil, true, false},
+        {nil, &on, false, true},
+        {nil, &on, true, true},
+        {nil, &off, false, false},
+        {nil, &off, true, false},
+        {&on, nil, false, true},
+        {&on, nil, true, true},
+        {&on, &on, false, true},
+        {&on, &on, true, true},
+        {&on, &off, false, true},
+        {&on, &off, true, true},
+        {&off, nil, false, false},
+        {&off, nil, true, false},
+        {&off, &on, false, false},
+        {&off, &on, true, false},
+        {&off, &off, false, false},
+        {&off, &off, true, false},
+    } {
+        ten := Tenancy{CompartmentIDInSubtree: tc.ten, DiscoverCompartments: tc.discover}
+        ns := MetricNamespace{CompartmentIDInSubtree: tc.ns}
+        if got := inSubtree(ten, ns); got != tc.want {
+            t.Errorf("inSubtree(namespace %v, tenancy %v, discovery %v) = %v, want %v", fmtBool(tc.ns), fmtBool(tc.ten), tc.discover, got, tc.want)
+        }
+        // A root query always covers the subtree.
+        ns.rootQuery = true
+        if !inSubtree(ten, ns) {
+            t.Errorf("root query of namespace %v, tenancy %v, discovery %v is not in the subtree", fmtBool(tc.ns), fmtBool(tc.ten), tc.discover)
+        }
+    }
+}
+
+func fmtBool(b *bool) string {
+    if b == nil {
+        return "unset"
+    }
+    return strconv.FormatBool(*b)
+}
+
+// fakeIdentity serves ListCompartments over tree, which maps a compartment to
+// its children, one compartment per page. It returns the server's URL and
+// records every listed parent and subtree flag in calls.
+func fakeIdentity(t *testing.T, tree map[string][]string, calls *[]string) string {
+    var descendants func(id string) []string
+    descendants = func(id string) []string {
+        var out []string
+        for _, child := range tree[id] {
+            out = append(append(out, child), descendants(child)...)
+        }
+        return out
+    }
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+        parent, subtree := q.Get("compartmentId"), q.Get("compartmentIdInSubtree") == "true"
+        *calls = append(*calls, parent+" subtree="+strconv.FormatBool(subtree))
+        ids := tree[parent]
+        if subtree {
+            ids = descendants(parent)
+        }
+        offset, _ := strconv.Atoi(q.Get("page"))
+        var page []map[string]string
+        if offset < len(ids) {
+            page = []map[string]string{{"id": ids[offset]}}
+        }
+        if offset+1 < len(ids) {
+            w.Header().Set("opc-next-page", strconv.Itoa(offset+1))
+        }
+        if page == nil {
+            page = []map[string]string{}
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(page)
+    }))
+    t.Cleanup(srv.Close)
+    return srv.URL
+}
+
+func TestDiscoverCompartments(t *testing.T) {
+    const (
+        tenancy = "ocid1.tenancy.oc1..test"
+        a       = "ocid1.compartment.oc1..a"
+        a1      = "ocid1.compartment.oc1..a1"
+        a2      = "ocid1.compartment.oc1..a2"
+        b       = "ocid1.compartment.oc1..b"
+    )
+    tree := map[string][]string{tenancy: {a, b}, a: {a1, a2}}
+    for _, tc := range []struct {
+        name  string
+        start string
+        want  []string
+        calls []string
+    }{
+        {"tenancy root lists the subtree at once", tenancy, []string{tenancy, a, a1, a2, b}, []string{
+            tenancy + " subtree=true", tenancy + " subtree=true", tenancy + " subtree=true", tenancy + " subtree=true",
+        }},
+        {"other compartments are walked", a, []string{a, a1, a2}, []string{
+            a + " subtree=false", a + " subtree=false", a1 + " subtree=false", a2 + " subtree=false",
+        }},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            var calls []string
+            client, err := identity.NewIdentityClientWithConfigurationProvider(sharedTestProvider(t))
+            if err != nil {
+                t.Fatal(err)
+            }
+            client.Host = fakeIdentity(t, tree, &calls)
+            ten := testTenancy("acme")
+            ten.TenancyID, ten.CompartmentID = tenancy, tc.start
+
+            got, err := discoverCompartments(context.Background(), client, ten)
+            if err != nil {
+                t.Fatalf("discoverCompartments: %v", err)
+            }
+            sort.Strings(got)
+            sort.Strings(tc.want)
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Errorf("discovered %v, want %v", got, tc.want)
+            }
+            if !reflect.DeepEqual(calls, tc.calls) {
+                t.Errorf("ListCompartments calls %v, want %v", calls, tc.calls)
+            }
+        })
+    }
+}
+
+func TestCollectCompartmentScope(t *testing.T) {
+    const (
+        tenancy = "ocid1.tenancy.oc1..test"
+        root    = "ocid1.compartment.oc1..test"
+        child   = "ocid1.compartment.oc1..child"
+    )
+    on, off := true, false
+    type query struct {
+        compartment string
+        inSubtree   bool
+    }
+    for _, tc := range []struct {
+        name       string
+        ten        func(*Tenancy)
+        ns         func(*MetricNamespace)
+        rootQuery  bool
+        discovered []string
+        want       []query
+    }{
+        {name: "explicit compartment with its subtree", want: []query{{root, true}}},
+        {name: "tenancy turns the subtree off", ten: func(ten *Tenancy) { ten.CompartmentIDInSubtree = &off }, want: []query{{root, false}}},
+        {
+            name:       "discovery queries each compartment alone",
+            ten:        func(ten *Tenancy) { ten.DiscoverCompartments = true },
+            discovered: []string{root, child},
+            want:       []query{{root, false}, {child, false}},
+        },
+        {
+            name:       "namespace turns the subtree on under discovery",
+            ten:        func(ten *Tenancy) { ten.DiscoverCompartments = true },
+            ns:         func(ns *MetricNamespace) { ns.CompartmentIDInSubtree = &on },
+            discovered: []string{root, child},
+            want:       []query{{root, true}, {child, true}},
+        },
+        {
+            name:       "root query under discovery",
+            ten:        func(ten *Tenancy) { ten.DiscoverCompartments = true },
+            rootQuery:  true,
+            discovered: []string{root, child},
+            want:       []query{{tenancy, true}},
+        },
+        {
+            name:      "root query needs discovery",
+            rootQuery: true,
+            want:      []query{{root, true}},
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            fake, url := startFake(t, nil)
+            c, _ := newTestCollector(t)
+            c.rootQuery = tc.rootQuery
+            ten := testTenancy("acme")
+            ns := cpuConfig.Metrics[0]
+            if tc.ten != nil {
+                tc.ten(&ten)
+            }
+            if tc.ns != nil {
+                tc.ns(&ns)
+            }
+            compartments := ten.queryCompartments(tc.discovered)
+            if _, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, compartments, MetricConfig{Metrics: []MetricNamespace{ns}}); err != nil {
+                t.Fatalf("collectTenancy: %v", err)
+            }
+            var got []query
+            for _, r := range fake.Requests() {
+                got = append(got, query{r.CompartmentID, r.InSubtree})
+            }
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Errorf("queries %v, want %v", got, tc.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "regexp"
+    "sort"
+    "strings"
+    "text/template"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+)
+
+// compatVars are the variables available to the compat_metric_names template.
+type compatVars struct {
+    Namespace string
+    Metric    string
+    Statistic string
+}
+
+// statisticPattern matches the MQL statistic calls of a query.
+var statisticPattern = regexp.MustCompile(`\.(mean|sum|max|min|count|rate|percentile|last|first)\(`)
+
+// queryStatistic returns the last statistic applied by an MQL query, "mean" if
+// it names none.
+func queryStatistic(query string) string {
+    m := statisticPattern.FindAllStringSubmatch(query, -1)
+    if len(m) == 0 {
+        return "mean"
+    }
+    return m[len(m)-1][1]
+}
+
+// compatNamer renders the legacy metric names of compat_metric_names.
+type compatNamer struct {
+    tmpl *template.Template
+}
+
+func newCompatNamer(text string) (*compatNamer, error) {
+    tmpl, err := template.New("compat_metric_names").Option("missingkey=error").Parse(text)
+    if err != nil {
+        return nil, err
+    }
+    return &compatNamer{tmpl: tmpl}, nil
+}
+
+// Name renders the legacy name for vars, with characters outside
+// [a-zA-Z0-9_] replaced by underscores.
+func (n *compatNamer) Name(vars compatVars) (string, error) {
+    var b strings.Builder
+    if err := n.tmpl.Execute(&b, vars); err != nil {
+        return "", err
+    }
+    name := sanitizeLabelName(b.String())
+    if name == valueMetricName || strings.HasPrefix(name, "_") {
+        return "", fmt.Errorf("%q is not a usable metric name", b.String())
+    }
+    return name, nil
+}
+
+// validateCompatNames checks that text renders a usable name.
+func validateCompatNames(text string) error {
+    namer, err := newCompatNamer(text)
+    if err != nil {
+        return err
+    }
+    _, err = namer.Name(compatVars{Namespace: "oci_computeagent", Metric: "CpuUtilization", Statistic: "mean"})
+    return err
+}
+
+// recordCompat stores the legacy copy of a value series. Names are cached in
+// names, by metric, for the duration of one response.
+func (c *collector) recordCompat(namer *compatNamer, namespace, metric, statistic string, labels prometheus.Labels, v float64, ts time.Time, names map[string]string) {
+    name, ok := names[metric]
+    if !ok {
+        // Checked at load; a failure here only skips the copy.
+        name, _ = namer.Name(compatVars{Namespace: namespace, Metric: metric, Statistic: statistic})
+        names[metric] = name
+    }
+    if name != "" {
+        c.compat.SetNamedAt(name, labels, v, ts)
+    }
+}
+
+// ownFamilies are the metric families the exporter exports besides the self
+// metrics. A compat name must not take one: the registry rejects a family
+// whose series disagree on type or help, and fails the scrape.
+var ownFamilies = map[string]bool{
+    valueMetricName: true, "oci_metric_state": true, "oci_metric_coverage": true,
+    "oci_metric_resolution_seconds": true, "oci_metric_distribution": true, "oci_resource_info": true,
+    "oci_lb_backend_healthy": true, "oci_tenancy_info": true, "oci_tenancy_up": true,
+    "oci_tenancy_removed_timestamp_seconds": true, "oci_namespace_collecting": true,
+    "oci_query_info": true, "oci_region_health": true,
+    "oci_alarm_suppression_active": true, "oci_alarm_suppression_start_timestamp_seconds": true,
+    "oci_alarm_suppression_end_timestamp_seconds": true,
+}
+
+// ownFamily reports whether name is one of the exporter's own families, or a
+// self-metric under the default -self-metrics-prefix.
+func ownFamily(name string) bool {
+    return ownFamilies[name] || strings.HasPrefix(name, defaultSelfMetricsPrefix)
+}
+
+// checkCompatCollisions returns an error naming every metric of the entries
+// from source whose compat name is one of the exporter's own families.
+// Wildcard entries are checked at runtime, by compatGuard.
+func checkCompatCollisions(text, source string, entries []MetricNamespace) error {
+    namer, err := newCompatNamer(text)
+    if err != nil {
+        return err
+    }
+    var problems []string
+    for _, ns := range entries {
+        statistics := ns.Statistics
+        if len(statistics) == 0 {
+            statistics = []string{queryStatistic(ns.Query)}
+        }
+        for _, name := range ns.Names {
+            if name == wildcardName {
+                continue
+            }
+            for _, stat := range statistics {
+                compat, err := namer.Name(compatVars{Namespace: ns.Namespace, Metric: name, Statistic: stat})
+                if err == nil && ownFamily(compat) {
+                    problems = append(problems, fmt.Sprintf("%s: namespace %s: metric %s gets the compat name %s, which the exporter already exports", source, ns.Namespace, name, compat))
+                }
+            }
+        }
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%s", strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// compatGuard is a Gatherer that merges the compat series, gathered from their
+// own registry, into the families of base. A compat family whose name base
+// already has, such as a self-metric under a custom -self-metrics-prefix or a
+// family a wildcard metric ran into, is quarantined instead of failing the
+// scrape: it is left out, its series are deleted and no longer stored, and
+// oci_exporter_quarantined_compat_names reports it.
+type compatGuard struct {
+    base, compat prometheus.Gatherer
+    store        *sampleStore
+    quarantined  *prometheus.GaugeVec
+}
+
+func newCompatGuard(base, compat prometheus.Gatherer, store *sampleStore, self *selfMetrics) *compatGuard {
+    return &compatGuard{
+        base:        base,
+        compat:      compat,
+        store:       store,
+        quarantined: self.gaugeVec("quarantined_compat_names", "Compat metric names not exported because another family of the exporter has that name, value is always 1.", "name"),
+    }
+}
+
+func (g *compatGuard) Gather() ([]*dto.MetricFamily, error) {
+    families, err := g.base.Gather()
+    compat, compatErr := g.compat.Gather()
+    if err == nil {
+        err = compatErr
+    }
+    taken := make(map[string]bool, len(families))
+    for _, mf := range families {
+        taken[mf.GetName()] = true
+    }
+    for _, mf := range compat {
+        name := mf.GetName()
+        if taken[name] {
+            if n := g.store.Quarantine(name); n > 0 {
+                log.Printf("Warning: compat metric name %s is already used by another metric family, not exporting its %d series; change compat_metric_names", name, n)
+            }
+            g.quarantined.WithLabelValues(name).Set(1)
+            continue
+        }
+        families = append(families, mf)
+    }
+    sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+    return families, err
+}
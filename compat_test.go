@@ -0,0 +1,130 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+func TestCheckCompatCollisions(t *testing.T) {
+    for _, tc := range []struct {
+        name    string
+        text    string
+        entries []MetricNamespace
+        // clash is the family the error must name, "" for no error.
+        clash string
+    }{
+        {
+            name:    "no clash",
+            text:    "oci_{{.Metric}}_{{.Statistic}}",
+            entries: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}}},
+        },
+        {
+            name:    "own family",
+            text:    "oci_{{.Metric}}",
+            entries: []MetricNamespace{{Namespace: "custom_app", Names: []string{"requests", "tenancy_up"}}},
+            clash:   "oci_tenancy_up",
+        },
+        {
+            name:    "self-metric",
+            text:    "oci_exporter_{{.Metric}}",
+            entries: []MetricNamespace{{Namespace: "custom_app", Names: []string{"api_calls_total"}}},
+            clash:   "oci_exporter_api_calls_total",
+        },
+        {
+            name:    "one statistic of several",
+            text:    "oci_{{.Metric}}_{{.Statistic}}",
+            entries: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"metric"}, Statistics: []string{"max", "state"}}},
+            clash:   "oci_metric_state",
+        },
+        {
+            name:    "wildcard left to runtime",
+            text:    "oci_{{.Metric}}",
+            entries: []MetricNamespace{{Namespace: "custom_app", Names: []string{wildcardName}}},
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            err := checkCompatCollisions(tc.text, "metrics.yaml", tc.entries)
+            switch {
+            case tc.clash == "" && err != nil:
+                t.Errorf("unexpected error: %v", err)
+            case tc.clash != "" && (err == nil || !strings.Contains(err.Error(), "compat name "+tc.clash+",")):
+                t.Errorf("error = %v, want one naming %s", err, tc.clash)
+            }
+        })
+    }
+}
+
+func TestCompatClashRejectedAtLoad(t *testing.T) {
+    inConfigDir(t, `tenancies:
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..aaa
+    compartment_id: ocid1.compartment.oc1..aaa
+    region: us-ashburn-1
+`, `compat_metric_names: "oci_{{.Metric}}"
+metrics:
+  - namespace: custom_app
+    custom: true
+    names: [tenancy_up]
+`)
+    _, _, err := loadConfigs(labelSourceName)
+    if err == nil || !strings.Contains(err.Error(), "oci_tenancy_up") {
+        t.Errorf("loadConfigs = %v, want the oci_tenancy_up clash", err)
+    }
+}
+
+func TestCompatClashQuarantinedAtRuntime(t *testing.T) {
+    value := func(v float64) *float64 { return &v }
+    _, url := startFake(t, []fakemonitoring.Series{
+        {Namespace: "custom_app", Name: "requests", Dimensions: map[string]string{"resourceId": "r1"}, Values: []*float64{value(5)}},
+        {Namespace: "custom_app", Name: "tenancy_up", Dimensions: map[string]string{"resourceId": "r1"}, Values: []*float64{value(1)}},
+    })
+    c, reg := newTestCollector(t)
+    c.compat = newSampleStore(valueMetricName, "compat")
+    compatReg := prometheus.NewRegistry()
+    compatReg.MustRegister(c.compat)
+    guard := newCompatGuard(reg, compatReg, c.compat, c.self)
+    ten := testTenancy("acme")
+    c.setTenancyUp(ten.Label, "")
+    client := newFakeClient(t, url)
+
+    // Only the wildcard's expansion at runtime brings tenancy_up in.
+    config := MetricConfig{CompatMetricNames: "oci_{{.Metric}}", Metrics: []MetricNamespace{{Namespace: "custom_app", Custom: true, Names: []string{wildcardName}}}}
+    if err := checkCompatCollisions(config.CompatMetricNames, "metrics.yaml", config.Metrics); err != nil {
+        t.Fatalf("wildcard entry rejected at load: %v", err)
+    }
+    expanded := newWildcardCache(time.Hour, 0.5).Expand(context.Background(), c, client, ten, []string{ten.CompartmentID}, config)
+    for cycle := 0; cycle < 2; cycle++ {
+        if _, err := c.collectTenancy(context.Background(), client, ten, []string{ten.CompartmentID}, expanded); err != nil {
+            t.Fatalf("collectTenancy: %v", err)
+        }
+        families, err := guard.Gather()
+        if err != nil {
+            t.Fatalf("cycle %d: Gather failed instead of quarantining: %v", cycle, err)
+        }
+        exported := make(map[string]int)
+        for _, mf := range families {
+            exported[mf.GetName()] = len(mf.GetMetric())
+        }
+        if exported["oci_tenancy_up"] != 1 || exported["oci_requests"] != 1 {
+            t.Errorf("cycle %d: exported %v, want the exporter's oci_tenancy_up series and the oci_requests copy", cycle, exported)
+        }
+        if !c.compat.HasName("oci_requests") {
+            t.Errorf("cycle %d: oci_requests copy not stored", cycle)
+        }
+        for _, smp := range c.compat.Snapshot() {
+            if smp.Labels["metric"] == "tenancy_up" {
+                t.Errorf("cycle %d: quarantined copy still stored: %v", cycle, smp.Labels)
+            }
+        }
+    }
+    if got := testutil.ToFloat64(guard.quarantined.WithLabelValues("oci_tenancy_up")); got != 1 {
+        t.Errorf("quarantined_compat_names{name=oci_tenancy_up} = %v, want 1", got)
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "math"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// adaptiveLimiter bounds the SummarizeMetricsData requests in flight across all
+// tenancy loops and adapts the bound to OCI's capacity, AIMD style: every
+// throttled attempt halves it, every other attempt raises it by 1/limit, so it
+// grows by about one per limit requests, and it always stays within [min, max].
+// Slots go to waiting callers in arrival order. A loop has one request in
+// flight at a time and queues again behind the others after it, so every
+// tenancy gets its share of the limit however busy the others are. A nil
+// limiter does not limit.
+type adaptiveLimiter struct {
+    min, max float64
+    current  prometheus.Gauge
+    pending  prometheus.Gauge
+
+    mu       sync.Mutex
+    limit    float64
+    inFlight int
+    // queue holds a channel per waiting Acquire, oldest first, closed when
+    // the slot is handed to it.
+    queue []chan struct{}
+}
+
+func newAdaptiveLimiter(min, max int, self *selfMetrics) *adaptiveLimiter {
+    l := &adaptiveLimiter{
+        min:     float64(min),
+        max:     float64(max),
+        limit:   float64(max),
+        current: self.gaugeVec("query_concurrency", "Current adaptive limit of SummarizeMetricsData requests in flight across all tenancies.").WithLabelValues(),
+        pending: self.gaugeVec("pending_queries", "SummarizeMetricsData requests waiting for a slot under the adaptive concurrency limit.").WithLabelValues(),
+    }
+    l.current.Set(l.limit)
+    return l
+}
+
+// Acquire waits for a free slot. It fails only when ctx is done.
+func (l *adaptiveLimiter) Acquire(ctx context.Context) error {
+    if l == nil {
+        return nil
+    }
+    l.mu.Lock()
+    if len(l.queue) == 0 && l.inFlight < int(l.limit) {
+        l.inFlight++
+        l.mu.Unlock()
+        return nil
+    }
+    ready := make(chan struct{})
+    l.queue = append(l.queue, ready)
+    l.pending.Set(float64(len(l.queue)))
+    l.mu.Unlock()
+
+    select {
+    case <-ready:
+        return nil
+    case <-ctx.Done():
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for i, w := range l.queue {
+        if w == ready {
+            l.queue = append(l.queue[:i], l.queue[i+1:]...)
+            l.pending.Set(float64(len(l.queue)))
+            return ctx.Err()
+        }
+    }
+    // The slot was handed over as ctx ended; pass it on.
+    l.inFlight--
+    l.grant()
+    return ctx.Err()
+}
+
+// grant hands free slots to the oldest waiters. Callers must hold l.mu.
+func (l *adaptiveLimiter) grant() {
+    for len(l.queue) > 0 && l.inFlight < int(l.limit) {
+        l.inFlight++
+        close(l.queue[0])
+        l.queue = l.queue[1:]
+    }
+    l.pending.Set(float64(len(l.queue)))
+}
+
+// Release frees a slot and adjusts the limit by the attempt's outcome.
+func (l *adaptiveLimiter) Release(throttled bool) {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.inFlight--
+    if throttled {
+        l.limit = math.Max(l.min, l.limit/2)
+    } else {
+        l.limit = math.Min(l.max, l.limit+1/l.limit)
+    }
+    l.current.Set(math.Floor(l.limit))
+    l.grant()
+}
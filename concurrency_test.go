@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimiterPendingQueries(t *testing.T) {
+    l := newAdaptiveLimiter(1, 1, newSelfMetrics(prometheus.NewRegistry(), defaultSelfMetricsPrefix))
+    if err := l.Acquire(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    waitPending := func(want float64) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for testutil.ToFloat64(l.pending) != want {
+            if time.Now().After(deadline) {
+                t.Fatalf("pending_queries = %v, want %v", testutil.ToFloat64(l.pending), want)
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancelled := make(chan error)
+    go func() { cancelled <- l.Acquire(ctx) }()
+    granted := make(chan error)
+    go func() {
+        // Queue behind the first waiter.
+        for testutil.ToFloat64(l.pending) != 1 {
+            time.Sleep(time.Millisecond)
+        }
+        granted <- l.Acquire(context.Background())
+    }()
+    waitPending(2)
+
+    cancel()
+    if err := <-cancelled; err == nil {
+        t.Error("Acquire with a cancelled context succeeded")
+    }
+    waitPending(1)
+    l.Release(false)
+    if err := <-granted; err != nil {
+        t.Fatal(err)
+    }
+    waitPending(0)
+    l.Release(false)
+}
@@ -0,0 +1,912 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Tenancy represents a single OCI tenancy configuration.
+// CompartmentIDs, when set, replaces CompartmentID as the list of compartments to query.
+// DiscoverCompartments adds the compartments found below CompartmentID, merged with or
+// replacing the explicit list according to DiscoveryMode.
+// Metrics and MetricsFile, when either is set, give the tenancy its own metric entries
+// in place of metrics.yaml. After loading, Metrics holds both.
+// Key is an optional short identifier, used as the tenancy label with -tenancy-label-source=key.
+// Label is not read from YAML; loadConfigs sets it to the value of the tenancy label.
+type Tenancy struct {
+    Name                   string   `yaml:"name"`
+    Key                    string   `yaml:"key,omitempty"`
+    Group                  string   `yaml:"group,omitempty"`
+    TenancyID              string   `yaml:"tenancy_id"`
+    CompartmentID          string   `yaml:"compartment_id"`
+    Region                 string   `yaml:"region"`
+    CompartmentIDs         []string `yaml:"compartment_ids,omitempty"`
+    CompartmentIDInSubtree *bool    `yaml:"compartment_id_in_subtree,omitempty"`
+    DiscoverCompartments   bool     `yaml:"discover_compartments,omitempty"`
+    DiscoveryMode          string   `yaml:"discovery_mode,omitempty"`
+    // SkipUnhealthyRegion overrides -skip-unhealthy-regions for this tenancy.
+    SkipUnhealthyRegion *bool `yaml:"skip_unhealthy_region,omitempty"`
+    // RootQuery overrides -root-query for this tenancy.
+    RootQuery *bool `yaml:"root_query,omitempty"`
+    // ConfigFile and Profile, when either is set, authenticate the tenancy with
+    // that OCI config file and profile instead of the DEFAULT profile of -config.
+    ConfigFile string `yaml:"config_file,omitempty"`
+    Profile    string `yaml:"profile,omitempty"`
+    // AuditProfile names a second profile of the same config file whose view of
+    // the tenancy's metrics -audit-profiles compares with the tenancy's own.
+    AuditProfile string `yaml:"audit_profile,omitempty"`
+
+    Metrics     []MetricNamespace `yaml:"metrics,omitempty"`
+    MetricsFile string            `yaml:"metrics_file,omitempty"`
+
+    Label string `yaml:"-"`
+    // renamedFrom is the configured name of a tenancy renamed because another
+    // one has the same name, see suffixDuplicateNames.
+    renamedFrom string
+}
+
+// Sources of the tenancy label value.
+const (
+    labelSourceName = "name"
+    labelSourceOCID = "ocid"
+    labelSourceKey  = "key"
+)
+
+// labelValue returns the tenancy label value for source. A tenancy without a
+// key falls back to its name.
+func (ten Tenancy) labelValue(source string) string {
+    switch source {
+    case labelSourceOCID:
+        return ten.TenancyID
+    case labelSourceKey:
+        if ten.Key != "" {
+            return ten.Key
+        }
+    }
+    return ten.Name
+}
+
+// credentialKey identifies the tenancy's OCI credentials: "" for -config,
+// otherwise its config file and profile.
+func (ten Tenancy) credentialKey() string {
+    if ten.ConfigFile == "" && ten.Profile == "" {
+        return ""
+    }
+    return ten.ConfigFile + "\xff" + ten.Profile
+}
+
+// ownsMetrics reports whether the tenancy defines its own metric entries.
+func (ten Tenancy) ownsMetrics() bool {
+    return len(ten.Metrics) > 0 || ten.MetricsFile != ""
+}
+
+// metrics returns the enabled entries collected for the tenancy: its own if it
+// has any, otherwise the global ones from metrics.yaml.
+func (ten Tenancy) metrics(global MetricConfig) MetricConfig {
+    entries := global.Metrics
+    if ten.ownsMetrics() {
+        entries = ten.Metrics
+    }
+    enabled := make([]MetricNamespace, 0, len(entries))
+    for _, ns := range entries {
+        if ns.enabled() {
+            enabled = append(enabled, ns)
+        }
+    }
+    return MetricConfig{CompatMetricNames: global.CompatMetricNames, Metrics: enabled}
+}
+
+// TenancyConfig is the content of tenants.yaml. Endpoints overrides the Monitoring
+// endpoint of a region; keys may be region identifiers or keys such as "phx".
+// ExtraRegions lists regions to accept although the SDK does not know them yet.
+// Tenancies are decoded after tenancy_defaults and their group are merged in,
+// see mergeTenancyDefaults.
+type TenancyConfig struct {
+    Tenancies    []Tenancy         `yaml:"tenancies"`
+    Endpoints    map[string]string `yaml:"endpoints,omitempty"`
+    ExtraRegions []string          `yaml:"extra_regions,omitempty"`
+}
+
+// MetricNamespace holds namespace and list of metric names, optional resource group and resolution.
+// EndOffset, when set, overrides the global -end-offset for this namespace.
+// AggregationScope "compartment" aggregates each metric per compartment instead of per resource.
+// PackDimensions exports the dimensions not already mapped to labels as one JSON-encoded label.
+// CompartmentIDInSubtree overrides the tenancy's subtree setting for this namespace.
+// Priority (high, normal or low) decides which entries are dropped first when output is capped.
+// Buckets, when set, also accumulates the entry's datapoints into a histogram with these upper bounds.
+// Custom marks namespaces published with PostMetricData: every returned dimension becomes a label.
+// Windows, when set, queries each metric once per window and labels the series with the window.
+// LifecycleStates, when set, drops series whose lifecycleState or state dimension is not listed.
+// Query is a text/template for the MQL, replacing the default query; QueryTemplate names one
+// of the file's query_templates instead and is resolved into Query at load.
+// QuerySuffix is appended verbatim to the generated query, e.g. " * 100".
+// Statistics, when set, queries each metric once per statistic instead of for
+// its mean, and labels the series with the statistic.
+// GroupBy aggregates each metric by these dimension keys, which become its labels.
+// Resolutions, when set, are tried in order per metric, each stream being taken
+// from the first resolution at which it has datapoints.
+// MaxResources, when positive, caps the resources exported per metric, evicting
+// the least recently updated ones beyond it.
+// Window, when set, overrides -metric-window, the span each query aggregates over.
+// Enabled set to false keeps the entry in the config but skips it.
+type MetricNamespace struct {
+    Namespace        string    `yaml:"namespace"`
+    Names            []string  `yaml:"names"`
+    ResourceGroup    string    `yaml:"resource_group,omitempty"`
+    Resolution       string    `yaml:"resolution,omitempty"`
+    Resolutions      []string  `yaml:"resolutions,omitempty"`
+    EndOffset        string    `yaml:"end_offset,omitempty"`
+    AggregationScope string    `yaml:"aggregation_scope,omitempty"`
+    PackDimensions   bool      `yaml:"pack_dimensions,omitempty"`
+    Priority         string    `yaml:"priority,omitempty"`
+    Buckets          []float64 `yaml:"buckets,omitempty"`
+    Custom           bool      `yaml:"custom,omitempty"`
+    Window           string    `yaml:"window,omitempty"`
+    Windows          []string  `yaml:"windows,omitempty"`
+    LifecycleStates  []string  `yaml:"lifecycle_states,omitempty"`
+    Query            string    `yaml:"query,omitempty"`
+    QueryTemplate    string    `yaml:"query_template,omitempty"`
+    QuerySuffix      string    `yaml:"query_suffix,omitempty"`
+    Statistics       []string  `yaml:"statistics,omitempty"`
+    GroupBy          []string  `yaml:"group_by,omitempty"`
+    MaxResources     int       `yaml:"max_resources,omitempty"`
+    Enabled          *bool     `yaml:"enabled,omitempty"`
+    // Preset names an embedded entry whose fields fill those left unset.
+    Preset string `yaml:"preset,omitempty"`
+
+    CompartmentIDInSubtree *bool `yaml:"compartment_id_in_subtree,omitempty"`
+
+    // statistic is the statistic of one of Statistics being queried, see perStatistic.
+    statistic string
+    // rootQuery is set while the entry is queried once from the tenancy root, see rootScope.
+    rootQuery bool
+    // groupAll is set when -allowed-label-dimensions blocked every group_by key,
+    // so the streams are aggregated into one.
+    groupAll bool
+    // queriedResolution is the one of Resolutions being queried, see collectTenancy.
+    queriedResolution time.Duration
+}
+
+// statisticFuncs are the MQL statistics usable in statistics.
+var statisticFuncs = map[string]bool{"mean": true, "max": true, "min": true, "sum": true, "count": true, "rate": true, "first": true, "last": true}
+
+// perStatistic returns the entry once per configured statistic, each set to
+// query and label that statistic, or the entry itself without statistics. MQL
+// applies one statistic per query, so every statistic costs its own request.
+func (ns MetricNamespace) perStatistic() []MetricNamespace {
+    if len(ns.Statistics) == 0 {
+        return []MetricNamespace{ns}
+    }
+    out := make([]MetricNamespace, len(ns.Statistics))
+    for i, stat := range ns.Statistics {
+        out[i] = ns
+        out[i].statistic = stat
+    }
+    return out
+}
+
+const (
+    scopeResource    = "resource"
+    scopeCompartment = "compartment"
+)
+
+const (
+    priorityHigh   = "high"
+    priorityNormal = "normal"
+    priorityLow    = "low"
+)
+
+// enabled reports whether the entry is collected; entries are enabled by default.
+func (ns MetricNamespace) enabled() bool {
+    return ns.Enabled == nil || *ns.Enabled
+}
+
+// priorityWeight orders priorities; higher is more important.
+func (ns MetricNamespace) priorityWeight() int {
+    switch ns.Priority {
+    case priorityHigh:
+        return 2
+    case priorityLow:
+        return 0
+    default:
+        return 1
+    }
+}
+
+// MetricConfig is the content of a metrics file. Include lists further metric
+// files, resolved relative to the including file, whose entries are merged in.
+// QueryTemplates are named query templates that entries refer to by query_template.
+// CompatMetricNames is only read from metrics.yaml.
+type MetricConfig struct {
+    Include        []string          `yaml:"include,omitempty"`
+    QueryTemplates map[string]string `yaml:"query_templates,omitempty"`
+    // CompatMetricNames is a template, over compatVars, of a second name every
+    // value series is also exported under, for migrating from other exporters.
+    CompatMetricNames string            `yaml:"compat_metric_names,omitempty"`
+    Metrics           []MetricNamespace `yaml:"metrics"`
+}
+
+// loadConfigs reads tenants.yaml and metrics.yaml. It is used both at startup and
+// on reload, so it reports problems instead of exiting. labelSource decides each
+// tenancy's Label.
+func loadConfigs(labelSource string) (TenancyConfig, MetricConfig, error) {
+    var tenants TenancyConfig
+    var metrics MetricConfig
+
+    data, err := readConfigFile("config/tenants.yaml")
+    if err != nil {
+        return tenants, metrics, fmt.Errorf("cannot read tenants.yaml: %v", err)
+    }
+    if err := yaml.Unmarshal(data, &tenants); err != nil {
+        return tenants, metrics, fmt.Errorf("invalid tenants.yaml: %v", err)
+    }
+    if tenants.Tenancies, err = mergeTenancyDefaults(data); err != nil {
+        return tenants, metrics, fmt.Errorf("invalid tenants.yaml: %v", err)
+    }
+    endpoints := make(map[string]string, len(tenants.Endpoints))
+    for region, ep := range tenants.Endpoints {
+        endpoints[normalizeRegion(region)] = ep
+    }
+    tenants.Endpoints = endpoints
+    suffixDuplicateNames(tenants.Tenancies)
+    labels := make(map[string]string, len(tenants.Tenancies))
+    for i := range tenants.Tenancies {
+        ten := &tenants.Tenancies[i]
+        ten.Region = normalizeRegion(ten.Region)
+        ten.Label = ten.labelValue(labelSource)
+        if ten.Label == "" {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: empty %s for the tenancy label", ten.Name, labelSource)
+        }
+        if prev, ok := labels[ten.Label]; ok && labelSource != labelSourceName {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancies %s and %s have the same tenancy label %q", prev, ten.Name, ten.Label)
+        }
+        labels[ten.Label] = ten.Name
+    }
+    for _, ten := range tenants.Tenancies {
+        if !knownRegion(ten.Region, tenants.ExtraRegions) && tenants.Endpoints[ten.Region] == "" {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: unknown region %q; fix the name, or list it under extra_regions if the SDK is older than the region", ten.Name, ten.Region)
+        }
+        switch ten.DiscoveryMode {
+        case "", discoveryMerge, discoveryReplace:
+        default:
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: unknown discovery_mode %q", ten.Name, ten.DiscoveryMode)
+        }
+        if ten.DiscoveryMode != "" && !ten.DiscoverCompartments {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: discovery_mode requires discover_compartments", ten.Name)
+        }
+        if len(ten.queryCompartments(nil)) == 0 && !ten.DiscoverCompartments {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: no compartment_id or compartment_ids", ten.Name)
+        }
+    }
+
+    // metrics.yaml is optional when every tenancy brings its own entries.
+    if _, err := os.Stat("config/metrics.yaml"); err == nil {
+        metrics, err = loadMetricConfig("config/metrics.yaml")
+        if err != nil {
+            return tenants, metrics, fmt.Errorf("invalid metrics.yaml: %v", err)
+        }
+    } else if !os.IsNotExist(err) {
+        return tenants, metrics, fmt.Errorf("cannot read metrics.yaml: %v", err)
+    } else {
+        for _, ten := range tenants.Tenancies {
+            if !ten.ownsMetrics() {
+                return tenants, metrics, fmt.Errorf("tenancy %s has no metric configuration: config/metrics.yaml does not exist and the tenancy sets neither metrics nor metrics_file", ten.Name)
+            }
+        }
+    }
+    if err := resolveQueryTemplates(metrics.Metrics, metrics.QueryTemplates); err != nil {
+        return tenants, metrics, fmt.Errorf("invalid metrics.yaml: %v", err)
+    }
+    if err := validateMetrics(metrics.Metrics); err != nil {
+        return tenants, metrics, fmt.Errorf("invalid metrics.yaml: %v", err)
+    }
+    if metrics.CompatMetricNames != "" {
+        if err := validateCompatNames(metrics.CompatMetricNames); err != nil {
+            return tenants, metrics, fmt.Errorf("invalid metrics.yaml: compat_metric_names: %v", err)
+        }
+        if err := checkCompatCollisions(metrics.CompatMetricNames, "metrics.yaml", metrics.Metrics); err != nil {
+            return tenants, metrics, fmt.Errorf("invalid metrics.yaml: compat_metric_names: %v", err)
+        }
+    }
+
+    for i, ten := range tenants.Tenancies {
+        if !ten.ownsMetrics() {
+            continue
+        }
+        own, err := loadTenancyMetrics(ten)
+        if err != nil {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: %v", ten.Name, err)
+        }
+        templates := make(map[string]string, len(metrics.QueryTemplates)+len(own.QueryTemplates))
+        for name, text := range metrics.QueryTemplates {
+            templates[name] = text
+        }
+        for name, text := range own.QueryTemplates {
+            templates[name] = text
+        }
+        if err := resolveQueryTemplates(own.Metrics, templates); err != nil {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: %v", ten.Name, err)
+        }
+        if err := validateMetrics(own.Metrics); err != nil {
+            return tenants, metrics, fmt.Errorf("invalid tenants.yaml: tenancy %s: %v", ten.Name, err)
+        }
+        if metrics.CompatMetricNames != "" {
+            if err := checkCompatCollisions(metrics.CompatMetricNames, "tenancy "+ten.Name, own.Metrics); err != nil {
+                return tenants, metrics, fmt.Errorf("invalid tenants.yaml: compat_metric_names: %v", err)
+            }
+        }
+        tenants.Tenancies[i].Metrics = own.Metrics
+    }
+
+    return tenants, metrics, nil
+}
+
+// suffixDuplicateNames renames every tenancy whose name an earlier one already
+// has to the first free "<name>-2", "<name>-3" and so on. Names key the
+// collection loops and, by default, the tenancy label, so duplicates would
+// otherwise silently replace or merge each other's series.
+func suffixDuplicateNames(tenancies []Tenancy) {
+    taken := make(map[string]bool, len(tenancies))
+    for _, ten := range tenancies {
+        taken[ten.Name] = true
+    }
+    seen := make(map[string]bool, len(tenancies))
+    for i := range tenancies {
+        ten := &tenancies[i]
+        if !seen[ten.Name] {
+            seen[ten.Name] = true
+            continue
+        }
+        name := ten.Name
+        for n := 2; ; n++ {
+            if candidate := fmt.Sprintf("%s-%d", ten.Name, n); !taken[candidate] {
+                name = candidate
+                break
+            }
+        }
+        ten.renamedFrom, ten.Name = ten.Name, name
+        taken[name], seen[name] = true, true
+    }
+}
+
+// renamedTenancies returns a problem for every tenancy suffixDuplicateNames renamed.
+func renamedTenancies(tenants TenancyConfig) []string {
+    var problems []string
+    for _, ten := range tenants.Tenancies {
+        if ten.renamedFrom != "" {
+            problems = append(problems, fmt.Sprintf("tenancy name %q is used more than once; this one is collected as %q", ten.renamedFrom, ten.Name))
+        }
+    }
+    return problems
+}
+
+// checkTenancyNames returns the duplicate tenancy names as an error with
+// strict; otherwise the renamed tenancies are config warnings.
+func checkTenancyNames(tenants TenancyConfig, strict bool) error {
+    if problems := renamedTenancies(tenants); strict && len(problems) > 0 {
+        return fmt.Errorf("invalid tenants.yaml (-strict-tenancy-names): %s", strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// mergeTenancyDefaults decodes the tenancies of tenants.yaml with shared settings
+// merged in: first tenancy_defaults, then the tenancy's group from groups, then
+// the tenancy's own fields. Mappings are merged key by key, scalars and lists
+// from a later level replace earlier ones.
+func mergeTenancyDefaults(data []byte) ([]Tenancy, error) {
+    var raw struct {
+        Defaults  map[string]interface{}            `yaml:"tenancy_defaults"`
+        Groups    map[string]map[string]interface{} `yaml:"groups"`
+        Tenancies []map[string]interface{}          `yaml:"tenancies"`
+    }
+    if err := yaml.Unmarshal(data, &raw); err != nil {
+        return nil, err
+    }
+    tenancies := make([]Tenancy, 0, len(raw.Tenancies))
+    for i, own := range raw.Tenancies {
+        merged := mergeYAMLMaps(nil, raw.Defaults)
+        if group, ok := own["group"]; ok {
+            name, _ := group.(string)
+            settings, ok := raw.Groups[name]
+            if !ok {
+                return nil, fmt.Errorf("tenancy %d (%v): unknown group %v", i+1, own["name"], group)
+            }
+            merged = mergeYAMLMaps(merged, settings)
+        }
+        merged = mergeYAMLMaps(merged, own)
+        out, err := yaml.Marshal(merged)
+        if err != nil {
+            return nil, err
+        }
+        var ten Tenancy
+        if err := yaml.Unmarshal(out, &ten); err != nil {
+            return nil, fmt.Errorf("tenancy %d (%v): %v", i+1, own["name"], err)
+        }
+        tenancies = append(tenancies, ten)
+    }
+    return tenancies, nil
+}
+
+// mergeYAMLMaps returns dst with src merged in: nested mappings are merged
+// recursively, any other value in src replaces the one in dst. dst is not modified.
+func mergeYAMLMaps(dst, src map[string]interface{}) map[string]interface{} {
+    out := make(map[string]interface{}, len(dst)+len(src))
+    for k, v := range dst {
+        out[k] = v
+    }
+    for k, v := range src {
+        srcMap, srcIsMap := v.(map[string]interface{})
+        dstMap, dstIsMap := out[k].(map[string]interface{})
+        if srcIsMap && dstIsMap {
+            out[k] = mergeYAMLMaps(dstMap, srcMap)
+            continue
+        }
+        out[k] = v
+    }
+    return out
+}
+
+// logEffectiveMetrics logs how many metric entries each tenancy collects and where they come from.
+func logEffectiveMetrics(tenants TenancyConfig, global MetricConfig) {
+    for _, ten := range tenants.Tenancies {
+        source := "metrics.yaml"
+        if ten.ownsMetrics() {
+            source = "its own metrics"
+        }
+        log.Printf("Tenancy %s: %d metric entries from %s", ten.Name, len(ten.metrics(global).Metrics), source)
+    }
+}
+
+// allowsState reports whether a series with the given dimensions passes the entry's
+// lifecycle_states filter. Series without a state dimension always pass.
+func (ns MetricNamespace) allowsState(dims map[string]string) bool {
+    if len(ns.LifecycleStates) == 0 {
+        return true
+    }
+    state, ok := dims["lifecycleState"]
+    if !ok {
+        state, ok = dims["state"]
+    }
+    if !ok {
+        return true
+    }
+    for _, s := range ns.LifecycleStates {
+        if strings.EqualFold(s, state) {
+            return true
+        }
+    }
+    return false
+}
+
+// validateMetrics checks the settings of metric entries that the YAML decoder cannot.
+func validateMetrics(entries []MetricNamespace) error {
+    for _, ns := range entries {
+        seen := make(map[string]bool, len(ns.Statistics))
+        for _, stat := range ns.Statistics {
+            switch {
+            case !statisticFuncs[stat]:
+                return fmt.Errorf("namespace %s: unknown statistic %q", ns.Namespace, stat)
+            case seen[stat]:
+                return fmt.Errorf("namespace %s: statistic %q listed twice", ns.Namespace, stat)
+            case ns.Query != "":
+                return fmt.Errorf("namespace %s: statistics only apply to the generated query, not to query or query_template", ns.Namespace)
+            }
+            seen[stat] = true
+        }
+        if err := ns.validateGroupBy(); err != nil {
+            return fmt.Errorf("namespace %s: %v", ns.Namespace, err)
+        }
+        for _, name := range ns.Names {
+            if name == wildcardName && len(ns.Names) > 1 {
+                return fmt.Errorf("namespace %s: %q must be the only name of its entry", ns.Namespace, wildcardName)
+            }
+        }
+        if _, err := ns.endOffset(0); err != nil {
+            return fmt.Errorf("namespace %s: %v", ns.Namespace, err)
+        }
+        switch ns.AggregationScope {
+        case "", scopeResource, scopeCompartment:
+        default:
+            return fmt.Errorf("namespace %s: unknown aggregation_scope %q", ns.Namespace, ns.AggregationScope)
+        }
+        switch ns.Priority {
+        case "", priorityHigh, priorityNormal, priorityLow:
+        default:
+            return fmt.Errorf("namespace %s: unknown priority %q", ns.Namespace, ns.Priority)
+        }
+        if _, err := ns.queryWindows(); err != nil {
+            return fmt.Errorf("namespace %s: %v", ns.Namespace, err)
+        }
+        if _, err := ns.queryResolutions(); err != nil {
+            return fmt.Errorf("namespace %s: %v", ns.Namespace, err)
+        }
+        if _, err := ns.window(queryWindow); err != nil {
+            return fmt.Errorf("namespace %s: %v", ns.Namespace, err)
+        }
+        if ns.QuerySuffix != "" {
+            if ns.Query != "" {
+                return fmt.Errorf("namespace %s: query_suffix only applies to the generated query, not to query or query_template", ns.Namespace)
+            }
+            if !balancedParens(ns.QuerySuffix) {
+                return fmt.Errorf("namespace %s: query_suffix %q has unbalanced parentheses", ns.Namespace, ns.QuerySuffix)
+            }
+        }
+        for i, b := range ns.Buckets {
+            if math.IsNaN(b) || math.IsInf(b, 0) {
+                return fmt.Errorf("namespace %s: bucket %v is not a finite number", ns.Namespace, b)
+            }
+            if i > 0 && b <= ns.Buckets[i-1] {
+                return fmt.Errorf("namespace %s: buckets must be strictly increasing, got %v after %v", ns.Namespace, b, ns.Buckets[i-1])
+            }
+        }
+        switch {
+        case ns.MaxResources < 0:
+            return fmt.Errorf("namespace %s: max_resources must not be negative", ns.Namespace)
+        case ns.MaxResources > 0 && (ns.Custom || len(ns.GroupBy) > 0 || ns.AggregationScope == scopeCompartment):
+            return fmt.Errorf("namespace %s: max_resources counts resource_id series and cannot be combined with custom, group_by or aggregation_scope: compartment", ns.Namespace)
+        }
+    }
+    return nil
+}
+
+// dimensionKeyPattern matches plausible OCI dimension keys.
+var dimensionKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// validateGroupBy checks the group_by keys and the options they exclude: the
+// exported labels are exactly the keys, so nothing else may add or drop labels.
+func (ns MetricNamespace) validateGroupBy() error {
+    if len(ns.GroupBy) == 0 {
+        return nil
+    }
+    switch {
+    case ns.Query != "":
+        return fmt.Errorf("group_by only applies to the generated query, not to query or query_template")
+    case ns.Custom:
+        return fmt.Errorf("group_by cannot be combined with custom")
+    case ns.PackDimensions:
+        return fmt.Errorf("group_by cannot be combined with pack_dimensions")
+    case ns.AggregationScope == scopeCompartment:
+        return fmt.Errorf("group_by cannot be combined with aggregation_scope: compartment; add compartmentId to group_by instead")
+    }
+    seen := make(map[string]bool, len(ns.GroupBy))
+    for _, key := range ns.GroupBy {
+        if !dimensionKeyPattern.MatchString(key) {
+            return fmt.Errorf("group_by key %q is not a valid dimension name", key)
+        }
+        if seen[key] {
+            return fmt.Errorf("group_by key %q listed twice", key)
+        }
+        seen[key] = true
+    }
+    return nil
+}
+
+// balancedParens reports whether every "(" in s is closed by a later ")".
+func balancedParens(s string) bool {
+    depth := 0
+    for _, c := range s {
+        switch c {
+        case '(':
+            depth++
+        case ')':
+            depth--
+            if depth < 0 {
+                return false
+            }
+        }
+    }
+    return depth == 0
+}
+
+// loadTenancyMetrics returns the tenancy's inline entries followed by those of its
+// metrics_file, which resolves relative to tenants.yaml and may use includes.
+func loadTenancyMetrics(ten Tenancy) (MetricConfig, error) {
+    var merged MetricConfig
+    defined := make(map[string]string)
+    if err := addMetricEntries(&merged, ten.Metrics, "tenants.yaml", defined); err != nil {
+        return merged, err
+    }
+    if ten.MetricsFile != "" {
+        path := ten.MetricsFile
+        if !filepath.IsAbs(path) {
+            path = filepath.Join("config", path)
+        }
+        if err := mergeMetricFile(path, nil, &merged, make(map[string]bool), defined); err != nil {
+            return merged, err
+        }
+    }
+    return merged, nil
+}
+
+// resolveQueryTemplates replaces each entry's query_template with the named
+// template's text and checks that every query template parses and only uses
+// the variables a query provides.
+func resolveQueryTemplates(entries []MetricNamespace, templates map[string]string) error {
+    for i := range entries {
+        ns := &entries[i]
+        if ns.QueryTemplate != "" {
+            if ns.Query != "" {
+                return fmt.Errorf("namespace %s: query and query_template are mutually exclusive", ns.Namespace)
+            }
+            text, ok := templates[ns.QueryTemplate]
+            if !ok {
+                return fmt.Errorf("namespace %s: undefined query_template %q", ns.Namespace, ns.QueryTemplate)
+            }
+            ns.Query = text
+        }
+        if ns.Query == "" {
+            continue
+        }
+        if _, err := renderQuery(ns.Query, queryVars{}); err != nil {
+            if ns.QueryTemplate != "" {
+                return fmt.Errorf("namespace %s: query_template %q: %v", ns.Namespace, ns.QueryTemplate, err)
+            }
+            return fmt.Errorf("namespace %s: query: %v", ns.Namespace, err)
+        }
+    }
+    return nil
+}
+
+// loadMetricConfig reads a metrics file and, depth first, every file it includes,
+// returning the merged entries. A file reached twice through different includes is
+// only merged once; an include cycle or a metric defined in two files is an error.
+func loadMetricConfig(path string) (MetricConfig, error) {
+    var merged MetricConfig
+    loaded := make(map[string]bool)
+    defined := make(map[string]string)
+    err := mergeMetricFile(path, nil, &merged, loaded, defined)
+    return merged, err
+}
+
+func mergeMetricFile(path string, stack []string, merged *MetricConfig, loaded map[string]bool, defined map[string]string) error {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return err
+    }
+    for _, p := range stack {
+        if p == abs {
+            return fmt.Errorf("include cycle: %s", strings.Join(append(stack, abs), " -> "))
+        }
+    }
+    if loaded[abs] {
+        return nil
+    }
+    loaded[abs] = true
+
+    data, err := readConfigFile(abs)
+    if err != nil {
+        return err
+    }
+    var cfg MetricConfig
+    if err := yaml.Unmarshal(data, &cfg); err != nil {
+        return fmt.Errorf("%s: %v", abs, err)
+    }
+
+    stack = append(stack, abs)
+    for _, inc := range cfg.Include {
+        if !filepath.IsAbs(inc) {
+            inc = filepath.Join(filepath.Dir(abs), inc)
+        }
+        if err := mergeMetricFile(inc, stack, merged, loaded, defined); err != nil {
+            return err
+        }
+    }
+    for name, text := range cfg.QueryTemplates {
+        if _, ok := merged.QueryTemplates[name]; ok {
+            return fmt.Errorf("%s: query template %s is already defined", abs, name)
+        }
+        if merged.QueryTemplates == nil {
+            merged.QueryTemplates = make(map[string]string)
+        }
+        merged.QueryTemplates[name] = text
+    }
+    // Included files may not set it, see MetricConfig.
+    if len(stack) == 1 {
+        merged.CompatMetricNames = cfg.CompatMetricNames
+    }
+    return addMetricEntries(merged, cfg.Metrics, abs, defined)
+}
+
+// addMetricEntries appends entries read from source to merged, with their
+// presets expanded. A metric already defined by an earlier source is an error.
+func addMetricEntries(merged *MetricConfig, entries []MetricNamespace, source string, defined map[string]string) error {
+    for _, ns := range entries {
+        ns, err := expandPreset(ns)
+        if err != nil {
+            return fmt.Errorf("%s: %v", source, err)
+        }
+        for _, name := range ns.Names {
+            key := strings.Join([]string{ns.Namespace, ns.ResourceGroup, ns.AggregationScope, name}, "/")
+            if prev, ok := defined[key]; ok {
+                return fmt.Errorf("%s: metric %s in namespace %s is already defined in %s", source, name, ns.Namespace, prev)
+            }
+            defined[key] = source
+        }
+        merged.Metrics = append(merged.Metrics, ns)
+    }
+    return nil
+}
+
+// maxConfigFileSize caps how much of a config file is read, so pointing the
+// exporter at the wrong file, such as a large log, fails fast instead of stalling.
+const maxConfigFileSize = 10 << 20
+
+// readConfigFile reads a YAML config file of at most maxConfigFileSize bytes and
+// checks that its content is a YAML mapping.
+func readConfigFile(path string) ([]byte, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if !info.Mode().IsRegular() {
+        return nil, fmt.Errorf("%s is not a regular file", path)
+    }
+    data, err := io.ReadAll(io.LimitReader(f, maxConfigFileSize+1))
+    if err != nil {
+        return nil, err
+    }
+    if len(data) > maxConfigFileSize {
+        return nil, fmt.Errorf("%s is larger than %d MB; is it the right file?", path, maxConfigFileSize>>20)
+    }
+    var doc yaml.Node
+    if err := yaml.Unmarshal(data, &doc); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+        return nil, fmt.Errorf("%s does not contain a YAML mapping; is it the right file?", path)
+    }
+    return data, nil
+}
+
+// warnInsecureKeyFiles logs a warning when the OCI config file, which may hold a
+// pass_phrase, or a key_file or security_token_file it references is readable by
+// other users. Problems reading the files are left to the SDK to report.
+func warnInsecureKeyFiles(cfgPath string) {
+    for _, path := range credentialFiles(cfgPath) {
+        warnWorldReadable(path)
+    }
+}
+
+// credentialFiles returns the OCI config file cfgPath followed by every
+// key_file and security_token_file it references, in any profile.
+func credentialFiles(cfgPath string) []string {
+    files := []string{cfgPath}
+    f, err := os.Open(cfgPath)
+    if err != nil {
+        return files
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        key, value, ok := strings.Cut(scanner.Text(), "=")
+        if !ok {
+            continue
+        }
+        switch strings.TrimSpace(key) {
+        case "key_file", "security_token_file":
+            path := strings.TrimSpace(value)
+            if strings.HasPrefix(path, "~/") {
+                if home, err := os.UserHomeDir(); err == nil {
+                    path = filepath.Join(home, path[2:])
+                }
+            }
+            files = append(files, path)
+        }
+    }
+    return files
+}
+
+func warnWorldReadable(path string) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return
+    }
+    if info.Mode().Perm()&0o004 != 0 {
+        log.Printf("Warning: %s is world-readable (mode %v); restrict it with chmod 600", path, info.Mode().Perm())
+    }
+}
+
+// endOffset returns the namespace's end_offset, or def when it is not set.
+func (ns MetricNamespace) endOffset(def time.Duration) (time.Duration, error) {
+    if ns.EndOffset == "" {
+        return def, nil
+    }
+    d, err := time.ParseDuration(ns.EndOffset)
+    if err != nil {
+        return 0, fmt.Errorf("invalid end_offset %q: %v", ns.EndOffset, err)
+    }
+    if d < 0 {
+        return 0, fmt.Errorf("end_offset %q must not be negative", ns.EndOffset)
+    }
+    return d, nil
+}
+
+// window returns the entry's window, or def when it is not set. Like windows it
+// must be a positive whole number of minutes; it replaces the default window
+// without adding a label, so it cannot be combined with the options that pick
+// windows themselves.
+func (ns MetricNamespace) window(def time.Duration) (time.Duration, error) {
+    if ns.Window == "" {
+        return def, nil
+    }
+    if len(ns.Windows) > 0 || len(ns.Resolutions) > 0 || ns.Resolution == resolutionAuto {
+        return 0, fmt.Errorf("window cannot be combined with windows, resolutions or resolution: auto")
+    }
+    d, err := time.ParseDuration(ns.Window)
+    if err != nil {
+        return 0, fmt.Errorf("invalid window %q: %v", ns.Window, err)
+    }
+    if d < time.Minute || d%time.Minute != 0 {
+        return 0, fmt.Errorf("window %q must be a whole number of minutes", ns.Window)
+    }
+    return d, nil
+}
+
+// queryResolutions returns the parsed resolutions, or nil when the entry has none.
+// Like windows, each must be a positive whole number of minutes, and each is also
+// the window its query aggregates over.
+func (ns MetricNamespace) queryResolutions() ([]time.Duration, error) {
+    if len(ns.Resolutions) == 0 {
+        return nil, nil
+    }
+    if ns.Resolution != "" || len(ns.Windows) > 0 {
+        return nil, fmt.Errorf("resolutions cannot be combined with resolution or windows")
+    }
+    var resolutions []time.Duration
+    seen := make(map[time.Duration]bool, len(ns.Resolutions))
+    for _, r := range ns.Resolutions {
+        d, err := time.ParseDuration(r)
+        if err != nil {
+            return nil, fmt.Errorf("invalid resolution %q: %v", r, err)
+        }
+        if d < time.Minute || d%time.Minute != 0 {
+            return nil, fmt.Errorf("resolution %q must be a whole number of minutes", r)
+        }
+        if seen[d] {
+            return nil, fmt.Errorf("resolution %q is listed twice", r)
+        }
+        seen[d] = true
+        resolutions = append(resolutions, d)
+    }
+    return resolutions, nil
+}
+
+// queryWindows returns the parsed windows, or nil when the entry has none. Each must
+// be a positive whole number of minutes, so it can be written as an MQL interval.
+func (ns MetricNamespace) queryWindows() ([]time.Duration, error) {
+    if len(ns.Windows) > 0 && ns.Resolution == resolutionAuto {
+        return nil, fmt.Errorf("windows cannot be combined with resolution: auto")
+    }
+    var windows []time.Duration
+    seen := make(map[time.Duration]bool, len(ns.Windows))
+    for _, w := range ns.Windows {
+        d, err := time.ParseDuration(w)
+        if err != nil {
+            return nil, fmt.Errorf("invalid window %q: %v", w, err)
+        }
+        if d < time.Minute || d%time.Minute != 0 {
+            return nil, fmt.Errorf("window %q must be a whole number of minutes", w)
+        }
+        if seen[d] {
+            return nil, fmt.Errorf("window %q is listed twice", w)
+        }
+        seen[d] = true
+        windows = append(windows, d)
+    }
+    return windows, nil
+}
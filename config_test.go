@@ -0,0 +1,256 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// inConfigDir writes tenants.yaml and, unless empty, metrics.yaml to the
+// config directory of a temporary working directory, as loadConfigs reads
+// them relative to it. Tests using it must not run in parallel.
+func inConfigDir(t *testing.T, tenants, metrics string) {
+    t.Helper()
+    dir := t.TempDir()
+    if err := os.Mkdir(filepath.Join(dir, "config"), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "config", "tenants.yaml"), []byte(tenants), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if metrics != "" {
+        if err := os.WriteFile(filepath.Join(dir, "config", "metrics.yaml"), []byte(metrics), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chdir(dir); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Chdir(wd) })
+}
+
+const testMetricsYAML = `metrics:
+  - namespace: oci_computeagent
+    names: [CpuUtilization]
+`
+
+func TestSuffixDuplicateNames(t *testing.T) {
+    for _, tc := range []struct {
+        name  string
+        names []string
+        want  []string
+    }{
+        {"unique", []string{"a", "b"}, []string{"a", "b"}},
+        {"duplicate", []string{"a", "a"}, []string{"a", "a-2"}},
+        {"suffix already taken", []string{"a", "a", "a-2", "b", "a"}, []string{"a", "a-3", "a-2", "b", "a-4"}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            tenancies := make([]Tenancy, len(tc.names))
+            for i, name := range tc.names {
+                tenancies[i].Name = name
+            }
+            suffixDuplicateNames(tenancies)
+            got := make([]string, len(tenancies))
+            renamed := 0
+            for i, ten := range tenancies {
+                got[i] = ten.Name
+                if ten.renamedFrom != "" {
+                    renamed++
+                    if ten.renamedFrom != tc.names[i] {
+                        t.Errorf("%s renamedFrom = %q, want %q", ten.Name, ten.renamedFrom, tc.names[i])
+                    }
+                }
+            }
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Errorf("names = %v, want %v", got, tc.want)
+            }
+            if n := len(renamedTenancies(TenancyConfig{Tenancies: tenancies})); n != renamed {
+                t.Errorf("renamedTenancies reported %d problems, want %d", n, renamed)
+            }
+        })
+    }
+}
+
+func TestDuplicateTenancyNames(t *testing.T) {
+    inConfigDir(t, `tenancies:
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..aaa
+    compartment_id: ocid1.compartment.oc1..aaa
+    region: us-ashburn-1
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..bbb
+    compartment_id: ocid1.compartment.oc1..bbb
+    region: us-ashburn-1
+`, testMetricsYAML)
+
+    tenants, _, err := loadConfigs(labelSourceName)
+    if err != nil {
+        t.Fatalf("loadConfigs: %v", err)
+    }
+    var names, labels []string
+    for _, ten := range tenants.Tenancies {
+        names = append(names, ten.Name)
+        labels = append(labels, ten.Label)
+    }
+    if want := []string{"prod", "prod-2"}; !reflect.DeepEqual(names, want) || !reflect.DeepEqual(labels, want) {
+        t.Errorf("names %v and labels %v, want both %v", names, labels, want)
+    }
+
+    if err := checkTenancyNames(tenants, false); err != nil {
+        t.Errorf("checkTenancyNames without strict: %v", err)
+    }
+    err = checkTenancyNames(tenants, true)
+    if err == nil || !strings.Contains(err.Error(), `"prod" is used more than once`) {
+        t.Errorf("checkTenancyNames with strict = %v, want the duplicate name", err)
+    }
+}
+
+func TestCompatMetricNamesLoaded(t *testing.T) {
+    inConfigDir(t, `tenancies:
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..aaa
+    compartment_id: ocid1.compartment.oc1..aaa
+    region: us-ashburn-1
+`, `compat_metric_names: "legacy_{{.Metric}}"
+include: [extra.yaml]
+metrics:
+  - namespace: oci_computeagent
+    names: [CpuUtilization]
+`)
+    extra := "compat_metric_names: \"ignored_{{.Metric}}\"\nmetrics:\n  - namespace: oci_streaming\n    names: [GetMessages.Throughput.Bytes]\n"
+    if err := os.WriteFile(filepath.Join("config", "extra.yaml"), []byte(extra), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    tenants, metrics, err := loadConfigs(labelSourceName)
+    if err != nil {
+        t.Fatalf("loadConfigs: %v", err)
+    }
+    if metrics.CompatMetricNames != "legacy_{{.Metric}}" || len(metrics.Metrics) != 2 {
+        t.Errorf("compat_metric_names = %q with %d entries, want metrics.yaml's and 2", metrics.CompatMetricNames, len(metrics.Metrics))
+    }
+    if got := tenants.Tenancies[0].metrics(metrics).CompatMetricNames; got != metrics.CompatMetricNames {
+        t.Errorf("tenancy's compat_metric_names = %q, want %q", got, metrics.CompatMetricNames)
+    }
+}
+
+func TestMergeTenancyDefaults(t *testing.T) {
+    const defaults = `tenancy_defaults:
+  region: us-ashburn-1
+  compartment_ids: [ocid1.compartment.oc1..d1, ocid1.compartment.oc1..d2]
+  discover_compartments: true
+  profile: shared
+groups:
+  eu:
+    region: eu-frankfurt-1
+    compartment_ids: [ocid1.compartment.oc1..g1]
+  lab:
+    discover_compartments: false
+`
+    for _, tc := range []struct {
+        name      string
+        tenancies string
+        want      Tenancy
+        err       string
+    }{
+        {
+            name:      "defaults only",
+            tenancies: "  - name: a\n",
+            want:      Tenancy{Name: "a", Region: "us-ashburn-1", CompartmentIDs: []string{"ocid1.compartment.oc1..d1", "ocid1.compartment.oc1..d2"}, DiscoverCompartments: true, Profile: "shared"},
+        },
+        {
+            name:      "group replaces scalars and lists",
+            tenancies: "  - name: a\n    group: eu\n",
+            want:      Tenancy{Name: "a", Group: "eu", Region: "eu-frankfurt-1", CompartmentIDs: []string{"ocid1.compartment.oc1..g1"}, DiscoverCompartments: true, Profile: "shared"},
+        },
+        {
+            name:      "group sets false over a true default",
+            tenancies: "  - name: a\n    group: lab\n",
+            want:      Tenancy{Name: "a", Group: "lab", Region: "us-ashburn-1", CompartmentIDs: []string{"ocid1.compartment.oc1..d1", "ocid1.compartment.oc1..d2"}, Profile: "shared"},
+        },
+        {
+            name:      "tenancy wins over its group",
+            tenancies: "  - name: a\n    group: eu\n    region: eu-amsterdam-1\n    compartment_ids: []\n    compartment_id: ocid1.compartment.oc1..own\n",
+            want:      Tenancy{Name: "a", Group: "eu", Region: "eu-amsterdam-1", CompartmentID: "ocid1.compartment.oc1..own", CompartmentIDs: []string{}, DiscoverCompartments: true, Profile: "shared"},
+        },
+        {
+            name:      "unknown group",
+            tenancies: "  - name: a\n    group: us\n",
+            err:       "unknown group us",
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            got, err := mergeTenancyDefaults([]byte(defaults + "tenancies:\n" + tc.tenancies))
+            if tc.err != "" {
+                if err == nil || !strings.Contains(err.Error(), tc.err) {
+                    t.Errorf("error = %v, want %q", err, tc.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("mergeTenancyDefaults: %v", err)
+            }
+            if len(got) != 1 || !reflect.DeepEqual(got[0], tc.want) {
+                t.Errorf("merged %+v, want %+v", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestMergeYAMLMaps(t *testing.T) {
+    dst := map[string]interface{}{
+        "scalar": "dst",
+        "list":   []interface{}{"a", "b"},
+        "nested": map[string]interface{}{"keep": 1, "replace": 1, "deep": map[string]interface{}{"x": 1}},
+    }
+    src := map[string]interface{}{
+        "scalar": "src",
+        "list":   []interface{}{"c"},
+        "nested": map[string]interface{}{"replace": 2, "add": 2, "deep": map[string]interface{}{"y": 2}},
+        "new":    true,
+    }
+    want := map[string]interface{}{
+        "scalar": "src",
+        "list":   []interface{}{"c"},
+        "nested": map[string]interface{}{"keep": 1, "replace": 2, "add": 2, "deep": map[string]interface{}{"x": 1, "y": 2}},
+        "new":    true,
+    }
+    if got := mergeYAMLMaps(dst, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("mergeYAMLMaps = %v, want %v", got, want)
+    }
+    if dst["scalar"] != "dst" || len(dst["nested"].(map[string]interface{})) != 3 {
+        t.Errorf("dst was modified: %v", dst)
+    }
+}
+
+func TestEntryWindow(t *testing.T) {
+    for _, tc := range []struct {
+        ns   MetricNamespace
+        want time.Duration
+        err  bool
+    }{
+        {ns: MetricNamespace{}, want: 3 * time.Minute},
+        {ns: MetricNamespace{Window: "5m"}, want: 5 * time.Minute},
+        {ns: MetricNamespace{Window: "1h"}, want: time.Hour},
+        {ns: MetricNamespace{Window: "90s"}, err: true},
+        {ns: MetricNamespace{Window: "30s"}, err: true},
+        {ns: MetricNamespace{Window: "five"}, err: true},
+        {ns: MetricNamespace{Window: "5m", Windows: []string{"1m"}}, err: true},
+        {ns: MetricNamespace{Window: "5m", Resolution: resolutionAuto}, err: true},
+    } {
+        got, err := tc.ns.window(3 * time.Minute)
+        if tc.err != (err != nil) || got != tc.want {
+            t.Errorf("window %q = %v, %v, want %v (error %v)", tc.ns.Window, got, err, tc.want, tc.err)
+        }
+    }
+    c := &collector{metricWindow: 2 * time.Minute}
+    if got := c.entryWindow(MetricNamespace{}); got != 2*time.Minute {
+        t.Errorf("entry without window got %v, want -metric-window", got)
+    }
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+)
+
+// consoleDomains maps a realm to its console host. The commercial realm has a
+// global console; the others have one console per region.
+var consoleDomains = map[string]string{
+    "oc2":  "oraclegovcloud.com",
+    "oc3":  "oraclegovcloud.com",
+    "oc4":  "oraclegovcloud.uk",
+    "oc8":  "oraclecloud8.com",
+    "oc9":  "oraclecloud9.com",
+    "oc10": "oraclecloud10.com",
+}
+
+// consolePaths maps the resource type segment of an OCID to its console page.
+var consolePaths = map[string]string{
+    "instance":           "/compute/instances/",
+    "volume":             "/block-storage/volumes/",
+    "bootvolume":         "/block-storage/boot-volumes/",
+    "loadbalancer":       "/networking/load-balancers/",
+    "vcn":                "/networking/vcns/",
+    "autonomousdatabase": "/db/adbs/",
+    "cluster":            "/containers/clusters/",
+}
+
+// consoleURL returns the OCI console page of a resource, or "" when the OCID is
+// not of a known resource type. The realm is read from the OCID, falling back to
+// the realm of region.
+func consoleURL(ocid, region string) string {
+    parts := strings.Split(ocid, ".")
+    if len(parts) < 5 || parts[0] != "ocid1" {
+        return ""
+    }
+    path, ok := consolePaths[parts[1]]
+    if !ok {
+        return ""
+    }
+    realm := parts[2]
+    if realm == "" {
+        realm, _ = common.StringToRegion(region).RealmID()
+    }
+    host := "cloud.oracle.com"
+    if domain, ok := consoleDomains[realm]; ok {
+        host = "console." + region + "." + domain
+    }
+    return "https://" + host + path + ocid + "?region=" + region
+}
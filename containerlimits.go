@@ -0,0 +1,90 @@
+package main
+
+import (
+    "log"
+    "math"
+    "os"
+    "runtime"
+    "runtime/debug"
+    "strconv"
+    "strings"
+)
+
+// memLimitRatio is the share of the cgroup memory limit given to GOMEMLIMIT,
+// leaving headroom for memory the Go runtime does not account for.
+const memLimitRatio = 0.9
+
+// cgroupCPUQuota returns the CPU limit of the process' cgroup in cores, from
+// cgroup v2 or else v1, and whether there is one.
+func cgroupCPUQuota() (float64, bool) {
+    if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+        fields := strings.Fields(string(data))
+        if len(fields) == 2 && fields[0] != "max" {
+            quota, err1 := strconv.ParseFloat(fields[0], 64)
+            period, err2 := strconv.ParseFloat(fields[1], 64)
+            if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+                return quota / period, true
+            }
+        }
+        return 0, false
+    }
+    quota, err1 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+    period, err2 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+    if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+        return 0, false
+    }
+    return float64(quota) / float64(period), true
+}
+
+// cgroupMemoryLimit returns the memory limit of the process' cgroup in bytes,
+// from cgroup v2 or else v1, and whether there is one.
+func cgroupMemoryLimit() (int64, bool) {
+    if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+        limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+        return limit, err == nil && limit > 0
+    }
+    limit, err := readCgroupInt("/sys/fs/cgroup/memory/memory.limit_in_bytes")
+    // v1 reports a huge number, near MaxInt64, when unlimited.
+    if err != nil || limit <= 0 || limit >= math.MaxInt64/2 {
+        return 0, false
+    }
+    return limit, true
+}
+
+func readCgroupInt(path string) (int64, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// applyContainerLimits sizes GOMAXPROCS to the cgroup CPU limit, rounded down
+// and at least 1, and GOMEMLIMIT to memLimitRatio of the cgroup memory limit,
+// as enabled. A value set through the environment is left alone.
+func applyContainerLimits(autoProcs, autoMemLimit bool) {
+    if autoProcs {
+        switch cores, ok := cgroupCPUQuota(); {
+        case os.Getenv("GOMAXPROCS") != "":
+            log.Printf("GOMAXPROCS is set in the environment, keeping %d", runtime.GOMAXPROCS(0))
+        case !ok:
+            log.Printf("No cgroup CPU limit found, keeping GOMAXPROCS=%d", runtime.GOMAXPROCS(0))
+        default:
+            procs := int(math.Max(1, math.Floor(cores)))
+            runtime.GOMAXPROCS(procs)
+            log.Printf("Set GOMAXPROCS=%d from the cgroup CPU limit of %.2f cores", procs, cores)
+        }
+    }
+    if autoMemLimit {
+        switch limit, ok := cgroupMemoryLimit(); {
+        case os.Getenv("GOMEMLIMIT") != "":
+            log.Printf("GOMEMLIMIT is set in the environment, keeping %d bytes", debug.SetMemoryLimit(-1))
+        case !ok:
+            log.Printf("No cgroup memory limit found, leaving GOMEMLIMIT unset")
+        default:
+            memLimit := int64(float64(limit) * memLimitRatio)
+            debug.SetMemoryLimit(memLimit)
+            log.Printf("Set GOMEMLIMIT=%d bytes, %.0f%% of the cgroup memory limit of %d bytes", memLimit, memLimitRatio*100, limit)
+        }
+    }
+}
@@ -0,0 +1,13 @@
+package main
+
+import "log"
+
+// debugLogging enables debugf, set by -debug.
+var debugLogging bool
+
+// debugf logs like log.Printf when -debug is set.
+func debugf(format string, args ...interface{}) {
+    if debugLogging {
+        log.Printf("DEBUG: "+format, args...)
+    }
+}
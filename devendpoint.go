@@ -0,0 +1,51 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "log"
+    "net"
+    "net/http"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+// testEndpointFake is the -test-endpoint value that starts the built-in fake.
+const testEndpointFake = "fake"
+
+// startTestEndpoint resolves -test-endpoint to a URL, starting the built-in
+// fake Monitoring server on a loopback port for "fake".
+func startTestEndpoint(endpoint string) (string, error) {
+    if endpoint != testEndpointFake {
+        return endpoint, nil
+    }
+    fixtures, err := fakemonitoring.DefaultFixtures()
+    if err != nil {
+        return "", err
+    }
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return "", err
+    }
+    go func() {
+        if err := http.Serve(ln, fakemonitoring.New(fixtures)); err != nil {
+            log.Printf("Fake Monitoring server stopped: %v", err)
+        }
+    }()
+    return "http://" + ln.Addr().String(), nil
+}
+
+// testConfigProvider returns credentials only good for signing requests to a
+// test endpoint: placeholder OCIDs and a key generated for this run.
+func testConfigProvider() (common.ConfigurationProvider, error) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return nil, err
+    }
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+    return common.NewRawConfigurationProvider("ocid1.tenancy.oc1..test", "ocid1.user.oc1..test", "us-ashburn-1", "00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00", string(keyPEM), nil), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// dimensionLabel is a label filled from the first present of several dimensions.
+type dimensionLabel struct {
+    label      string
+    dimensions []string
+}
+
+// builtinDimensionLabels are labels added from the dimensions of well-known
+// namespaces: messaging ones, so their backlog and throughput series identify
+// the stream, partition, queue or connector, and Functions and OKE, whose
+// metrics key on the function or cluster rather than on resourceId, all
+// without custom configuration.
+var builtinDimensionLabels = map[string][]dimensionLabel{
+    "oci_streaming": {
+        {"stream_id", []string{"streamId", "resourceId"}},
+        {"stream_name", []string{"streamName", "resourceName"}},
+        {"stream_pool_id", []string{"streamPoolId"}},
+        {"partition", []string{"partition", "partitionId"}},
+    },
+    "oci_queue": {
+        {"queue_id", []string{"queueId", "resourceId"}},
+        {"queue_name", []string{"queueName", "resourceName"}},
+        {"channel_id", []string{"channelId"}},
+    },
+    "oci_service_connector_hub": {
+        {"connector_id", []string{"connectorId", "resourceId"}},
+        {"connector_name", []string{"connectorName", "resourceName"}},
+        {"source_kind", []string{"sourceKind"}},
+        {"target_kind", []string{"targetKind"}},
+        {"task_kind", []string{"taskKind"}},
+    },
+    "oci_faas": {
+        {"function_id", []string{"functionId", "resourceId"}},
+        {"function_name", []string{"functionName", "resourceDisplayName", "resourceName"}},
+        {"application_id", []string{"applicationId"}},
+        {"application_name", []string{"applicationName", "applicationDisplayName"}},
+    },
+    "oci_oke": {
+        {"cluster_id", []string{"clusterId", "resourceId"}},
+        {"cluster_name", []string{"clusterName", "resourceDisplayName", "resourceName"}},
+        {"node_pool_id", []string{"nodepoolId", "nodePoolId"}},
+    },
+}
+
+// addBuiltinDimensionLabels adds the built-in labels of namespace for which a
+// dimension is present and returns the dimension keys it used.
+func addBuiltinDimensionLabels(labels prometheus.Labels, namespace string, dims map[string]string) []string {
+    var used []string
+    for _, dl := range builtinDimensionLabels[namespace] {
+        for _, dim := range dl.dimensions {
+            if v, ok := dims[dim]; ok && v != "" {
+                labels[dl.label] = v
+                used = append(used, dim)
+                break
+            }
+        }
+    }
+    return used
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// entryError is the last failure of one (tenancy, namespace, metric).
+type entryError struct {
+    Tenancy       string    `json:"tenancy"`
+    Namespace     string    `json:"namespace"`
+    Metric        string    `json:"metric"`
+    CompartmentID string    `json:"compartment_id"`
+    Class         string    `json:"class"`
+    Message       string    `json:"message"`
+    RequestID     string    `json:"opc_request_id,omitempty"`
+    Time          time.Time `json:"time"`
+}
+
+// entryErrors keeps the last error of every failing (tenancy, namespace,
+// metric). An entry is cleared when its query next succeeds in the compartment
+// that failed, and dropped once it is no longer configured, so memory is
+// bounded by the configured entries, not by the error rate.
+type entryErrors struct {
+    mu     sync.Mutex
+    errors map[string]entryError
+}
+
+func newEntryErrors() *entryErrors {
+    return &entryErrors{errors: make(map[string]entryError)}
+}
+
+func entryErrorKey(tenancy, namespace, metric string) string {
+    return tenancy + "\xff" + namespace + "\xff" + metric
+}
+
+// Failed records err as the last error of the entry.
+func (e *entryErrors) Failed(ten Tenancy, namespace, metric, compartmentID string, err error, at time.Time) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.errors[entryErrorKey(ten.Label, namespace, metric)] = entryError{
+        Tenancy:       ten.Label,
+        Namespace:     namespace,
+        Metric:        metric,
+        CompartmentID: compartmentID,
+        Class:         errorClass(err),
+        Message:       err.Error(),
+        RequestID:     requestID(err),
+        Time:          at.UTC(),
+    }
+}
+
+// Succeeded clears the entry's error if it came from compartmentID.
+func (e *entryErrors) Succeeded(ten Tenancy, namespace, metric, compartmentID string) {
+    key := entryErrorKey(ten.Label, namespace, metric)
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if prev, ok := e.errors[key]; ok && prev.CompartmentID == compartmentID {
+        delete(e.errors, key)
+    }
+}
+
+// Retain drops the errors of the tenancy whose entry is not in config.
+func (e *entryErrors) Retain(tenancy string, config MetricConfig) {
+    keep := make(map[string]bool)
+    for _, ns := range config.Metrics {
+        for _, name := range ns.Names {
+            keep[entryErrorKey(tenancy, ns.Namespace, name)] = true
+        }
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for key, entry := range e.errors {
+        if entry.Tenancy == tenancy && !keep[key] {
+            delete(e.errors, key)
+        }
+    }
+}
+
+// forget drops every error of the tenancy.
+func (e *entryErrors) forget(tenancy string) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for key := range e.errors {
+        if strings.HasPrefix(key, tenancy+"\xff") {
+            delete(e.errors, key)
+        }
+    }
+}
+
+// List returns the errors of the tenancy, or of every tenancy for "", ordered
+// by tenancy, namespace and metric.
+func (e *entryErrors) List(tenancy string) []entryError {
+    e.mu.Lock()
+    out := make([]entryError, 0, len(e.errors))
+    for _, entry := range e.errors {
+        if tenancy == "" || entry.Tenancy == tenancy {
+            out = append(out, entry)
+        }
+    }
+    e.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool {
+        a, b := out[i], out[j]
+        if a.Tenancy != b.Tenancy {
+            return a.Tenancy < b.Tenancy
+        }
+        if a.Namespace != b.Namespace {
+            return a.Namespace < b.Namespace
+        }
+        return a.Metric < b.Metric
+    })
+    return out
+}
+
+// errorsHandler serves GET /debug/errors: the last error of every failing
+// entry, so the message is at hand without searching the logs.
+func errorsHandler(errs *entryErrors) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        out := struct {
+            Errors []entryError `json:"errors"`
+        }{Errors: errs.List("")}
+        w.Header().Set("Content-Type", "application/json")
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(out); err != nil {
+            log.Printf("Writing /debug/errors: %v", err)
+        }
+    }
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestEntryErrorsClearedByTheirCompartment(t *testing.T) {
+    e := newEntryErrors()
+    acme := testTenancy("acme")
+    e.Failed(acme, "oci_computeagent", "CpuUtilization", "ocid1.compartment.oc1..a", errors.New("down"), time.Now())
+    e.Failed(acme, "oci_computeagent", "MemoryUtilization", "ocid1.compartment.oc1..a", errors.New("down"), time.Now())
+    e.Failed(testTenancy("other"), "oci_computeagent", "CpuUtilization", "ocid1.compartment.oc1..a", errors.New("down"), time.Now())
+
+    e.Succeeded(acme, "oci_computeagent", "CpuUtilization", "ocid1.compartment.oc1..b")
+    if got := len(e.List("acme")); got != 2 {
+        t.Fatalf("%d errors after a success in another compartment, want 2", got)
+    }
+    e.Succeeded(acme, "oci_computeagent", "CpuUtilization", "ocid1.compartment.oc1..a")
+    if got := e.List("acme"); len(got) != 1 || got[0].Metric != "MemoryUtilization" {
+        t.Fatalf("errors after a success = %+v, want MemoryUtilization's only", got)
+    }
+
+    e.Retain("acme", MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}}}})
+    if got := len(e.List("acme")); got != 0 {
+        t.Errorf("%d errors left for entries no longer configured, want 0", got)
+    }
+    e.forget("other")
+    if got := len(e.List("")); got != 0 {
+        t.Errorf("%d errors left after forgetting the tenancy, want 0", got)
+    }
+}
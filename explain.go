@@ -0,0 +1,157 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// streamVerdict is what became of one returned stream: exported as a series
+// with Labels and Value, or dropped for Reason, its streams_skipped_total
+// reason, with Detail naming the rule or condition.
+type streamVerdict struct {
+    Metric     string
+    Dimensions map[string]string
+    Labels     prometheus.Labels
+    Value      *float64
+    Timestamp  time.Time
+    Reason     string
+    Detail     string
+}
+
+// explainTarget is the metric -explain collects once: tenancy=X metric=Y and
+// optionally namespace=Z.
+type explainTarget struct {
+    tenancy, namespace, metric string
+}
+
+func parseExplain(arg string) (explainTarget, error) {
+    var t explainTarget
+    for _, field := range strings.Fields(arg) {
+        key, value, ok := strings.Cut(field, "=")
+        if !ok || value == "" {
+            return t, fmt.Errorf("%q is not key=value", field)
+        }
+        switch key {
+        case "tenancy":
+            t.tenancy = value
+        case "namespace":
+            t.namespace = value
+        case "metric":
+            t.metric = value
+        default:
+            return t, fmt.Errorf("unknown key %q; use tenancy, metric and optionally namespace", key)
+        }
+    }
+    if t.tenancy == "" || t.metric == "" {
+        return t, fmt.Errorf("tenancy and metric are required")
+    }
+    return t, nil
+}
+
+// explainEntries returns the tenancy's enabled entries that collect the target
+// metric, wildcard ones included, each narrowed to that metric.
+func explainEntries(ten Tenancy, global MetricConfig, t explainTarget) MetricConfig {
+    metrics := ten.metrics(global)
+    var entries []MetricNamespace
+    for _, ns := range metrics.Metrics {
+        if t.namespace != "" && ns.Namespace != t.namespace {
+            continue
+        }
+        for _, name := range ns.Names {
+            if name == t.metric || name == wildcardName {
+                ns.Names = []string{t.metric}
+                entries = append(entries, ns)
+                break
+            }
+        }
+    }
+    metrics.Metrics = entries
+    return metrics
+}
+
+// runExplain runs the target tenancy's queries of the target metric once,
+// through the same path as a collection cycle, and writes the verdict on every
+// returned stream to w. It tells streams dropped by a rule apart from queries
+// OCI returned nothing for.
+func runExplain(ctx context.Context, w io.Writer, coll *collector, clients *regionClients, identityClient identity.IdentityClient, tenants TenancyConfig, global MetricConfig, t explainTarget) error {
+    var ten Tenancy
+    found := false
+    for _, candidate := range tenants.Tenancies {
+        if candidate.Name == t.tenancy || candidate.Label == t.tenancy {
+            ten, found = candidate, true
+            break
+        }
+    }
+    if !found {
+        return fmt.Errorf("no tenancy named %s", t.tenancy)
+    }
+    metrics := explainEntries(ten, global, t)
+    if len(metrics.Metrics) == 0 {
+        return fmt.Errorf("no enabled entry of tenancy %s collects %s", ten.Name, t.metric)
+    }
+    client, err := clients.For(ten)
+    if err != nil {
+        return err
+    }
+    if set, ok := clients.Profile(ten); ok {
+        identityClient = set.identity
+    }
+
+    var discovered []string
+    if ten.DiscoverCompartments {
+        identityClient.SetRegion(ten.Region)
+        if discovered, err = discoverCompartments(ctx, identityClient, ten); err != nil {
+            fmt.Fprintf(w, "Compartment discovery failed, using the configured compartments: %v\n", err)
+        }
+    }
+    compartments := ten.queryCompartments(discovered)
+    for _, q := range coll.plan(ten, compartments, metrics, time.Time{}).Queries {
+        fmt.Fprintf(w, "Query %s: %s (resolution %s) in %d compartments\n", q.Namespace, q.Query, q.Resolution, len(q.Compartments))
+    }
+
+    // A one-off run must not overwrite the dump file or be held back by backoff.
+    coll.queryDump, coll.backoff = nil, nil
+    var verdicts []streamVerdict
+    coll.explain = func(v streamVerdict) { verdicts = append(verdicts, v) }
+    started := time.Now()
+    stats, err := coll.collectTenancy(ctx, client, ten, compartments, metrics)
+    coll.explain = nil
+
+    for _, v := range verdicts {
+        if v.Reason == "" {
+            fmt.Fprintf(w, "exported %s%s %g at %s\n", valueMetricName, formatLabels(v.Labels), *v.Value, v.Timestamp.UTC().Format(time.RFC3339))
+        } else {
+            fmt.Fprintf(w, "dropped  %s: %s (%s)\n", formatLabels(v.Dimensions), v.Reason, v.Detail)
+        }
+    }
+    switch {
+    case len(verdicts) > 0:
+    case stats.returned == 0 && len(stats.Errors) == 0:
+        fmt.Fprintln(w, "OCI returned no streams: there is no data for the metric in the queried compartments and window, so no rule of the exporter is involved.")
+    case len(stats.Errors) > 0:
+        fmt.Fprintln(w, "No streams: the queries failed, see the errors above.")
+    }
+    fmt.Fprintf(w, "Cycle %s\n", stats.summary(ten, time.Since(started), err))
+    return nil
+}
+
+// formatLabels formats labels or dimensions in exposition style, sorted by name.
+func formatLabels(labels map[string]string) string {
+    names := make([]string, 0, len(labels))
+    for name := range labels {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    parts := make([]string, len(names))
+    for i, name := range names {
+        parts[i] = fmt.Sprintf("%s=%q", name, labels[name])
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
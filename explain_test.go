@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "testing"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+)
+
+func TestParseExplain(t *testing.T) {
+    for _, tc := range []struct {
+        arg  string
+        want explainTarget
+        err  bool
+    }{
+        {arg: "tenancy=acme metric=CpuUtilization", want: explainTarget{tenancy: "acme", metric: "CpuUtilization"}},
+        {arg: "namespace=oci_computeagent tenancy=acme metric=CpuUtilization", want: explainTarget{tenancy: "acme", namespace: "oci_computeagent", metric: "CpuUtilization"}},
+        {arg: "tenancy=acme", err: true},
+        {arg: "tenancy=acme metric=", err: true},
+        {arg: "tenancy=acme metric=CpuUtilization region=us-ashburn-1", err: true},
+    } {
+        got, err := parseExplain(tc.arg)
+        if tc.err {
+            if err == nil {
+                t.Errorf("parseExplain(%q) = %+v, want an error", tc.arg, got)
+            }
+            continue
+        }
+        if err != nil || got != tc.want {
+            t.Errorf("parseExplain(%q) = %+v, %v, want %+v", tc.arg, got, err, tc.want)
+        }
+    }
+}
+
+func TestRunExplain(t *testing.T) {
+    _, url := startFake(t, nil)
+    tenants := TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}}
+    global := MetricConfig{Metrics: []MetricNamespace{
+        {Namespace: "oci_computeagent", Names: []string{"CpuUtilization", "MemoryUtilization", "DiskBytesRead"}},
+    }}
+    for _, tc := range []struct {
+        metric string
+        // want appears count times in the output.
+        want  string
+        count int
+    }{
+        {"CpuUtilization", "exported " + valueMetricName + "{", 2},
+        {"MemoryUtilization", "nil_value", 1},
+        {"DiskBytesRead", "OCI returned no streams", 1},
+    } {
+        t.Run(tc.metric, func(t *testing.T) {
+            c, _ := newTestCollector(t)
+            clients := newRegionClients(newFakeClient(t, ""), nil)
+            clients.override = url
+            var out strings.Builder
+            target := explainTarget{tenancy: "acme", metric: tc.metric}
+            if err := runExplain(context.Background(), &out, c, clients, identity.IdentityClient{}, tenants, global, target); err != nil {
+                t.Fatalf("runExplain: %v", err)
+            }
+            if n := strings.Count(out.String(), tc.want); n != tc.count {
+                t.Errorf("output has %q %d times, want %d:\n%s", tc.want, n, tc.count, out.String())
+            }
+        })
+    }
+
+    c, _ := newTestCollector(t)
+    target := explainTarget{tenancy: "acme", metric: "NetworksBytesIn"}
+    if err := runExplain(context.Background(), &strings.Builder{}, c, newRegionClients(newFakeClient(t, url), nil), identity.IdentityClient{}, tenants, global, target); err == nil {
+        t.Error("explaining a metric no entry collects succeeded")
+    }
+}
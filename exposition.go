@@ -0,0 +1,257 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    dto "github.com/prometheus/client_model/go"
+)
+
+// valueMetricName is the metric every OCI datapoint is exported as.
+const valueMetricName = "oci_metric_value"
+
+// entryRanks orders the configured (namespace, metric) pairs by how much they are
+// worth keeping: higher priority first, then earlier in the config. Keys are
+// namespace + "\xff" + metric name.
+func entryRanks(metrics MetricConfig) map[string]int {
+    type entry struct {
+        key      string
+        priority int
+        index    int
+    }
+    var entries []entry
+    for _, ns := range metrics.Metrics {
+        for _, name := range ns.Names {
+            entries = append(entries, entry{ns.Namespace + "\xff" + name, ns.priorityWeight(), len(entries)})
+        }
+    }
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].priority > entries[j].priority })
+    ranks := make(map[string]int, len(entries))
+    for i, e := range entries {
+        if _, ok := ranks[e.key]; !ok {
+            ranks[e.key] = i
+        }
+    }
+    return ranks
+}
+
+// limitingGatherer, when maxSeries is positive and exceeded, drops value series
+// of the lowest-ranked (namespace, metric) pairs until the output fits, instead
+// of letting an oversized scrape fail as a whole. Value series are those of the
+// families valueFamily accepts: oci_metric_value and its compat_metric_names
+// copies.
+type limitingGatherer struct {
+    inner       prometheus.Gatherer
+    maxSeries   int
+    metrics     func() MetricConfig
+    valueFamily func(name string) bool
+
+    dropped prometheus.Gauge
+
+    mu          sync.Mutex
+    lastDropped int
+}
+
+func newLimitingGatherer(inner prometheus.Gatherer, maxSeries int, metrics func() MetricConfig, valueFamily func(string) bool, self *selfMetrics) *limitingGatherer {
+    g := &limitingGatherer{inner: inner, maxSeries: maxSeries, metrics: metrics, valueFamily: valueFamily}
+    g.dropped = self.gaugeVec("exposition_dropped_series", "Series dropped from the last exposition to stay within -max-exposition-series.").WithLabelValues()
+    return g
+}
+
+func (g *limitingGatherer) Gather() ([]*dto.MetricFamily, error) {
+    families, err := g.inner.Gather()
+    total := 0
+    for _, mf := range families {
+        total += len(mf.Metric)
+    }
+
+    dropped := 0
+    if g.maxSeries > 0 && total > g.maxSeries {
+        dropped = g.limit(families, total-g.maxSeries)
+        total -= dropped
+    }
+    g.dropped.Set(float64(dropped))
+
+    g.mu.Lock()
+    if dropped != g.lastDropped {
+        if dropped > 0 {
+            log.Printf("WARNING: exposition exceeds -max-exposition-series=%d, dropped %d value series of the lowest-priority entries", g.maxSeries, dropped)
+        } else {
+            log.Printf("Exposition is back within -max-exposition-series=%d", g.maxSeries)
+        }
+        g.lastDropped = dropped
+    }
+    g.mu.Unlock()
+    return families, err
+}
+
+// limit removes at least excess value series, whole (namespace, metric) groups
+// at a time starting from the lowest rank, and returns how many it removed.
+func (g *limitingGatherer) limit(families []*dto.MetricFamily, excess int) int {
+    ranks := entryRanks(g.metrics())
+    unranked := len(ranks)
+    groups := make(map[int][]*dto.Metric)
+    var valueFamilies []*dto.MetricFamily
+    for _, mf := range families {
+        if !g.valueFamily(mf.GetName()) {
+            continue
+        }
+        valueFamilies = append(valueFamilies, mf)
+        for _, m := range mf.Metric {
+            var namespace, metric string
+            for _, lp := range m.Label {
+                switch lp.GetName() {
+                case "namespace":
+                    namespace = lp.GetValue()
+                case "metric":
+                    metric = lp.GetValue()
+                }
+            }
+            rank, ok := ranks[namespace+"\xff"+metric]
+            if !ok {
+                // Metrics of a wildcard entry rank with the entry.
+                rank, ok = ranks[namespace+"\xff"+wildcardName]
+            }
+            if !ok {
+                rank = unranked
+            }
+            groups[rank] = append(groups[rank], m)
+        }
+    }
+    order := make([]int, 0, len(groups))
+    for rank := range groups {
+        order = append(order, rank)
+    }
+    sort.Sort(sort.Reverse(sort.IntSlice(order)))
+
+    drop := make(map[*dto.Metric]bool)
+    for _, rank := range order {
+        if len(drop) >= excess {
+            break
+        }
+        for _, m := range groups[rank] {
+            drop[m] = true
+        }
+    }
+    for _, mf := range valueFamilies {
+        kept := mf.Metric[:0]
+        for _, m := range mf.Metric {
+            if !drop[m] {
+                kept = append(kept, m)
+            }
+        }
+        mf.Metric = kept
+    }
+    return len(drop)
+}
+
+// countingWriter counts the bytes of a response body.
+type countingWriter struct {
+    http.ResponseWriter
+    n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+    n, err := w.ResponseWriter.Write(b)
+    w.n += n
+    return n, err
+}
+
+// seriesCounter is a Gatherer that counts the series inner returns.
+type seriesCounter struct {
+    inner prometheus.Gatherer
+    n     int
+}
+
+func (c *seriesCounter) Gather() ([]*dto.MetricFamily, error) {
+    families, err := c.inner.Gather()
+    for _, mf := range families {
+        c.n += len(mf.Metric)
+    }
+    return families, err
+}
+
+// nameFilter is a Gatherer returning only the families of inner with one of
+// the given names.
+type nameFilter struct {
+    inner prometheus.Gatherer
+    names map[string]bool
+}
+
+func (f nameFilter) Gather() ([]*dto.MetricFamily, error) {
+    families, err := f.inner.Gather()
+    kept := families[:0]
+    for _, mf := range families {
+        if f.names[mf.GetName()] {
+            kept = append(kept, mf)
+        }
+    }
+    return kept, err
+}
+
+// filteredHandler serves the exposition of g. Requests with name[] query
+// parameters, e.g. /metrics?name[]=oci_metric_value, only get those families,
+// which saves federating Prometheus servers from fetching what they drop.
+// Unknown names match nothing; without parameters the output is complete.
+// The series and bytes of every exposition are measured on what was sent,
+// after the filter, and labeled by whether one was applied.
+func filteredHandler(g prometheus.Gatherer, opts promhttp.HandlerOpts, self *selfMetrics) http.Handler {
+    series := self.gaugeVec("exposition_series", "Series in the last rendered /metrics exposition, by whether name[] filtered it.", "filtered")
+    size := self.gaugeVec("exposition_bytes", "Size in bytes, as sent, of the last rendered /metrics exposition, by whether name[] filtered it.", "filtered")
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        served := g
+        requested := r.URL.Query()["name[]"]
+        if len(requested) > 0 {
+            names := make(map[string]bool, len(requested))
+            for _, name := range requested {
+                names[name] = true
+            }
+            served = nameFilter{inner: g, names: names}
+        }
+        counted := &seriesCounter{inner: served}
+        cw := &countingWriter{ResponseWriter: w}
+        promhttp.HandlerFor(counted, opts).ServeHTTP(cw, r)
+        filtered := strconv.FormatBool(len(requested) > 0)
+        series.WithLabelValues(filtered).Set(float64(counted.n))
+        size.WithLabelValues(filtered).Set(float64(cw.n))
+    })
+}
+
+// tenancyOrder is a Gatherer that sorts the series of every family of inner by
+// tenancy, then namespace, then the remaining labels, so each tenancy's series
+// are contiguous when reading the exposition. Prometheus ignores the order.
+type tenancyOrder struct {
+    inner prometheus.Gatherer
+}
+
+func (o tenancyOrder) Gather() ([]*dto.MetricFamily, error) {
+    families, err := o.inner.Gather()
+    for _, mf := range families {
+        sort.SliceStable(mf.Metric, func(i, j int) bool {
+            a, b := mf.Metric[i], mf.Metric[j]
+            for _, name := range []string{"tenancy", "namespace"} {
+                if va, vb := metricLabel(a, name), metricLabel(b, name); va != vb {
+                    return va < vb
+                }
+            }
+            // Registry order, which sorts by all labels, breaks ties.
+            return false
+        })
+    }
+    return families, err
+}
+
+// metricLabel returns the value of the named label of m, or "".
+func metricLabel(m *dto.Metric, name string) string {
+    for _, lp := range m.Label {
+        if lp.GetName() == name {
+            return lp.GetValue()
+        }
+    }
+    return ""
+}
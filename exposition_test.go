@@ -0,0 +1,131 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// fillStore stores n value series of the acme tenancy in c.
+func fillStore(c *collector, n int) {
+    t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    for i := 0; i < n; i++ {
+        c.store.SetAt(prometheus.Labels{"tenancy": "acme", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": fmt.Sprintf("ocid1.instance.oc1.iad.%08d", i)}, float64(i), t0)
+    }
+}
+
+func BenchmarkExposition(b *testing.B) {
+    c, reg := newTestCollector(b)
+    fillStore(c, benchStreams)
+    gatherer := newLimitingGatherer(reg, 0, func() MetricConfig { return cpuConfig }, func(name string) bool { return name == valueMetricName }, c.self)
+    handler := filteredHandler(gatherer, promhttp.HandlerOpts{}, c.self)
+    b.ReportAllocs()
+    b.ResetTimer()
+    var size int
+    for i := 0; i < b.N; i++ {
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+        if rec.Code != http.StatusOK {
+            b.Fatalf("status %d: %s", rec.Code, rec.Body)
+        }
+        size = rec.Body.Len()
+    }
+    b.ReportMetric(float64(size), "bytes/exposition")
+}
+
+func TestExpositionSizeMeasuredAfterFilter(t *testing.T) {
+    c, reg := newTestCollector(t)
+    fillStore(c, 10)
+    c.tenancyInfo.WithLabelValues("acme", "ocid1.tenancy.oc1..test", "us-ashburn-1", "ocid1.compartment.oc1..test").Set(1)
+    gatherer := newLimitingGatherer(reg, 0, func() MetricConfig { return cpuConfig }, func(name string) bool { return name == valueMetricName }, c.self)
+    handler := filteredHandler(gatherer, promhttp.HandlerOpts{}, c.self)
+    scrape := func(target string) (series, bytes int) {
+        t.Helper()
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+        if rec.Code != http.StatusOK {
+            t.Fatalf("%s: status %d", target, rec.Code)
+        }
+        for _, line := range strings.Split(rec.Body.String(), "\n") {
+            if line != "" && !strings.HasPrefix(line, "#") {
+                series++
+            }
+        }
+        return series, rec.Body.Len()
+    }
+
+    fullSeries, fullBytes := scrape("/metrics")
+    filteredSeries, filteredBytes := scrape("/metrics?name[]=" + valueMetricName)
+    if filteredSeries != 10 || fullSeries <= filteredSeries {
+        t.Fatalf("full exposition has %d series, filtered %d, want more than 10 and 10", fullSeries, filteredSeries)
+    }
+    for _, tc := range []struct {
+        filtered      string
+        series, bytes int
+    }{
+        {"false", fullSeries, fullBytes},
+        {"true", filteredSeries, filteredBytes},
+    } {
+        if got := gaugeValue(t, reg, defaultSelfMetricsPrefix+"exposition_series", "filtered", tc.filtered); got != float64(tc.series) {
+            t.Errorf("exposition_series{filtered=%q} = %v, want %d", tc.filtered, got, tc.series)
+        }
+        if got := gaugeValue(t, reg, defaultSelfMetricsPrefix+"exposition_bytes", "filtered", tc.filtered); got != float64(tc.bytes) {
+            t.Errorf("exposition_bytes{filtered=%q} = %v, want %d", tc.filtered, got, tc.bytes)
+        }
+    }
+}
+
+func TestTenancyOrder(t *testing.T) {
+    c, reg := newTestCollector(t)
+    t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    for _, l := range []prometheus.Labels{
+        {"tenancy": "beta", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": "1"},
+        {"tenancy": "acme", "namespace": "oci_lbaas", "metric": "CpuUtilization", "resource_id": "2"},
+        {"tenancy": "acme", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": "3"},
+    } {
+        c.store.SetAt(l, 1, t0)
+    }
+    families, err := tenancyOrder{inner: reg}.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var order []string
+    for _, mf := range families {
+        if mf.GetName() == "oci_metric_value" {
+            for _, m := range mf.Metric {
+                order = append(order, metricLabel(m, "resource_id"))
+            }
+        }
+    }
+    if got := strings.Join(order, ","); got != "3,2,1" {
+        t.Errorf("series order by resource_id = %s, want 3,2,1 (by tenancy, then namespace)", got)
+    }
+}
+
+// gaugeValue returns the value of the gauge family name in g whose label has
+// the given value.
+func gaugeValue(t *testing.T, g prometheus.Gatherer, name, label, value string) float64 {
+    t.Helper()
+    families, err := g.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, mf := range families {
+        if mf.GetName() != name {
+            continue
+        }
+        for _, m := range mf.Metric {
+            if metricLabel(m, label) == value {
+                return m.GetGauge().GetValue()
+            }
+        }
+    }
+    t.Fatalf("no %s{%s=%q}", name, label, value)
+    return 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+// The tests run the collector against the fake Monitoring server of
+// internal/fakemonitoring, the one -test-endpoint fake serves.
+
+var (
+    testProviderOnce sync.Once
+    testProvider     common.ConfigurationProvider
+    testProviderErr  error
+)
+
+// sharedTestProvider returns one testConfigProvider for every test, as
+// generating its key is slow.
+func sharedTestProvider(t testing.TB) common.ConfigurationProvider {
+    t.Helper()
+    testProviderOnce.Do(func() {
+        testProvider, testProviderErr = testConfigProvider()
+    })
+    if testProviderErr != nil {
+        t.Fatalf("creating test credentials: %v", testProviderErr)
+    }
+    return testProvider
+}
+
+// startFake serves series, or the default fixtures when series is nil, on a
+// loopback port until the test ends.
+func startFake(t testing.TB, series []fakemonitoring.Series) (*fakemonitoring.Server, string) {
+    t.Helper()
+    if series == nil {
+        var err error
+        if series, err = fakemonitoring.DefaultFixtures(); err != nil {
+            t.Fatalf("loading fixtures: %v", err)
+        }
+    }
+    fake := fakemonitoring.New(series)
+    srv := httptest.NewServer(fake)
+    t.Cleanup(srv.Close)
+    return fake, srv.URL
+}
+
+// newFakeClient returns a Monitoring client sending every call to url.
+func newFakeClient(t testing.TB, url string) monitoring.MonitoringClient {
+    t.Helper()
+    client, err := monitoring.NewMonitoringClientWithConfigurationProvider(sharedTestProvider(t))
+    if err != nil {
+        t.Fatalf("creating Monitoring client: %v", err)
+    }
+    client.Host = url
+    return client
+}
+
+// newTestCollector returns a collector wired like main's with default flags,
+// its stores registered in the returned registry.
+func newTestCollector(t testing.TB) (*collector, *prometheus.Registry) {
+    t.Helper()
+    reg := prometheus.NewRegistry()
+    store := newSampleStore(valueMetricName, "OCI Monitoring metric value")
+    reg.MustRegister(store)
+    self := newSelfMetrics(reg, defaultSelfMetricsPrefix)
+    histograms := newHistogramStore("oci_metric_distribution", "Distribution of collected OCI Monitoring datapoint values for entries with buckets")
+    reg.MustRegister(histograms)
+    resolution := newSampleStore("oci_metric_resolution_seconds", "")
+    reg.MustRegister(resolution)
+    c := &collector{
+        store:             store,
+        tenancyInfo:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_tenancy_info"}, []string{"tenancy", "tenancy_id", "region", "compartment_id"}),
+        tenancyUp:         prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_tenancy_up"}, []string{"tenancy", "reason"}),
+        tenancyRemoved:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_tenancy_removed_timestamp_seconds"}, []string{"tenancy"}),
+        collecting:        prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "oci_namespace_collecting"}, []string{"tenancy", "namespace"}),
+        histograms:        histograms,
+        resolution:        resolution,
+        throttles:         newThrottleTracker(5*time.Minute, 0.1, self),
+        pacers:            newTenancyPacers(defaultQueryRate),
+        regions:           newRegionHealth(5*time.Minute, 0.5, 5*time.Minute, false, reg),
+        allowedDimensions: newDimensionAllowlist(""),
+        resolutions:       newResolutionDetector(),
+        resolutionChoices: newResolutionCache(),
+        budgets:           newSeriesBudgets(self),
+        lastErrors:        newEntryErrors(),
+        self:              self,
+    }
+    reg.MustRegister(c.tenancyInfo, c.tenancyUp, c.tenancyRemoved, c.collecting)
+    return c, reg
+}
+
+// testTenancy is a tenancy whose label is its name.
+func testTenancy(name string) Tenancy {
+    return Tenancy{
+        Name:          name,
+        Label:         name,
+        TenancyID:     "ocid1.tenancy.oc1..test",
+        CompartmentID: "ocid1.compartment.oc1..test",
+        Region:        "us-ashburn-1",
+    }
+}
+
+// findSamples returns the stored samples whose labels include match.
+func findSamples(s *sampleStore, match map[string]string) []snapshotSample {
+    var out []snapshotSample
+    for _, smp := range s.Snapshot() {
+        ok := true
+        for k, v := range match {
+            if smp.Labels[k] != v {
+                ok = false
+                break
+            }
+        }
+        if ok {
+            out = append(out, smp)
+        }
+    }
+    return out
+}
+
+// sampleValue returns the value of the one stored sample matching match.
+func sampleValue(t testing.TB, s *sampleStore, match map[string]string) float64 {
+    t.Helper()
+    found := findSamples(s, match)
+    if len(found) != 1 {
+        t.Fatalf("%d series match %v, want 1", len(found), match)
+    }
+    return found[0].Value
+}
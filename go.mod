@@ -1,9 +1,26 @@
-module  oci-prom-exporter-multitenant
+module oci-prom-exporter-multitenant
 
-go 1.21
+go 1.25.0
 
 require (
-    github.com/oracle/oci-go-sdk/v65 latest
-    github.com/prometheus/client_golang v1.16.0
-    gopkg.in/yaml.v3 v3.0.1
+	github.com/oracle/oci-go-sdk/v65 v65.126.0
+	github.com/prometheus/client_golang v1.16.0
+	github.com/prometheus/client_model v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gofrs/flock v0.10.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.10.1 // indirect
+	github.com/sony/gobreaker/v2 v2.4.0 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	golang.org/x/crypto v0.52.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
 )
@@ -0,0 +1,26 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// readyHandler serves /readyz. It answers 503 when more than threshold of the
+// configured tenancies are failing, so an orchestrator can take a broadly broken
+// instance out of rotation, and 200 otherwise.
+func readyHandler(manager *collectionManager, threshold float64) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        failing, total := manager.Failing()
+        ratio := 0.0
+        if total > 0 {
+            ratio = float64(failing) / float64(total)
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        if ratio > threshold {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            fmt.Fprintf(w, "not ready: %d of %d tenancies failing\n", failing, total)
+            return
+        }
+        fmt.Fprintf(w, "ready: %d of %d tenancies failing\n", failing, total)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// heartbeatPusher POSTs to a dead man's switch URL, such as a healthchecks.io
+// check, after fully successful cycles, at most once per interval. Delivery runs
+// in its own goroutine, so a slow or failing endpoint never delays collection.
+// A nil pusher does nothing.
+type heartbeatPusher struct {
+    url      string
+    interval time.Duration
+    client   *http.Client
+    failures prometheus.Counter
+
+    mu       sync.Mutex
+    lastPush time.Time
+    pushing  bool
+}
+
+func newHeartbeatPusher(url string, interval time.Duration, self *selfMetrics) *heartbeatPusher {
+    return &heartbeatPusher{
+        url:      url,
+        interval: interval,
+        client:   &http.Client{Timeout: 10 * time.Second},
+        failures: self.counterVec("heartbeat_push_failures_total", "Heartbeat POSTs to -heartbeat-url that failed or were not answered with 2xx.").WithLabelValues(),
+    }
+}
+
+// CycleDone is called after every tenancy cycle with whether it fully succeeded.
+func (h *heartbeatPusher) CycleDone(ok bool) {
+    if h == nil || !ok {
+        return
+    }
+    h.mu.Lock()
+    if h.pushing || time.Since(h.lastPush) < h.interval {
+        h.mu.Unlock()
+        return
+    }
+    h.pushing = true
+    h.mu.Unlock()
+    go h.push()
+}
+
+func (h *heartbeatPusher) push() {
+    resp, err := h.client.Post(h.url, "text/plain", nil)
+    if err == nil {
+        resp.Body.Close()
+        if resp.StatusCode/100 != 2 {
+            err = fmt.Errorf("unexpected status %s", resp.Status)
+        }
+    }
+    h.mu.Lock()
+    h.pushing = false
+    if err == nil {
+        h.lastPush = time.Now()
+    }
+    h.mu.Unlock()
+    if err != nil {
+        h.failures.Inc()
+        log.Printf("Heartbeat to %s failed: %v", h.url, err)
+    }
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "math"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// idleBackoff stretches the collection interval while nothing scrapes the
+// metrics endpoint, since data collected then is never read but still costs
+// API calls. The multiplier grows by one per threshold of idle time, up to
+// max, and drops back to 1 on the next scrape.
+type idleBackoff struct {
+    threshold time.Duration
+    max       float64
+
+    mu         sync.Mutex
+    lastScrape time.Time
+}
+
+func newIdleBackoff(threshold time.Duration, max float64, self *selfMetrics) *idleBackoff {
+    b := &idleBackoff{threshold: threshold, max: max, lastScrape: time.Now()}
+    self.gaugeFunc("seconds_since_last_scrape", "Seconds since the metrics endpoint was last scraped, or since startup.",
+        func() float64 { return time.Since(b.last()).Seconds() })
+    self.gaugeFunc("collection_interval_multiplier", "Factor -idle-backoff currently stretches the collection interval by; 1 while scraped.",
+        func() float64 { return b.Multiplier(time.Now()) })
+    return b
+}
+
+func (b *idleBackoff) last() time.Time {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.lastScrape
+}
+
+// Multiplier returns the current interval multiplier.
+func (b *idleBackoff) Multiplier(now time.Time) float64 {
+    idle := now.Sub(b.last())
+    if idle < b.threshold {
+        return 1
+    }
+    return math.Min(b.max, 1+math.Floor(idle.Seconds()/b.threshold.Seconds()))
+}
+
+// Skip reports whether a tick sinceLast after the previous cycle comes too
+// early under the current multiplier. Half an interval of slack absorbs
+// ticker jitter.
+func (b *idleBackoff) Skip(sinceLast, interval time.Duration) bool {
+    stretched := time.Duration(b.Multiplier(time.Now()) * float64(interval))
+    return sinceLast < stretched-interval/2
+}
+
+// Handler records a scrape for every request to next.
+func (b *idleBackoff) Handler(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b.mu.Lock()
+        b.lastScrape = time.Now()
+        b.mu.Unlock()
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,313 @@
+// Package fakemonitoring is an in-memory stand-in for the OCI Monitoring REST
+// API, enough of it to run the exporter end to end without credentials: it
+// serves SummarizeMetricsData and paginated ListMetrics from fixtures, checks
+// requests the way the service does, and can answer with 429s on demand.
+package fakemonitoring
+
+import (
+    "embed"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+//go:embed fixtures/*.json
+var fixtureFiles embed.FS
+
+// apiPrefix is the path prefix of the Monitoring API version the SDK uses.
+const apiPrefix = "/20180401/metrics/actions/"
+
+// Series is one fixture stream. Values are served as datapoints one
+// resolution apart ending at the request's endTime, the last value being the
+// latest. A stream with a Resolution, such as 5m, posts that often, so it is
+// left out of responses at finer resolutions; one without is served at every
+// resolution.
+type Series struct {
+    Namespace  string            `json:"namespace"`
+    Name       string            `json:"name"`
+    Dimensions map[string]string `json:"dimensions"`
+    Resolution string            `json:"resolution,omitempty"`
+    Values     []*float64        `json:"values"`
+}
+
+// Request is a SummarizeMetricsData request the server received.
+type Request struct {
+    CompartmentID string
+    InSubtree     bool
+    Namespace     string
+    Query         string
+    Start, End    time.Time
+}
+
+// ListRequest is a ListMetrics request the server received.
+type ListRequest struct {
+    CompartmentID string
+    InSubtree     bool
+    Namespace     string
+    Name          string
+}
+
+// Server is an http.Handler serving the fake API.
+type Server struct {
+    // PageSize is the ListMetrics page size when the request sets no limit.
+    PageSize int
+
+    mu       sync.Mutex
+    series   []Series
+    throttle int
+    requests []Request
+    listed   []ListRequest
+    nextID   int
+}
+
+// New returns a server serving series.
+func New(series []Series) *Server {
+    return &Server{PageSize: 2, series: series}
+}
+
+// DefaultFixtures returns the bundled fixtures, redacted payloads covering
+// compute, streaming and a stream without datapoints.
+func DefaultFixtures() ([]Series, error) {
+    entries, err := fixtureFiles.ReadDir("fixtures")
+    if err != nil {
+        return nil, err
+    }
+    var all []Series
+    for _, e := range entries {
+        data, err := fixtureFiles.ReadFile("fixtures/" + e.Name())
+        if err != nil {
+            return nil, err
+        }
+        var series []Series
+        if err := json.Unmarshal(data, &series); err != nil {
+            return nil, fmt.Errorf("fixture %s: %v", e.Name(), err)
+        }
+        all = append(all, series...)
+    }
+    return all, nil
+}
+
+// Throttle makes the next n SummarizeMetricsData requests fail with 429.
+func (s *Server) Throttle(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.throttle = n
+}
+
+// SetSeries replaces the served streams, e.g. to change one's resolution.
+func (s *Server) SetSeries(series []Series) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.series = series
+}
+
+// Requests returns the SummarizeMetricsData requests received so far.
+func (s *Server) Requests() []Request {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]Request(nil), s.requests...)
+}
+
+// ListRequests returns the ListMetrics requests received so far.
+func (s *Server) ListRequests() []ListRequest {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]ListRequest(nil), s.listed...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    s.mu.Lock()
+    s.nextID++
+    w.Header().Set("opc-request-id", fmt.Sprintf("fake-%06d", s.nextID))
+    s.mu.Unlock()
+
+    if r.Method != http.MethodPost {
+        writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST is supported")
+        return
+    }
+    switch r.URL.Path {
+    case apiPrefix + "summarizeMetricsData":
+        s.summarize(w, r)
+    case apiPrefix + "listMetrics":
+        s.list(w, r)
+    default:
+        writeError(w, http.StatusNotFound, "NotAuthorizedOrNotFound", "unknown operation "+r.URL.Path)
+    }
+}
+
+func (s *Server) summarize(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Namespace  string    `json:"namespace"`
+        Query      string    `json:"query"`
+        StartTime  time.Time `json:"startTime"`
+        EndTime    time.Time `json:"endTime"`
+        Resolution string    `json:"resolution"`
+    }
+    compartmentID := r.URL.Query().Get("compartmentId")
+    switch {
+    case compartmentID == "":
+        writeError(w, http.StatusBadRequest, "MissingParameter", "compartmentId is required")
+        return
+    case json.NewDecoder(r.Body).Decode(&body) != nil:
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "request body is not valid JSON")
+        return
+    case body.Namespace == "" || body.Query == "":
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "namespace and query are required")
+        return
+    case !body.EndTime.IsZero() && !body.StartTime.Before(body.EndTime):
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "startTime must be before endTime")
+        return
+    }
+    name, _, ok := strings.Cut(body.Query, "[")
+    if !ok || name == "" {
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "query must start with a metric name and an interval")
+        return
+    }
+    if body.Resolution == "" {
+        body.Resolution = "1m"
+    }
+    step, err := time.ParseDuration(body.Resolution)
+    if err != nil || step < time.Minute {
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "unsupported resolution "+body.Resolution)
+        return
+    }
+
+    s.mu.Lock()
+    inSubtree := r.URL.Query().Get("compartmentIdInSubtree") == "true"
+    s.requests = append(s.requests, Request{compartmentID, inSubtree, body.Namespace, body.Query, body.StartTime, body.EndTime})
+    throttled := s.throttle > 0
+    if throttled {
+        s.throttle--
+    }
+    series := s.series
+    s.mu.Unlock()
+    if throttled {
+        w.Header().Set("retry-after", "1")
+        writeError(w, http.StatusTooManyRequests, "TooManyRequests", "too many requests for the tenancy")
+        return
+    }
+
+    end := body.EndTime
+    if end.IsZero() {
+        end = time.Now().UTC()
+    }
+    end = end.Truncate(step)
+    type datapoint struct {
+        Timestamp time.Time `json:"timestamp"`
+        Value     *float64  `json:"value"`
+    }
+    type metricData struct {
+        Namespace            string            `json:"namespace"`
+        CompartmentID        string            `json:"compartmentId"`
+        Name                 string            `json:"name"`
+        Dimensions           map[string]string `json:"dimensions"`
+        Resolution           string            `json:"resolution"`
+        AggregatedDatapoints []datapoint       `json:"aggregatedDatapoints"`
+    }
+    out := []metricData{}
+    for _, ser := range series {
+        if ser.Namespace != body.Namespace || ser.Name != name {
+            continue
+        }
+        if posts, err := time.ParseDuration(ser.Resolution); err == nil && step < posts {
+            continue
+        }
+        md := metricData{
+            Namespace:            ser.Namespace,
+            CompartmentID:        compartmentID,
+            Name:                 ser.Name,
+            Dimensions:           ser.Dimensions,
+            Resolution:           body.Resolution,
+            AggregatedDatapoints: []datapoint{},
+        }
+        for i, v := range ser.Values {
+            at := end.Add(-time.Duration(len(ser.Values)-1-i) * step)
+            md.AggregatedDatapoints = append(md.AggregatedDatapoints, datapoint{at, v})
+        }
+        out = append(out, md)
+    }
+    writeJSON(w, out)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Namespace string `json:"namespace"`
+        Name      string `json:"name"`
+    }
+    q := r.URL.Query()
+    if q.Get("compartmentId") == "" {
+        writeError(w, http.StatusBadRequest, "MissingParameter", "compartmentId is required")
+        return
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "InvalidParameter", "request body is not valid JSON")
+        return
+    }
+    s.mu.Lock()
+    s.listed = append(s.listed, ListRequest{q.Get("compartmentId"), q.Get("compartmentIdInSubtree") == "true", body.Namespace, body.Name})
+    s.mu.Unlock()
+    limit := s.PageSize
+    if v := q.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            writeError(w, http.StatusBadRequest, "InvalidParameter", "limit must be a positive integer")
+            return
+        }
+        limit = n
+    }
+    offset := 0
+    if v := q.Get("page"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            writeError(w, http.StatusBadRequest, "InvalidParameter", "invalid page token")
+            return
+        }
+        offset = n
+    }
+
+    type metric struct {
+        Namespace     string            `json:"namespace"`
+        CompartmentID string            `json:"compartmentId"`
+        Name          string            `json:"name"`
+        Dimensions    map[string]string `json:"dimensions"`
+    }
+    var all []metric
+    s.mu.Lock()
+    for _, ser := range s.series {
+        if (body.Namespace == "" || ser.Namespace == body.Namespace) && (body.Name == "" || ser.Name == body.Name) {
+            all = append(all, metric{ser.Namespace, q.Get("compartmentId"), ser.Name, ser.Dimensions})
+        }
+    }
+    s.mu.Unlock()
+    if offset > len(all) {
+        offset = len(all)
+    }
+    page := all[offset:]
+    if len(page) > limit {
+        page = page[:limit]
+        w.Header().Set("opc-next-page", strconv.Itoa(offset+limit))
+    }
+    if page == nil {
+        page = []metric{}
+    }
+    writeJSON(w, page)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with the error body of OCI services.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(struct {
+        Code    string `json:"code"`
+        Message string `json:"message"`
+    }{code, message})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "log"
+    "net/http"
+    "time"
+)
+
+var landingTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+    "utc": func(t *time.Time) string {
+        if t == nil {
+            return "-"
+        }
+        return t.UTC().Format(time.RFC3339)
+    },
+    "until": func(t *time.Time, now time.Time) string {
+        if t == nil {
+            return "-"
+        }
+        if d := t.Sub(now); d > 0 {
+            return fmt.Sprintf("%.0f", d.Seconds())
+        }
+        return "due"
+    },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>OCI Exporter</title></head>
+<body>
+<h1>OCI Exporter</h1>
+<p>{{range $i, $l := .Links}}{{if $i}} | {{end}}<a href="{{$l.Path}}">{{$l.Title}}</a>{{end}}</p>
+{{if .Admin}}
+<h2>Tenancies</h2>
+<p>As of {{.Now.Format "2006-01-02T15:04:05Z07:00"}}, least healthy first. <a href="/?format=json">JSON</a></p>
+{{if .Tenancies}}
+<table border="1" cellpadding="4">
+<tr><th>Tenancy</th><th>Region</th><th>State</th><th>Entries</th><th>Last cycle finished</th><th>Duration (s)</th><th>Failing entries</th><th>Next cycle in (s)</th></tr>
+{{range .Tenancies}}
+<tr><td>{{.Tenancy}}</td><td>{{.Region}}</td><td>{{.State}}</td><td>{{.MetricEntries}}</td>
+{{if .LastCycle}}<td>{{utc .LastCycle.Finished}}</td><td>{{printf "%.3f" .LastCycle.DurationSeconds}}</td>{{else}}<td>-</td><td>-</td>{{end}}
+<td>{{len .LastErrors}}</td><td>{{until .NextRun $.Now}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No tenancies are configured.</p>
+{{end}}
+<h2>Namespace probes</h2>
+{{if .Probes}}
+<table border="1" cellpadding="4">
+<tr><th>Tenancy</th><th>Region</th><th>Namespace</th><th>Compartments</th><th>Status</th></tr>
+{{range .Probes}}
+<tr><td>{{.Tenancy}}</td><td>{{.Region}}</td><td>{{.Namespace}}</td><td>{{range $i, $id := .Compartments}}{{if $i}}, {{end}}{{$id}}{{end}}{{if .Subtree}} and subtrees{{end}}</td>
+<td>{{if .Err}}error: {{.Err}}{{else if .Found}}ok{{else}}no metrics published; check namespace and compartments{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No probes have completed yet.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// landingLink is a link on the index page.
+type landingLink struct {
+    Path  string `json:"path"`
+    Title string `json:"title"`
+}
+
+// landingHandler serves the index page of a listener. It links to metricsPath
+// unless it is empty and, if admin is set, to the ops endpoints, followed by the
+// tenancies, least healthy first, and the namespace probe findings. With
+// ?format=json it returns the same data as JSON.
+func landingHandler(prober *namespaceProber, manager *collectionManager, metricsPath string, admin bool) http.HandlerFunc {
+    var links []landingLink
+    if metricsPath != "" {
+        links = append(links, landingLink{metricsPath, "Metrics"})
+    }
+    if admin {
+        links = append(links, landingLink{"/debug/plan", "Query plan"}, landingLink{"/debug/errors", "Errors"}, landingLink{"/stats", "Stats"}, landingLink{"/readyz", "Readiness"})
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/" {
+            http.NotFound(w, r)
+            return
+        }
+        data := struct {
+            Now       time.Time        `json:"now"`
+            Links     []landingLink    `json:"links"`
+            Admin     bool             `json:"-"`
+            Tenancies []tenancyStats   `json:"tenancies,omitempty"`
+            Probes    []namespaceProbe `json:"probes,omitempty"`
+        }{Now: time.Now().UTC().Truncate(time.Second), Links: links, Admin: admin}
+        if admin {
+            data.Tenancies = manager.Stats()
+            sortStats(data.Tenancies)
+            data.Probes = prober.Results()
+        }
+        if r.URL.Query().Get("format") == "json" {
+            w.Header().Set("Content-Type", "application/json")
+            enc := json.NewEncoder(w)
+            enc.SetIndent("", "  ")
+            if err := enc.Encode(data); err != nil {
+                log.Printf("Writing landing page JSON: %v", err)
+            }
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        if err := landingTemplate.Execute(w, data); err != nil {
+            log.Printf("Rendering landing page: %v", err)
+        }
+    }
+}
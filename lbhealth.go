@@ -0,0 +1,93 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/loadbalancer"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// collectLBHealth exports oci_lb_backend_healthy for every backend of every active
+// load balancer in the tenancy's compartments. Backend health comes from the Load
+// Balancing API, one GetBackendSetHealth call per backend set; the Monitoring
+// namespace only has aggregate counts. client must be set to the tenancy's region.
+func (c *collector) collectLBHealth(ctx context.Context, client loadbalancer.LoadBalancerClient, ten Tenancy, compartments []string) {
+    for _, compartmentID := range compartments {
+        req := loadbalancer.ListLoadBalancersRequest{
+            CompartmentId:  common.String(compartmentID),
+            LifecycleState: loadbalancer.LoadBalancerLifecycleStateActive,
+        }
+        for {
+            resp, err := client.ListLoadBalancers(ctx, req)
+            c.self.apiCalls.WithLabelValues(ten.Label, "ListLoadBalancers").Inc()
+            if err != nil {
+                log.Printf("Error listing load balancers for tenancy %s (compartment %s): %v", ten.Name, compartmentID, err)
+                break
+            }
+            for _, lb := range resp.Items {
+                c.collectBackendSets(ctx, client, ten, lb)
+            }
+            if resp.OpcNextPage == nil || ctx.Err() != nil {
+                break
+            }
+            req.Page = resp.OpcNextPage
+        }
+    }
+}
+
+func (c *collector) collectBackendSets(ctx context.Context, client loadbalancer.LoadBalancerClient, ten Tenancy, lb loadbalancer.LoadBalancer) {
+    if lb.Id == nil {
+        return
+    }
+    lbName := *lb.Id
+    if lb.DisplayName != nil {
+        lbName = *lb.DisplayName
+    }
+    setNames := make([]string, 0, len(lb.BackendSets))
+    for name := range lb.BackendSets {
+        setNames = append(setNames, name)
+    }
+    sort.Strings(setNames)
+    for _, setName := range setNames {
+        if ctx.Err() != nil {
+            return
+        }
+        resp, err := client.GetBackendSetHealth(ctx, loadbalancer.GetBackendSetHealthRequest{
+            LoadBalancerId: lb.Id,
+            BackendSetName: common.String(setName),
+        })
+        c.self.apiCalls.WithLabelValues(ten.Label, "GetBackendSetHealth").Inc()
+        if err != nil {
+            log.Printf("Error reading health of backend set %s of load balancer %s for tenancy %s: %v", setName, lbName, ten.Name, err)
+            continue
+        }
+        unhealthy := make(map[string]bool)
+        for _, names := range [][]string{resp.WarningStateBackendNames, resp.CriticalStateBackendNames, resp.UnknownStateBackendNames} {
+            for _, name := range names {
+                unhealthy[name] = true
+            }
+        }
+        for _, backend := range lb.BackendSets[setName].Backends {
+            if backend.Name == nil {
+                continue
+            }
+            healthy := 1.0
+            if unhealthy[*backend.Name] {
+                healthy = 0
+            }
+            c.lbHealth.Set(prometheus.Labels{
+                "tenancy":          ten.Label,
+                "region":           ten.Region,
+                "load_balancer":    lbName,
+                "load_balancer_id": *lb.Id,
+                "backend_set":      setName,
+                "backend":          *backend.Name,
+            }, healthy)
+        }
+        sleepCtx(ctx, 100*time.Millisecond)
+    }
+}
@@ -4,182 +4,604 @@ import (
     "context"
     "flag"
     "fmt"
-    "io/ioutil"
     "log"
     "net/http"
     "os"
+    "os/signal"
     "strings"
+    "syscall"
     "time"
 
     "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/loadbalancer"
     "github.com/oracle/oci-go-sdk/v65/monitoring"
     "github.com/prometheus/client_golang/prometheus"
     "github.com/prometheus/client_golang/prometheus/promhttp"
     "gopkg.in/yaml.v3"
 )
 
-// Tenancy represents a single OCI tenancy configuration.
-type Tenancy struct {
-    Name          string `yaml:"name"`
-    TenancyID     string `yaml:"tenancy_id"`
-    CompartmentID string `yaml:"compartment_id"`
-    Region        string `yaml:"region"`
-}
-
-type TenancyConfig struct {
-    Tenancies []Tenancy `yaml:"tenancies"`
-}
-
-// MetricNamespace holds namespace and list of metric names, optional resource group and resolution.
-type MetricNamespace struct {
-    Namespace     string   `yaml:"namespace"`
-    Names         []string `yaml:"names"`
-    ResourceGroup string   `yaml:"resource_group,omitempty"`
-    Resolution    string   `yaml:"resolution,omitempty"`
-}
+// reservedPaths are the built-in endpoints -metrics-path and -self-metrics-path
+// must not take over. "/" is the landing page, which every listener serves.
+var reservedPaths = map[string]bool{"/": true, "/debug/plan": true, "/debug/errors": true, "/stats": true, "/readyz": true}
 
-type MetricConfig struct {
-    Metrics []MetricNamespace `yaml:"metrics"`
-}
+func main() {
+    cfgPath := flag.String("config", "", "Path to OCI config file, whose DEFAULT profile is used by tenancies without config_file or profile")
+    checkConfig := flag.Bool("check-config", false, "Validate tenants.yaml and metrics.yaml, then exit")
+    auditProfiles := flag.Bool("audit-profiles", false, "Query the metrics of every tenancy with an audit_profile once with its own credentials and once with the audit profile, print the queries whose streams differ, then exit")
+    explainArg := flag.String("explain", "", "Collect one metric of one tenancy once, print what became of every returned stream, then exit, e.g. \"tenancy=prod metric=CpuUtilization\"")
+    testEndpoint := flag.String("test-endpoint", "", "Developer use: send every Monitoring call to this URL, or to a built-in fake server with \"fake\", with throwaway credentials instead of -config")
+    listen := flag.String("listen-address", ":8080", "Metrics listen address")
+    adminListen := flag.String("admin-listen-address", "", "Serve the landing page, /debug/plan, /stats and /readyz on this address instead of -listen-address")
+    metricsPath := flag.String("metrics-path", "/metrics", "HTTP path to serve metrics on")
+    selfPrefix := flag.String("self-metrics-prefix", defaultSelfMetricsPrefix, "Prefix of the names of the exporter's own metrics")
+    selfPath := flag.String("self-metrics-path", "", "Serve the exporter's own metrics on this path, e.g. /metrics/self, instead of with the OCI metrics on -metrics-path")
+    dialTimeout := flag.Duration("dial-timeout", 30*time.Second, "Timeout for DNS resolution and TCP connect of Monitoring API calls (0 disables)")
+    tlsTimeout := flag.Duration("tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake of Monitoring API calls (0 disables)")
+    headerTimeout := flag.Duration("response-header-timeout", 0, "Timeout for the Monitoring API to start answering a sent request (0 disables)")
+    endOffset := flag.Duration("end-offset", 0, "Shift the query window end back from now by this duration to allow for OCI ingestion lag")
+    countResources := flag.Bool("count-resources", false, "Export oci_exporter_resources_total, the number of distinct resources reporting each metric")
+    maxSeries := flag.Int("max-exposition-series", 0, "Drop the lowest-priority metric entries from /metrics when it would exceed this many series (0 disables)")
+    throttleWindow := flag.Duration("throttle-window", 5*time.Minute, "Sliding window over which oci_exporter_throttle_ratio is computed")
+    throttleWarn := flag.Float64("throttle-warn-ratio", 0.1, "Log a warning when a tenancy's throttle ratio exceeds this value")
+    skipUnhealthy := flag.Bool("skip-unhealthy-regions", false, "Skip a tenancy's cycles for -region-cooldown when its region answers less than -region-health-threshold of requests")
+    regionWindow := flag.Duration("region-health-window", 5*time.Minute, "Sliding window over which oci_region_health is computed")
+    regionThreshold := flag.Float64("region-health-threshold", 0.5, "oci_region_health below which a region is unhealthy")
+    regionCooldown := flag.Duration("region-cooldown", 5*time.Minute, "How long an unhealthy region is skipped")
+    backoffMax := flag.Duration("query-backoff-max", time.Hour, "Longest delay between attempts of a query that keeps failing; the delay starts at 1m and doubles per failure (0 disables)")
+    wildcardRefresh := flag.Duration("wildcard-refresh-interval", time.Hour, "How often the metric list of a names: [\"*\"] entry is refreshed with ListMetrics, jittered by 25%")
+    wildcardEmpty := flag.Float64("wildcard-empty-ratio", 0.5, "Refresh a wildcard entry on the next cycle when more than this share of its queries return nothing")
+    autoProcs := flag.Bool("auto-gomaxprocs", false, "Set GOMAXPROCS from the cgroup CPU limit unless set in the environment")
+    autoMemLimit := flag.Bool("auto-gomemlimit", false, "Set GOMEMLIMIT to 90% of the cgroup memory limit unless set in the environment")
+    strictNames := flag.Bool("strict-tenancy-names", false, "Reject tenants.yaml when two tenancies have the same name, instead of suffixing the later ones with -2, -3, ... and warning")
+    strictRegion := flag.Bool("strict-region", false, "Reject tenants.yaml when a tenancy or compartment OCID points at another realm or region than the tenancy's region, instead of warning")
+    onClientError := flag.String("on-client-error", "fatal", "What to do when an OCI client cannot be created: fatal exits (fail fast), skip marks the affected tenancies down and retries with backoff")
+    readinessThreshold := flag.Float64("readiness-failure-threshold", 1, "Fail /readyz when more than this fraction of tenancies are failing (1 never fails)")
+    labelSource := flag.String("tenancy-label-source", labelSourceName, "Value of the tenancy label: name, ocid, or key (falls back to name)")
+    queryRate := flag.Float64("tenancy-query-rate", defaultQueryRate, "SummarizeMetricsData queries per second each tenancy loop sends at most (0 disables the pacing)")
+    interval := flag.Duration("collection-interval", time.Minute, "How often every tenancy loop collects its metrics")
+    metricWindow := flag.Duration("metric-window", queryWindow, "Span each query aggregates over, for entries without window, windows, resolutions or resolution: auto; whole minutes")
+    maxItems := flag.Int("max-response-items", 0, "Truncate SummarizeMetricsData responses with more series than this, counting them in oci_exporter_oversized_responses_total (0 disables)")
+    maxLabelLength := flag.Int("max-label-length", 0, "Truncate label values taken from dimensions to this many characters, ending them with \u2026 (0 disables)")
+    allowedDimensions := flag.String("allowed-label-dimensions", "", "Comma-separated dimension keys that custom, pack_dimensions and group_by entries may export as labels; others are dropped and logged (empty allows all)")
+    enableLBHealth := flag.Bool("enable-lb-health", false, "Export oci_lb_backend_healthy from the Load Balancing API for every load balancer backend")
+    snapshotPath := flag.String("snapshot-file", "", "Save the latest values here on shutdown and serve them on startup until fresh data arrives")
+    minConcurrency := flag.Int("min-query-concurrency", 1, "Lower bound of the adaptive query concurrency")
+    maxConcurrency := flag.Int("max-query-concurrency", 0, "Upper bound of the adaptive query concurrency, lowered on 429s and raised as they subside (0 disables the limit)")
+    heartbeatURL := flag.String("heartbeat-url", "", "POST here after fully successful cycles, as a dead man's switch")
+    heartbeatInterval := flag.Duration("heartbeat-interval", time.Minute, "Minimum time between heartbeat POSTs")
+    autoReload := flag.Duration("auto-reload-interval", 0, "Poll the YAML files under config/ this often and reload them as one set when they change (0 disables)")
+    reloadSettle := flag.Duration("reload-settle", 10*time.Second, "With -auto-reload-interval, how long the config files must stay unchanged before they are reloaded")
+    reloadMaxDelay := flag.Duration("reload-max-delay", 0, "With -auto-reload-interval, reload this long after the first change even if files are still changing, possibly applying a partially updated set (0 waits for the files to settle)")
+    collectionOrder := flag.String("collection-order", orderTenancy, "Order of each cycle's entries: tenancy (config order) or namespace (sorted by namespace, the same sequence in every tenancy); only a loop's first cycle puts high-priority entries first")
+    printPresets := flag.Bool("list-presets", false, "List the metric presets usable as preset: <name> in metrics entries and exit")
+    flag.BoolVar(&debugLogging, "debug", false, "Log debug messages, such as every returned stream that is not exported and why")
+    cycleSummary := flag.String("cycle-summary", summaryInfo, "Log one line per tenancy cycle with its requests, streams, errors and series changes: info, debug (only with -debug) or off")
+    prewarm := flag.Bool("prewarm-connections", false, "Open a connection to each region's Monitoring endpoint at startup, before the first cycle")
+    dropRemoved := flag.Bool("delete-removed-namespaces", true, "On reload, delete at once the series of namespaces a tenancy no longer collects, and after the next cycle those whose labels its entries no longer produce")
+    rootQuery := flag.Bool("root-query", false, "Query tenancies that discover their compartments once from the tenancy root with compartmentIdInSubtree, splitting series by compartment, instead of once per compartment")
+    scrapeOnRequest := flag.Bool("scrape-on-request", false, "Run a collection cycle of every tenancy on each scrape of -metrics-path instead of every -collection-interval; concurrent scrapes share one round")
+    scrapeTimeout := flag.Duration("scrape-timeout", 10*time.Second, "With -scrape-on-request, the longest a scrape waits for its round before serving the values stored so far")
+    idleAfter := flag.Duration("idle-backoff", 0, "Stretch the collection interval when the metrics endpoint has not been scraped for this long (0 disables)")
+    idleMax := flag.Float64("idle-backoff-max-multiplier", 10, "Largest factor -idle-backoff stretches the collection interval by")
+    dumpQueries := flag.String("dump-queries-file", "", "Rewrite this file after every cycle with each tenancy's queries of its last cycle and the items they returned, as JSON lines")
+    labelQueryHash := flag.Bool("label-query-hash", false, "Add a query_hash label to every series and export oci_query_info mapping hashes to their MQL query")
+    exportCoverage := flag.Bool("export-metric-coverage", false, "Export oci_metric_coverage for series whose response carries coverage metadata")
+    exportState := flag.Bool("export-metric-state", false, "Export oci_metric_state: 0 data present, 1 no datapoints, 2 latest datapoint without value")
+    alarmSuppression := flag.Bool("enable-alarm-suppression", false, "Export oci_alarm_suppression_* from the alarms in each tenancy's compartments")
+    activeCycles := flag.Int("active-resource-cycles", 0, "Drop the series of resources that reported no value in this many successful cycles of their tenancy (0 disables)")
+    costPerMillion := flag.Float64("estimated-cost-per-million-datapoints", 0, "Export oci_exporter_estimated_retrieval_cost_total at this price per million retrieved datapoints (0 disables)")
+    removalCycles := flag.Int("tenancy-removal-cycles", 5, "Keep the series of a tenancy removed from tenants.yaml for this many collection intervals, with oci_tenancy_up 0, before deleting them")
+    groupByTenancy := flag.Bool("group-by-tenancy", false, "Order the series of each metric in the exposition by tenancy, then namespace")
+    compatNames := flag.Bool("compat-metric-names", true, "Also export every value series under the compat_metric_names template of metrics.yaml, if set; false ends a migration")
+    consoleLinks := flag.Bool("console-links", false, "Export oci_resource_info with the OCI console URL of each resource")
+    flag.Parse()
 
-func loadConfigs() (TenancyConfig, MetricConfig) {
-    var tenants TenancyConfig
-    var metrics MetricConfig
+    if *printPresets {
+        if err := listPresets(os.Stdout); err != nil {
+            log.Fatalf("Listing presets: %v", err)
+        }
+        return
+    }
 
-    data, err := ioutil.ReadFile("config/tenants.yaml")
-    if err != nil {
-        log.Fatalf("Cannot read tenants.yaml: %v", err)
+    if *dialTimeout < 0 || *tlsTimeout < 0 || *headerTimeout < 0 {
+        fmt.Println("-dial-timeout, -tls-handshake-timeout and -response-header-timeout must not be negative")
+        os.Exit(1)
     }
-    if err := yaml.Unmarshal(data, &tenants); err != nil {
-        log.Fatalf("Invalid tenants.yaml: %v", err)
+    if *endOffset < 0 {
+        fmt.Println("-end-offset must not be negative")
+        os.Exit(1)
     }
-
-    data, err = ioutil.ReadFile("config/metrics.yaml")
-    if err != nil {
-        log.Fatalf("Cannot read metrics.yaml: %v", err)
+    if *costPerMillion < 0 {
+        fmt.Println("-estimated-cost-per-million-datapoints must not be negative")
+        os.Exit(1)
+    }
+    if *queryRate < 0 {
+        fmt.Println("-tenancy-query-rate must not be negative")
+        os.Exit(1)
+    }
+    if *removalCycles < 0 {
+        fmt.Println("-tenancy-removal-cycles must not be negative")
+        os.Exit(1)
+    }
+    if *autoReload < 0 || *reloadSettle < 0 || *reloadMaxDelay < 0 {
+        fmt.Println("-auto-reload-interval, -reload-settle and -reload-max-delay must not be negative")
+        os.Exit(1)
+    }
+    if *scrapeOnRequest && (*scrapeTimeout <= 0 || *idleAfter > 0) {
+        fmt.Println("-scrape-on-request needs a positive -scrape-timeout and cannot be combined with -idle-backoff")
+        os.Exit(1)
+    }
+    if *idleAfter < 0 || *idleMax < 1 {
+        fmt.Println("-idle-backoff must not be negative and -idle-backoff-max-multiplier must be at least 1")
+        os.Exit(1)
+    }
+    if *maxLabelLength < 0 {
+        fmt.Println("-max-label-length must not be negative")
+        os.Exit(1)
+    }
+    if *activeCycles < 0 {
+        fmt.Println("-active-resource-cycles must not be negative")
+        os.Exit(1)
+    }
+    if *wildcardRefresh <= 0 {
+        fmt.Println("-wildcard-refresh-interval must be positive")
+        os.Exit(1)
+    }
+    if *regionThreshold < 0 || *regionThreshold > 1 {
+        fmt.Println("-region-health-threshold must be between 0 and 1")
+        os.Exit(1)
+    }
+    if *readinessThreshold < 0 || *readinessThreshold > 1 {
+        fmt.Println("-readiness-failure-threshold must be between 0 and 1")
+        os.Exit(1)
+    }
+    if *collectionOrder != orderTenancy && *collectionOrder != orderNamespace {
+        fmt.Println("-collection-order must be tenancy or namespace")
+        os.Exit(1)
+    }
+    switch *labelSource {
+    case labelSourceName, labelSourceOCID, labelSourceKey:
+    default:
+        fmt.Println("-tenancy-label-source must be name, ocid or key")
+        os.Exit(1)
+    }
+    switch {
+    case !strings.HasPrefix(*metricsPath, "/"):
+        fmt.Println("-metrics-path must start with /")
+        os.Exit(1)
+    case reservedPaths[*metricsPath]:
+        fmt.Printf("-metrics-path %s collides with a built-in endpoint\n", *metricsPath)
+        os.Exit(1)
+    }
+    if !validSelfMetricsPrefix(*selfPrefix) {
+        fmt.Println("-self-metrics-prefix must be a valid metric name prefix, such as obs_oci_exporter_")
+        os.Exit(1)
+    }
+    switch {
+    case *selfPath == "":
+    case !strings.HasPrefix(*selfPath, "/"):
+        fmt.Println("-self-metrics-path must start with /")
+        os.Exit(1)
+    case reservedPaths[*selfPath] || *selfPath == *metricsPath:
+        fmt.Printf("-self-metrics-path %s collides with -metrics-path or a built-in endpoint\n", *selfPath)
+        os.Exit(1)
+    }
+    if *interval <= 0 {
+        fmt.Println("-collection-interval must be positive")
+        os.Exit(1)
+    }
+    if *metricWindow < time.Minute || *metricWindow%time.Minute != 0 {
+        fmt.Println("-metric-window must be a positive whole number of minutes")
+        os.Exit(1)
+    }
+    if *adminListen != "" && *adminListen == *listen {
+        fmt.Println("-admin-listen-address must differ from -listen-address")
+        os.Exit(1)
     }
-    if err := yaml.Unmarshal(data, &metrics); err != nil {
-        log.Fatalf("Invalid metrics.yaml: %v", err)
+    if *maxConcurrency > 0 && (*minConcurrency < 1 || *minConcurrency > *maxConcurrency) {
+        fmt.Println("-min-query-concurrency must be between 1 and -max-query-concurrency")
+        os.Exit(1)
     }
+    switch *cycleSummary {
+    case summaryInfo, summaryDebug, summaryOff:
+    default:
+        fmt.Println("-cycle-summary must be info, debug or off")
+        os.Exit(1)
+    }
+    if *onClientError != "fatal" && *onClientError != "skip" {
+        fmt.Println("-on-client-error must be fatal or skip")
+        os.Exit(1)
+    }
+    var explain explainTarget
+    if *explainArg != "" {
+        var err error
+        if explain, err = parseExplain(*explainArg); err != nil {
+            fmt.Printf("-explain: %v\n", err)
+            os.Exit(1)
+        }
+    }
+    applyContainerLimits(*autoProcs, *autoMemLimit)
 
-    return tenants, metrics
-}
+    if *checkConfig {
+        tenants, metricsCfg, err := loadConfigs(*labelSource)
+        if err == nil {
+            err = checkRegions(tenants, *strictRegion)
+        }
+        if err == nil {
+            err = checkTenancyNames(tenants, *strictNames)
+        }
+        if err != nil {
+            fmt.Printf("Config check failed: %v\n", err)
+            os.Exit(1)
+        }
+        out, err := yaml.Marshal(tenants)
+        if err != nil {
+            fmt.Printf("Config check failed: %v\n", err)
+            os.Exit(1)
+        }
+        for _, w := range configWarnings(tenants, metricsCfg) {
+            fmt.Printf("Warning: %s\n", w)
+        }
+        fmt.Printf("Config OK. Merged tenants.yaml:\n%s", out)
+        return
+    }
+    if *cfgPath == "" && *testEndpoint == "" {
+        fmt.Println("Missing required -config flag")
+        os.Exit(1)
+    }
 
-// summarizeWithRetry retries up to 3 times on HTTP 429 with exponential backoff.
-func summarizeWithRetry(client monitoring.MonitoringClient, req monitoring.SummarizeMetricsDataRequest) (monitoring.SummarizeMetricsDataResponse, error) {
-    var resp monitoring.SummarizeMetricsDataResponse
-    var err error
-    for attempt := 0; attempt < 3; attempt++ {
-        resp, err = client.SummarizeMetricsData(context.Background(), req)
-        if err == nil || !strings.Contains(err.Error(), "TooManyRequests") {
-            return resp, err
+    var testURL string
+    if *testEndpoint != "" {
+        var err error
+        if testURL, err = startTestEndpoint(*testEndpoint); err != nil {
+            log.Fatalf("Failed starting test endpoint: %v", err)
         }
-        backoff := time.Duration(1<<attempt) * time.Second
-        log.Printf("TooManyRequests, backing off %v", backoff)
-        time.Sleep(backoff)
+        log.Printf("WARNING: sending every Monitoring call to test endpoint %s", testURL)
+    } else {
+        warnInsecureKeyFiles(*cfgPath)
     }
-    return resp, err
-}
 
-// collectMetrics queries each metric and sets the gauge.
-func collectMetrics(client monitoring.MonitoringClient, tenants TenancyConfig, config MetricConfig, gauge *prometheus.GaugeVec) {
-    for _, ten := range tenants.Tenancies {
-        client.SetRegion(ten.Region)
-        now := time.Now().UTC()
-        start := common.SDKTime{Time: now.Add(-1 * time.Minute)}
-        end := common.SDKTime{Time: now}
-
-        for _, ns := range config.Metrics {
-            for _, name := range ns.Names {
-                query := fmt.Sprintf("%s[1m].mean()", name)
-                req := monitoring.SummarizeMetricsDataRequest{
-                    CompartmentId:          common.String(ten.CompartmentID),
-                    CompartmentIdInSubtree: common.Bool(true),
-                    SummarizeMetricsDataDetails: monitoring.SummarizeMetricsDataDetails{
-                        Namespace: common.String(ns.Namespace),
-                        Query:     common.String(query),
-                        StartTime: &start,
-                        EndTime:   &end,
-                    },
-                }
-                if ns.ResourceGroup != "" {
-                    req.SummarizeMetricsDataDetails.ResourceGroup = common.String(ns.ResourceGroup)
-                }
-                if ns.Resolution != "" {
-                    req.SummarizeMetricsDataDetails.Resolution = common.String(ns.Resolution)
-                }
-
-                resp, err := summarizeWithRetry(client, req)
-                if err != nil {
-                    log.Printf("Error querying %s in %s: %v", name, ns.Namespace, err)
-                } else {
-                    for _, item := range resp.Items {
-                        if len(item.AggregatedDatapoints) == 0 {
-                            continue
-                        }
-                        latest := item.AggregatedDatapoints[len(item.AggregatedDatapoints)-1]
-                        resID := item.Dimensions["resourceId"]
-                        dispName := item.Dimensions["resourceDisplayName"]
-                        metricLabel := name
-                        if item.Name != nil {
-                            metricLabel = *item.Name
-                        }
-
-                        gauge.With(prometheus.Labels{
-                            "tenancy":               ten.Name,
-                            "region":                ten.Region,
-                            "namespace":             ns.Namespace,
-                            "metric":                metricLabel,
-                            "resource_id":           resID,
-                            "resource_display_name": dispName,
-                        }).Set(*latest.Value)
-                    }
-                }
-                time.Sleep(100 * time.Millisecond)
+    // newProfileClients creates the OCI clients of an OCI config file and
+    // profile, both "" for -config. It runs again for skipped tenancies until
+    // it succeeds, so a fixed config or key file is picked up.
+    newProfileClients := func(configFile, profile string) (clients ociClients, err error) {
+        var provider common.ConfigurationProvider
+        source := "OCI config"
+        switch {
+        case testURL != "":
+            provider, err = testConfigProvider()
+        case configFile == "" && profile == "":
+            provider, err = common.ConfigurationProviderFromFile(*cfgPath, "")
+        default:
+            if configFile == "" {
+                configFile = *cfgPath
+            }
+            if profile == "" {
+                profile = "DEFAULT"
             }
+            source = fmt.Sprintf("OCI config %s profile %s", configFile, profile)
+            provider, err = common.ConfigurationProviderFromFileWithProfile(configFile, profile, "")
+        }
+        if err != nil {
+            err = fmt.Errorf("loading %s: %v", source, err)
+        } else if clients.monitoring, err = monitoring.NewMonitoringClientWithConfigurationProvider(provider); err != nil {
+            err = fmt.Errorf("creating Monitoring client from %s: %v", source, err)
+        } else if clients.identity, err = identity.NewIdentityClientWithConfigurationProvider(provider); err != nil {
+            err = fmt.Errorf("creating Identity client from %s: %v", source, err)
+        } else if *enableLBHealth {
+            if clients.loadBalancer, err = loadbalancer.NewLoadBalancerClientWithConfigurationProvider(provider); err != nil {
+                err = fmt.Errorf("creating Load Balancer client from %s: %v", source, err)
+            }
+        }
+        if err == nil {
+            clients.monitoring.HTTPClient = &http.Client{Transport: newTransport(*dialTimeout, *tlsTimeout, *headerTimeout)}
         }
+        return clients, err
+    }
+    newClients := func() (monitoring.MonitoringClient, identity.IdentityClient, loadbalancer.LoadBalancerClient, error) {
+        clients, err := newProfileClients("", "")
+        return clients.monitoring, clients.identity, clients.loadBalancer, err
+    }
+    client, identityClient, lbClient, clientErr := newClients()
+    if clientErr != nil {
+        if *onClientError == "fatal" {
+            log.Fatalf("Failed %v", clientErr)
+        }
+        log.Printf("Warning: failed %v; affected tenancies are skipped and retried", clientErr)
     }
-}
-
-func main() {
-    cfgPath := flag.String("config", "", "Path to OCI config file")
-    listen := flag.String("listen-address", ":8080", "Metrics listen address")
-    flag.Parse()
 
-    if *cfgPath == "" {
-        fmt.Println("Missing required -config flag")
-        os.Exit(1)
+    tenants, metricsCfg, err := loadConfigs(*labelSource)
+    if err == nil {
+        err = checkRegions(tenants, *strictRegion)
     }
-    provider, err := common.ConfigurationProviderFromFile(*cfgPath, "")
-    if err != nil {
-        log.Fatalf("Failed loading OCI config: %v", err)
+    if err == nil {
+        err = checkTenancyNames(tenants, *strictNames)
     }
-    client, err := monitoring.NewMonitoringClientWithConfigurationProvider(provider)
     if err != nil {
-        log.Fatalf("Failed creating Monitoring client: %v", err)
+        log.Fatalf("Failed loading config: %v", err)
+    }
+    logEffectiveMetrics(tenants, metricsCfg)
+    warnings := logConfigWarnings(tenants, metricsCfg)
+    if testURL == "" {
+        checked := map[string]bool{*cfgPath: true}
+        for _, ten := range tenants.Tenancies {
+            if ten.ConfigFile != "" && !checked[ten.ConfigFile] {
+                checked[ten.ConfigFile] = true
+                warnInsecureKeyFiles(ten.ConfigFile)
+            }
+        }
     }
-
-    tenants, metricsCfg := loadConfigs()
 
     // Create a custom registry exposing only OCI metrics
-    gauge := prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "oci_metric_value",
-            Help: "OCI Monitoring metric value",
-        },
-        []string{"tenancy", "region", "namespace", "metric", "resource_id", "resource_display_name"},
-    )
+    store := newSampleStore(valueMetricName, "OCI Monitoring metric value")
     registry := prometheus.NewRegistry()
-    registry.MustRegister(gauge)
+    registry.MustRegister(store)
+    if *snapshotPath != "" {
+        n, written, err := loadSnapshot(*snapshotPath, store)
+        if err != nil {
+            log.Printf("Warning: not restoring snapshot: %v", err)
+        } else if n > 0 {
+            log.Printf("Restored %d series from snapshot written %s", n, written.Format(time.RFC3339))
+        }
+    }
+
+    // Self-metrics are merged into the OCI metrics unless -self-metrics-path
+    // serves them on their own.
+    selfRegistry := registry
+    if *selfPath != "" {
+        selfRegistry = prometheus.NewRegistry()
+    }
+    self := newSelfMetrics(selfRegistry, *selfPrefix)
+    self.configWarnings.Set(float64(warnings))
+    if *countResources {
+        self.enableResourceCounts()
+    }
+    if *costPerMillion > 0 {
+        self.enableCostEstimate(*costPerMillion)
+    }
+
+    histograms := newHistogramStore("oci_metric_distribution", "Distribution of collected OCI Monitoring datapoint values for entries with buckets")
+    registry.MustRegister(histograms)
+
+    tenancyInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "oci_tenancy_info",
+        Help: "Configured OCI tenancy, value is always 1",
+    }, []string{"tenancy", "tenancy_id", "region", "compartment_id"})
+    registry.MustRegister(tenancyInfo)
+    tenancyUp := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "oci_tenancy_up",
+        Help: "1 if the tenancy is collected; 0 if its client could not be created (reason client_error) or after its removal until its series are deleted (reason removed)",
+    }, []string{"tenancy", "reason"})
+    tenancyRemoved := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "oci_tenancy_removed_timestamp_seconds",
+        Help: "Unix time the tenancy was removed from tenants.yaml, exported until its series are deleted",
+    }, []string{"tenancy"})
+    collecting := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "oci_namespace_collecting",
+        Help: "1 if the tenancy's last cycle stored at least one series of the namespace, 0 otherwise",
+    }, []string{"tenancy", "namespace"})
+    registry.MustRegister(tenancyUp, tenancyRemoved, collecting)
+
+    coll := &collector{
+        store:             store,
+        tenancyInfo:       tenancyInfo,
+        tenancyUp:         tenancyUp,
+        collecting:        collecting,
+        tenancyRemoved:    tenancyRemoved,
+        histograms:        histograms,
+        throttles:         newThrottleTracker(*throttleWindow, *throttleWarn, self),
+        pacers:            newTenancyPacers(*queryRate),
+        regions:           newRegionHealth(*regionWindow, *regionThreshold, *regionCooldown, *skipUnhealthy, registry),
+        endOffset:         *endOffset,
+        metricWindow:      *metricWindow,
+        maxItems:          *maxItems,
+        maxLabelLength:    *maxLabelLength,
+        allowedDimensions: newDimensionAllowlist(*allowedDimensions),
+        rootQuery:         *rootQuery,
+        resolutions:       newResolutionDetector(),
+        resolutionChoices: newResolutionCache(),
+        budgets:           newSeriesBudgets(self),
+        lastErrors:        newEntryErrors(),
+        self:              self,
+    }
+    if *consoleLinks {
+        coll.resourceInfo = newSampleStore("oci_resource_info", "OCI resource metadata, value is always 1")
+        registry.MustRegister(coll.resourceInfo)
+    }
+    var compatRegistry *prometheus.Registry
+    if *compatNames {
+        coll.compat = newSampleStore(valueMetricName, "OCI Monitoring metric value, under a compat_metric_names name")
+        // Gathered separately and merged by compatGuard, so a name clash
+        // quarantines the compat family instead of failing the scrape.
+        compatRegistry = prometheus.NewRegistry()
+        compatRegistry.MustRegister(coll.compat)
+    }
+    if *exportState {
+        coll.seriesState = newSampleStore("oci_metric_state", "State of the latest OCI datapoint of a series: 0 present, 1 no datapoints, 2 no value")
+        registry.MustRegister(coll.seriesState)
+    }
+    if *dumpQueries != "" {
+        coll.queryDump = newQueryDump(*dumpQueries)
+    }
+    if *labelQueryHash {
+        coll.queryInfo = newQueryInfo(registry)
+    }
+    coll.resolution = newSampleStore("oci_metric_resolution_seconds", "Resolution in seconds the latest OCI datapoint of a series was taken at, for entries with resolutions")
+    registry.MustRegister(coll.resolution)
+    if *exportCoverage {
+        coll.coverage = newSampleStore("oci_metric_coverage", "Share of the aggregation window covered by the latest OCI datapoint of a series, from 0 to 1")
+        registry.MustRegister(coll.coverage)
+    }
+    if *heartbeatURL != "" {
+        coll.heartbeat = newHeartbeatPusher(*heartbeatURL, *heartbeatInterval, self)
+    }
+    if *maxConcurrency > 0 {
+        coll.limiter = newAdaptiveLimiter(*minConcurrency, *maxConcurrency, self)
+    }
+    if *backoffMax > 0 {
+        coll.backoff = newQueryBackoff(*backoffMax)
+    }
+    if *activeCycles > 0 {
+        coll.active = newActiveSet(*activeCycles, self)
+    }
+    if *alarmSuppression {
+        coll.alarms = newAlarmSuppressions(registry)
+    }
+    if *enableLBHealth {
+        coll.lbHealth = newSampleStore("oci_lb_backend_healthy", "1 if the load balancer backend passes its health checks, 0 if it is in warning, critical or unknown state")
+        registry.MustRegister(coll.lbHealth)
+    }
+    clients := newRegionClients(client, clientErr)
+    clients.override = testURL
+    clients.newProfile = newProfileClients
+    clients.configPath = *cfgPath
+    if *prewarm {
+        // Apply sets the same endpoints, so the prewarmed hosts are the ones used.
+        clients.SetEndpoints(tenants.Endpoints)
+        prewarmConnections(context.Background(), clients, tenants.Tenancies)
+    }
+    if *auditProfiles {
+        clients.SetEndpoints(tenants.Endpoints)
+        n, err := runAudit(context.Background(), os.Stdout, clients, identityClient, tenants, metricsCfg, *endOffset, *metricWindow)
+        if err != nil {
+            fmt.Printf("-audit-profiles: %v\n", err)
+            os.Exit(1)
+        }
+        if n > 0 {
+            os.Exit(2)
+        }
+        return
+    }
+    if *explainArg != "" {
+        clients.SetEndpoints(tenants.Endpoints)
+        if err := runExplain(context.Background(), os.Stdout, coll, clients, identityClient, tenants, metricsCfg, explain); err != nil {
+            fmt.Printf("-explain: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+    manager := newCollectionManager(clients, identityClient, lbClient, coll, *interval)
+    manager.removalCycles = *removalCycles
+    manager.dropRemoved = *dropRemoved
+    manager.rebuildClients = newClients
+    manager.cycleSummary = *cycleSummary
+    manager.collectionOrder = *collectionOrder
+    manager.onDemand = *scrapeOnRequest
+    if *idleAfter > 0 {
+        manager.idle = newIdleBackoff(*idleAfter, *idleMax, self)
+    }
+    manager.wildcardRefresh, manager.wildcardEmptyRatio = *wildcardRefresh, *wildcardEmpty
+    manager.Apply(tenants, metricsCfg)
+    go manager.RunHeartbeat(context.Background())
+    go manager.RunClientRetry(context.Background())
+
+    prober := newNamespaceProber(clients, coll)
+    go prober.Run(context.Background(), tenants, metricsCfg)
+
+    valueFamily := func(name string) bool {
+        return name == valueMetricName || coll.compat != nil && coll.compat.HasName(name)
+    }
+    var base prometheus.Gatherer = registry
+    if compatRegistry != nil {
+        base = newCompatGuard(registry, compatRegistry, coll.compat, self)
+    }
+    var gatherer prometheus.Gatherer = newLimitingGatherer(base, *maxSeries, manager.allMetrics, valueFamily, self)
+    if *scrapeOnRequest {
+        gatherer = newScrapeGatherer(gatherer, manager, *scrapeTimeout, self)
+    }
+    if *groupByTenancy {
+        gatherer = tenancyOrder{inner: gatherer}
+    }
+    mux := http.NewServeMux()
+    var metricsHandler http.Handler = filteredHandler(gatherer, promhttp.HandlerOpts{}, self)
+    if manager.idle != nil {
+        metricsHandler = manager.idle.Handler(metricsHandler)
+    }
+    mux.Handle(*metricsPath, metricsHandler)
+    if *selfPath != "" {
+        mux.Handle(*selfPath, promhttp.HandlerFor(selfRegistry, promhttp.HandlerOpts{}))
+    }
+    adminMux := mux
+    servers := []*http.Server{{Addr: *listen, Handler: mux}}
+    if *adminListen != "" {
+        adminMux = http.NewServeMux()
+        mux.Handle("/", landingHandler(prober, manager, *metricsPath, false))
+        adminMux.Handle("/", landingHandler(prober, manager, "", true))
+        servers = append(servers, &http.Server{Addr: *adminListen, Handler: adminMux})
+    } else {
+        mux.Handle("/", landingHandler(prober, manager, *metricsPath, true))
+    }
+    adminMux.Handle("/debug/plan", planHandler(manager))
+    adminMux.Handle("/debug/errors", errorsHandler(coll.lastErrors))
+    adminMux.Handle("/stats", statsHandler(manager))
+    adminMux.Handle("/readyz", readyHandler(manager, *readinessThreshold))
+    for _, server := range servers {
+        go func(server *http.Server) {
+            log.Printf("Exporter listening on %s", server.Addr)
+            if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Fatal(err)
+            }
+        }(server)
+    }
+
+    // reload loads and validates tenants.yaml and metrics.yaml together and
+    // applies them in one step, or keeps the running config.
+    reload := func() {
+        tenants, metricsCfg, err := loadConfigs(*labelSource)
+        if err == nil {
+            err = checkRegions(tenants, *strictRegion)
+        }
+        if err == nil {
+            err = checkTenancyNames(tenants, *strictNames)
+        }
+        if err != nil {
+            log.Printf("Reload failed, keeping current config: %v", err)
+            return
+        }
+        logEffectiveMetrics(tenants, metricsCfg)
+        self.configWarnings.Set(float64(logConfigWarnings(tenants, metricsCfg)))
+        manager.Apply(tenants, metricsCfg)
+        go prober.Run(context.Background(), tenants, metricsCfg)
+        log.Printf("Reloaded config: %d tenancies, %d metric entries", len(tenants.Tenancies), len(metricsCfg.Metrics))
+    }
+    changes := make(chan []string)
+    if *autoReload > 0 {
+        watcher := &configWatcher{dir: "config", interval: *autoReload, settle: *reloadSettle, maxDelay: *reloadMaxDelay}
+        go watcher.Run(context.Background(), changes)
+    }
 
-    go func() {
-        for {
-            collectMetrics(client, tenants, metricsCfg, gauge)
-            time.Sleep(1 * time.Minute)
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+loop:
+    for {
+        select {
+        case files := <-changes:
+            log.Printf("Config files changed: %s", strings.Join(files, ", "))
+            reload()
+        case sig := <-signals:
+            if sig == syscall.SIGHUP {
+                reload()
+                continue
+            }
+            log.Printf("Received %v, shutting down", sig)
+            break loop
         }
-    }()
+    }
 
-    http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
-    log.Printf("Exporter listening on %s", *listen)
-    log.Fatal(http.ListenAndServe(*listen, nil))
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    manager.Stop()
+    if *snapshotPath != "" {
+        if n, err := writeSnapshot(*snapshotPath, store); err != nil {
+            log.Printf("Writing snapshot: %v", err)
+        } else {
+            log.Printf("Wrote %d series to snapshot %s", n, *snapshotPath)
+        }
+    }
+    for _, server := range servers {
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("HTTP shutdown of %s: %v", server.Addr, err)
+        }
+    }
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// defaultQueryRate is how many SummarizeMetricsData queries per second a
+// tenancy sends at most, which spreads them out under the Monitoring rate
+// limits.
+const defaultQueryRate = 10
+
+// tenancyPacers space each tenancy's queries at least interval apart, so every
+// tenancy is paced on its own, whatever the others send. A nil or zero-interval
+// pacer does not pace.
+type tenancyPacers struct {
+    interval time.Duration
+
+    mu sync.Mutex
+    // next is when each tenancy may send its next query.
+    next map[string]time.Time
+}
+
+// newTenancyPacers returns pacers allowing rate queries per second per
+// tenancy; 0 disables pacing.
+func newTenancyPacers(rate float64) *tenancyPacers {
+    p := &tenancyPacers{next: make(map[string]time.Time)}
+    if rate > 0 {
+        p.interval = time.Duration(float64(time.Second) / rate)
+    }
+    return p
+}
+
+// wait blocks until the tenancy may send its next query and reserves that
+// turn. It fails only when ctx is done.
+func (p *tenancyPacers) wait(ctx context.Context, tenancy string) error {
+    if p == nil || p.interval <= 0 {
+        return nil
+    }
+    p.mu.Lock()
+    now := time.Now()
+    at := p.next[tenancy]
+    if at.Before(now) {
+        at = now
+    }
+    p.next[tenancy] = at.Add(p.interval)
+    p.mu.Unlock()
+    if d := at.Sub(now); d > 0 && !sleepCtx(ctx, d) {
+        return ctx.Err()
+    }
+    return nil
+}
+
+// forget drops the pacing state of a tenancy whose loop stopped.
+func (p *tenancyPacers) forget(tenancy string) {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    delete(p.next, tenancy)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+)
+
+// plannedQuery is one resolved metric query and the compartments it is issued in.
+type plannedQuery struct {
+    Namespace     string   `json:"namespace"`
+    Metric        string   `json:"metric"`
+    Query         string   `json:"query"`
+    Resolution    string   `json:"resolution,omitempty"`
+    ResourceGroup string   `json:"resource_group,omitempty"`
+    Window        string   `json:"window"`
+    EndOffset     string   `json:"end_offset"`
+    Compartments  []string `json:"compartments"`
+    Subtree       bool     `json:"compartment_id_in_subtree"`
+    Requests      int      `json:"requests"`
+}
+
+// tenancyPlan is the effective query plan of one tenancy.
+type tenancyPlan struct {
+    Tenancy          string         `json:"tenancy"`
+    Region           string         `json:"region"`
+    NextRun          *time.Time     `json:"next_run,omitempty"`
+    Queries          []plannedQuery `json:"queries"`
+    RequestsPerCycle int            `json:"requests_per_cycle"`
+}
+
+// plan resolves the queries collectTenancy issues for ten, with the same defaults
+// and overrides applied. Metrics whose window is still to be detected show the default.
+func (c *collector) plan(ten Tenancy, compartments []string, metrics MetricConfig, nextRun time.Time) tenancyPlan {
+    plan := tenancyPlan{Tenancy: ten.Label, Region: ten.Region, Queries: []plannedQuery{}}
+    if !nextRun.IsZero() {
+        t := nextRun.UTC()
+        plan.NextRun = &t
+    }
+    var entries []MetricNamespace
+    for _, ns := range metrics.Metrics {
+        entries = append(entries, ns.perStatistic()...)
+    }
+    queryIn, keep := c.rootScope(ten, compartments)
+    for _, ns := range entries {
+        ns.rootQuery = keep != nil
+        ns = c.allowedDimensions.groupBy(ten, ns)
+        offset, _ := ns.endOffset(c.endOffset)
+        windows, _ := ns.queryWindows()
+        resolutions, _ := ns.queryResolutions()
+        for _, name := range ns.Names {
+            queryWindows := windows
+            if len(resolutions) > 0 {
+                // Every resolution is listed, though cycles skip those no
+                // stream needs.
+                queryWindows = resolutions
+            } else if len(queryWindows) == 0 {
+                window := c.entryWindow(ns)
+                if ns.Resolution == resolutionAuto {
+                    if w, ok := c.resolutions.cached(ns, name); ok {
+                        window = w
+                    }
+                }
+                queryWindows = []time.Duration{window}
+            }
+            for _, window := range queryWindows {
+                q := plannedQuery{
+                    Namespace:     ns.Namespace,
+                    Metric:        name,
+                    Query:         ns.query(ten, name, window),
+                    Resolution:    ns.requestResolution(window),
+                    ResourceGroup: ns.ResourceGroup,
+                    Window:        mqlInterval(window),
+                    EndOffset:     offset.String(),
+                    Compartments:  queryIn,
+                    Subtree:       inSubtree(ten, ns),
+                    Requests:      len(queryIn),
+                }
+                plan.Queries = append(plan.Queries, q)
+                plan.RequestsPerCycle += q.Requests
+            }
+        }
+    }
+    return plan
+}
+
+// planHandler serves GET /debug/plan: the resolved queries of every tenancy and
+// the number of requests each collection cycle makes.
+func planHandler(manager *collectionManager) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        plans := manager.Plan()
+        sort.Slice(plans, func(i, j int) bool { return plans[i].Tenancy < plans[j].Tenancy })
+        out := struct {
+            Tenancies        []tenancyPlan `json:"tenancies"`
+            RequestsPerCycle int           `json:"requests_per_cycle"`
+        }{Tenancies: plans}
+        for _, p := range plans {
+            out.RequestsPerCycle += p.RequestsPerCycle
+        }
+        w.Header().Set("Content-Type", "application/json")
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(out); err != nil {
+            log.Printf("Writing /debug/plan: %v", err)
+        }
+    }
+}
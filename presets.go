@@ -0,0 +1,96 @@
+package main
+
+import (
+    "embed"
+    "fmt"
+    "io"
+    "path"
+    "reflect"
+    "sort"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+//go:embed presets/*.yaml
+var presetFiles embed.FS
+
+// metricPreset is a curated metric entry shipped with the exporter, selected
+// with preset: <name> in a metrics entry.
+type metricPreset struct {
+    Name            string `yaml:"-"`
+    Description     string `yaml:"description"`
+    MetricNamespace `yaml:",inline"`
+}
+
+// loadPresets parses the embedded presets, keyed by file name without .yaml.
+func loadPresets() (map[string]metricPreset, error) {
+    files, err := presetFiles.ReadDir("presets")
+    if err != nil {
+        return nil, err
+    }
+    presets := make(map[string]metricPreset, len(files))
+    for _, f := range files {
+        data, err := presetFiles.ReadFile(path.Join("presets", f.Name()))
+        if err != nil {
+            return nil, err
+        }
+        var p metricPreset
+        if err := yaml.Unmarshal(data, &p); err != nil {
+            return nil, fmt.Errorf("preset %s: %v", f.Name(), err)
+        }
+        p.Name = strings.TrimSuffix(f.Name(), ".yaml")
+        presets[p.Name] = p
+    }
+    return presets, nil
+}
+
+// expandPreset fills every field the entry leaves unset from its preset, so
+// the fields written in metrics.yaml win. Entries without a preset are
+// returned unchanged.
+func expandPreset(ns MetricNamespace) (MetricNamespace, error) {
+    if ns.Preset == "" {
+        return ns, nil
+    }
+    presets, err := loadPresets()
+    if err != nil {
+        return ns, err
+    }
+    p, ok := presets[ns.Preset]
+    if !ok {
+        return ns, fmt.Errorf("unknown preset %q, see -list-presets", ns.Preset)
+    }
+    out := reflect.ValueOf(&ns).Elem()
+    from := reflect.ValueOf(p.MetricNamespace)
+    for i := 0; i < out.NumField(); i++ {
+        if f := out.Field(i); f.CanSet() && f.IsZero() {
+            f.Set(from.Field(i))
+        }
+    }
+    return ns, nil
+}
+
+// listPresets writes every preset with its namespace, description and metrics.
+func listPresets(w io.Writer) error {
+    presets, err := loadPresets()
+    if err != nil {
+        return err
+    }
+    names := make([]string, 0, len(presets))
+    for name := range presets {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        p := presets[name]
+        fmt.Fprintf(w, "%s (%s): %s\n", name, p.Namespace, p.Description)
+        fmt.Fprintf(w, "    names: %s\n", strings.Join(p.Names, ", "))
+        if len(p.Statistics) > 0 {
+            fmt.Fprintf(w, "    statistics: %s\n", strings.Join(p.Statistics, ", "))
+        }
+        if len(p.Windows) > 0 {
+            fmt.Fprintf(w, "    windows: %s\n", strings.Join(p.Windows, ", "))
+        }
+    }
+    return nil
+}
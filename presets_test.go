@@ -0,0 +1,169 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// mqlQuery matches a generated query: a metric name, an interval and one
+// statistic, e.g. CpuUtilization[1m].mean().
+var mqlQuery = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9]*)\[([0-9]+[mhd])\]\.([a-z]+)\(\)$`)
+
+func TestPresetsExpandToValidMQL(t *testing.T) {
+    presets, err := loadPresets()
+    if err != nil {
+        t.Fatalf("loadPresets: %v", err)
+    }
+    if len(presets) == 0 {
+        t.Fatal("no presets embedded")
+    }
+    for name := range presets {
+        t.Run(name, func(t *testing.T) {
+            ns, err := expandPreset(MetricNamespace{Preset: name})
+            if err != nil {
+                t.Fatalf("expandPreset: %v", err)
+            }
+            if ns.Namespace == "" || len(ns.Names) == 0 {
+                t.Fatalf("expanded to namespace %q with names %v", ns.Namespace, ns.Names)
+            }
+            if err := validateMetrics([]MetricNamespace{ns}); err != nil {
+                t.Fatalf("validateMetrics: %v", err)
+            }
+            windows, err := ns.queryWindows()
+            if err != nil {
+                t.Fatalf("queryWindows: %v", err)
+            }
+            if len(windows) == 0 {
+                windows = []time.Duration{time.Minute}
+            }
+            ten := testTenancy("acme")
+            for _, entry := range ns.perStatistic() {
+                for _, metric := range entry.Names {
+                    for _, window := range windows {
+                        q := entry.query(ten, metric, window)
+                        m := mqlQuery.FindStringSubmatch(q)
+                        switch {
+                        case m == nil:
+                            t.Errorf("query %q is not valid MQL", q)
+                        case m[1] != metric || m[2] != mqlInterval(window) || !statisticFuncs[m[3]]:
+                            t.Errorf("query %q does not select %s over %s", q, metric, mqlInterval(window))
+                        }
+                    }
+                }
+            }
+
+            // The fake rejects malformed queries like the service does.
+            fake, url := startFake(t, nil)
+            c, _ := newTestCollector(t)
+            stats, err := c.collectTenancy(context.Background(), newFakeClient(t, url), ten, []string{ten.CompartmentID}, MetricConfig{Metrics: []MetricNamespace{ns}})
+            if err != nil {
+                t.Fatalf("collectTenancy: %v", err)
+            }
+            if stats.failed[ns.Namespace] > 0 {
+                t.Errorf("%d queries failed: %v", stats.failed[ns.Namespace], stats.Errors)
+            }
+            if want := len(ns.Names) * len(ns.perStatistic()) * len(windows); len(fake.Requests()) != want {
+                t.Errorf("%d queries, want %d", len(fake.Requests()), want)
+            }
+        })
+    }
+}
+
+func TestPresetFieldsOverridden(t *testing.T) {
+    base, err := expandPreset(MetricNamespace{Preset: "compute-basic"})
+    if err != nil {
+        t.Fatalf("expandPreset: %v", err)
+    }
+    for _, tc := range []struct {
+        name  string
+        entry MetricNamespace
+        check func(ns MetricNamespace) error
+    }{
+        {
+            name:  "names",
+            entry: MetricNamespace{Preset: "compute-basic", Names: []string{"CpuUtilization"}},
+            check: func(ns MetricNamespace) error {
+                if !reflect.DeepEqual(ns.Names, []string{"CpuUtilization"}) || !reflect.DeepEqual(ns.Statistics, base.Statistics) {
+                    return fmt.Errorf("names %v, statistics %v", ns.Names, ns.Statistics)
+                }
+                return nil
+            },
+        },
+        {
+            name:  "statistics",
+            entry: MetricNamespace{Preset: "compute-basic", Statistics: []string{"min"}},
+            check: func(ns MetricNamespace) error {
+                if !reflect.DeepEqual(ns.Statistics, []string{"min"}) || !reflect.DeepEqual(ns.Names, base.Names) {
+                    return fmt.Errorf("names %v, statistics %v", ns.Names, ns.Statistics)
+                }
+                return nil
+            },
+        },
+        {
+            name:  "windows",
+            entry: MetricNamespace{Preset: "compute-basic", Windows: []string{"5m"}},
+            check: func(ns MetricNamespace) error {
+                if !reflect.DeepEqual(ns.Windows, []string{"5m"}) || ns.Namespace != base.Namespace {
+                    return fmt.Errorf("namespace %s, windows %v", ns.Namespace, ns.Windows)
+                }
+                return nil
+            },
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            ns, err := expandPreset(tc.entry)
+            if err != nil {
+                t.Fatalf("expandPreset: %v", err)
+            }
+            if err := tc.check(ns); err != nil {
+                t.Error(err)
+            }
+            if err := validateMetrics([]MetricNamespace{ns}); err != nil {
+                t.Errorf("validateMetrics: %v", err)
+            }
+        })
+    }
+
+    if _, err := expandPreset(MetricNamespace{Preset: "no-such-preset"}); err == nil || !strings.Contains(err.Error(), "-list-presets") {
+        t.Errorf("unknown preset: err = %v, want one pointing at -list-presets", err)
+    }
+}
+
+func TestPresetOverriddenInMetricsYAML(t *testing.T) {
+    inConfigDir(t, `tenancies:
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..aaa
+    compartment_id: ocid1.compartment.oc1..aaa
+    region: us-ashburn-1
+`, `metrics:
+  - preset: lbaas-golden-signals
+    statistics: [sum]
+  - preset: vcn-basic
+`)
+    _, metrics, err := loadConfigs(labelSourceName)
+    if err != nil {
+        t.Fatalf("loadConfigs: %v", err)
+    }
+    got := make(map[string][]string)
+    for _, ns := range metrics.Metrics {
+        got[ns.Namespace] = append(got[ns.Namespace], ns.Statistics...)
+    }
+    want := map[string][]string{"oci_lbaas": {"sum"}, "oci_vcn": {"sum"}}
+    for _, stats := range got {
+        sort.Strings(stats)
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("statistics by namespace %v, want %v", got, want)
+    }
+    for _, ns := range metrics.Metrics {
+        if ns.Namespace == "oci_lbaas" && !reflect.DeepEqual(ns.Windows, []string{"1m", "5m"}) {
+            t.Errorf("lbaas windows %v, want the preset's", ns.Windows)
+        }
+    }
+}
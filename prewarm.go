@@ -0,0 +1,66 @@
+package main
+
+import (
+    "context"
+    "io"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+)
+
+// prewarmTimeout bounds prewarming, so an unreachable endpoint delays the
+// first cycle by at most this long.
+const prewarmTimeout = 30 * time.Second
+
+// prewarmConnections sends a HEAD request to the Monitoring endpoint of every
+// region the tenancies use, so the shared transport holds an established TLS
+// connection to each before the first cycle. Any HTTP answer counts, since
+// only the connection matters; failures are logged and otherwise ignored.
+func prewarmConnections(ctx context.Context, clients *regionClients, tenants []Tenancy) {
+    hosts := make(map[string]common.HTTPRequestDispatcher)
+    for _, ten := range tenants {
+        client, err := clients.For(ten)
+        if err != nil || client.HTTPClient == nil {
+            return
+        }
+        hosts[client.Host] = client.HTTPClient
+    }
+    ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+    defer cancel()
+    start := time.Now()
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    warmed := 0
+    for host, dispatcher := range hosts {
+        wg.Add(1)
+        go func(host string, dispatcher common.HTTPRequestDispatcher) {
+            defer wg.Done()
+            url := host
+            if !strings.Contains(url, "://") {
+                url = "https://" + url
+            }
+            req, err := http.NewRequestWithContext(ctx, http.MethodHead, url+"/", nil)
+            if err != nil {
+                log.Printf("Prewarming %s: %v", host, err)
+                return
+            }
+            resp, err := dispatcher.Do(req)
+            if err != nil {
+                log.Printf("Prewarming %s: %v", host, err)
+                return
+            }
+            // Draining the body lets the transport keep the connection.
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+            mu.Lock()
+            warmed++
+            mu.Unlock()
+        }(host, dispatcher)
+    }
+    wg.Wait()
+    log.Printf("Prewarmed connections to %d of %d Monitoring endpoints in %s", warmed, len(hosts), time.Since(start).Round(time.Millisecond))
+}
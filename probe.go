@@ -0,0 +1,184 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+// namespaceProbe is the outcome of checking that a namespace publishes any metric
+// in a tenancy's query compartments.
+type namespaceProbe struct {
+    Tenancy      string    `json:"tenancy"`
+    Region       string    `json:"region"`
+    Namespace    string    `json:"namespace"`
+    Compartments []string  `json:"compartments"`
+    Subtree      bool      `json:"subtree"`
+    Found        bool      `json:"found"`
+    Err          string    `json:"error,omitempty"`
+    Checked      time.Time `json:"checked"`
+
+    // dimensions are the dimension keys of the metric the probe found.
+    dimensions map[string]bool
+}
+
+// namespaceProber issues one ListMetrics call per (tenancy, namespace) and query
+// compartment, until one finds a metric, to catch misspelled namespaces and
+// compartments that publish nothing. The calls hold a slot of the collector's
+// limiter and are counted with its api_calls_total. Results are cached, so a
+// reload only probes pairs it has not seen before.
+type namespaceProber struct {
+    clients   *regionClients
+    collector *collector
+
+    runMu   sync.Mutex // serializes Run between startup and reloads
+    mu      sync.Mutex
+    results map[string]namespaceProbe
+}
+
+func newNamespaceProber(clients *regionClients, c *collector) *namespaceProber {
+    return &namespaceProber{clients: clients, collector: c, results: make(map[string]namespaceProbe)}
+}
+
+// Run probes every configured (tenancy, namespace) pair that is not cached yet and
+// drops cached results for pairs no longer in the config. A namespace is probed
+// with the subtree setting of its first entry.
+func (p *namespaceProber) Run(ctx context.Context, tenants TenancyConfig, metrics MetricConfig) {
+    p.runMu.Lock()
+    defer p.runMu.Unlock()
+
+    wanted := make(map[string]bool)
+    for _, ten := range tenants.Tenancies {
+        client, err := p.clients.For(ten)
+        if err != nil {
+            continue
+        }
+        // Discovery alone has no compartments before the loop's first cycle.
+        queryIn, keep := p.collector.rootScope(ten, ten.queryCompartments(nil))
+        if len(queryIn) == 0 {
+            continue
+        }
+        for _, ns := range ten.metrics(metrics).Metrics {
+            ns.rootQuery = keep != nil
+            key := ten.Name + "\xff" + ten.Region + "\xff" + strings.Join(queryIn, ",") + "\xff" + ns.Namespace
+            if wanted[key] {
+                continue
+            }
+            wanted[key] = true
+            p.mu.Lock()
+            _, cached := p.results[key]
+            p.mu.Unlock()
+            if cached {
+                continue
+            }
+            if ctx.Err() != nil {
+                return
+            }
+            res := p.probeNamespace(ctx, client, ten, ns, queryIn)
+            warnUnknownGroupBy(ten, ten.metrics(metrics).Metrics, res)
+            p.mu.Lock()
+            p.results[key] = res
+            p.mu.Unlock()
+        }
+    }
+
+    p.mu.Lock()
+    for key := range p.results {
+        if !wanted[key] {
+            delete(p.results, key)
+        }
+    }
+    p.mu.Unlock()
+}
+
+func (p *namespaceProber) probeNamespace(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, ns MetricNamespace, compartments []string) namespaceProbe {
+    res := namespaceProbe{
+        Tenancy:      ten.Label,
+        Region:       ten.Region,
+        Namespace:    ns.Namespace,
+        Compartments: compartments,
+        Subtree:      inSubtree(ten, ns),
+        Checked:      time.Now().UTC(),
+    }
+    limiter := p.collector.limiter
+    calls := p.collector.self.apiCalls.WithLabelValues(ten.Label, "ListMetrics")
+    for _, compartmentID := range compartments {
+        if err := limiter.Acquire(ctx); err != nil {
+            res.Err = err.Error()
+            return res
+        }
+        calls.Inc()
+        resp, err := client.ListMetrics(ctx, monitoring.ListMetricsRequest{
+            CompartmentId:          common.String(compartmentID),
+            CompartmentIdInSubtree: common.Bool(res.Subtree),
+            Limit:                  common.Int(1),
+            ListMetricsDetails: monitoring.ListMetricsDetails{
+                Namespace: common.String(ns.Namespace),
+            },
+        })
+        limiter.Release(isThrottled(err))
+        if err != nil {
+            res.Err = err.Error()
+            log.Printf("Warning: probing namespace %s for tenancy %s failed: %v", ns.Namespace, ten.Name, err)
+            return res
+        }
+        if len(resp.Items) > 0 {
+            res.Found = true
+            res.dimensions = make(map[string]bool, len(resp.Items[0].Dimensions))
+            for key := range resp.Items[0].Dimensions {
+                res.dimensions[key] = true
+            }
+            return res
+        }
+    }
+    scope, hint := "including their subtrees", "the namespace name and the tenancy's compartments"
+    if !res.Subtree {
+        scope, hint = "without their subtrees", "the namespace name, the tenancy's compartments and compartment_id_in_subtree"
+    }
+    log.Printf("Warning: namespace %s publishes no metrics for tenancy %s in compartments %s (%s), queried %s; check %s",
+        ns.Namespace, ten.Name, strings.Join(compartments, ", "), ten.Region, scope, hint)
+    return res
+}
+
+// warnUnknownGroupBy logs the group_by keys of the probed namespace's entries
+// that the metric found by the probe does not have. Metrics of a namespace
+// usually share their dimensions, so a missing key is likely a typo, but only
+// one metric is sampled, hence a warning rather than an error.
+func warnUnknownGroupBy(ten Tenancy, entries []MetricNamespace, res namespaceProbe) {
+    if !res.Found {
+        return
+    }
+    for _, ns := range entries {
+        if ns.Namespace != res.Namespace {
+            continue
+        }
+        for _, key := range ns.GroupBy {
+            if !res.dimensions[key] {
+                log.Printf("Warning: group_by key %q of namespace %s is not a dimension of the metrics sampled for tenancy %s; check its spelling", key, ns.Namespace, ten.Name)
+            }
+        }
+    }
+}
+
+// Results returns the cached probe results ordered by tenancy and namespace.
+func (p *namespaceProber) Results() []namespaceProbe {
+    p.mu.Lock()
+    out := make([]namespaceProbe, 0, len(p.results))
+    for _, res := range p.results {
+        out = append(out, res)
+    }
+    p.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Tenancy != out[j].Tenancy {
+            return out[i].Tenancy < out[j].Tenancy
+        }
+        return out[i].Namespace < out[j].Namespace
+    })
+    return out
+}
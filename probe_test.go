@@ -0,0 +1,59 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeInCompartmentIDs(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    c.limiter = newAdaptiveLimiter(1, 1, c.self)
+    clients := newRegionClients(newFakeClient(t, ""), nil)
+    clients.override = url
+    p := newNamespaceProber(clients, c)
+    ten := testTenancy("acme")
+    ten.CompartmentID = ""
+    ten.CompartmentIDs = []string{"ocid1.compartment.oc1..a", "ocid1.compartment.oc1..b"}
+    ten.CompartmentIDInSubtree = new(bool)
+    metrics := MetricConfig{Metrics: []MetricNamespace{
+        {Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}},
+        {Namespace: "oci_nothing_here", Names: []string{"Nothing"}},
+    }}
+
+    p.Run(context.Background(), TenancyConfig{Tenancies: []Tenancy{ten}}, metrics)
+
+    found := make(map[string]bool)
+    for _, res := range p.Results() {
+        if res.Err != "" || res.Subtree || len(res.Compartments) != 2 {
+            t.Errorf("probe of %s = %+v, want both compartments without subtrees", res.Namespace, res)
+        }
+        found[res.Namespace] = res.Found
+    }
+    if !found["oci_computeagent"] || found["oci_nothing_here"] {
+        t.Errorf("found = %v, want only oci_computeagent", found)
+    }
+    // The first compartment answers for oci_computeagent; the other
+    // namespace is looked for in both.
+    var listed []string
+    for _, r := range fake.ListRequests() {
+        if r.InSubtree {
+            t.Errorf("listed %s with its subtree, want without", r.CompartmentID)
+        }
+        listed = append(listed, r.Namespace+" "+r.CompartmentID)
+    }
+    if len(listed) != 3 {
+        t.Errorf("ListMetrics requests %v, want 3", listed)
+    }
+    if got := testutil.ToFloat64(c.self.apiCalls.WithLabelValues("acme", "ListMetrics")); got != 3 {
+        t.Errorf("ListMetrics api_calls_total = %v, want 3", got)
+    }
+    c.limiter.mu.Lock()
+    inFlight := c.limiter.inFlight
+    c.limiter.mu.Unlock()
+    if inFlight != 0 {
+        t.Errorf("%d limiter slots still held", inFlight)
+    }
+}
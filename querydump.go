@@ -0,0 +1,87 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+// dumpedQuery is one SummarizeMetricsData request in the -dump-queries-file.
+type dumpedQuery struct {
+    Time          time.Time `json:"time"`
+    Tenancy       string    `json:"tenancy"`
+    CompartmentID string    `json:"compartment_id"`
+    Namespace     string    `json:"namespace"`
+    Query         string    `json:"query"`
+    Resolution    string    `json:"resolution,omitempty"`
+    Items         int       `json:"items"`
+    Error         string    `json:"error,omitempty"`
+}
+
+// queryDump keeps the queries of every tenancy's last cycle and rewrites the
+// dump file, one JSON object per line, whenever a cycle ends. The file only
+// ever holds one cycle per tenancy, so its size is bounded by the config.
+type queryDump struct {
+    path string
+
+    mu      sync.Mutex
+    queries map[string][]dumpedQuery
+}
+
+func newQueryDump(path string) *queryDump {
+    return &queryDump{path: path, queries: make(map[string][]dumpedQuery)}
+}
+
+// EndCycle replaces the tenancy's queries with those of its finished cycle.
+func (d *queryDump) EndCycle(tenancy string, queries []dumpedQuery) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.queries[tenancy] = queries
+    d.write()
+}
+
+// forget drops the queries of a removed tenancy.
+func (d *queryDump) forget(tenancy string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    delete(d.queries, tenancy)
+    d.write()
+}
+
+// write replaces the file with the queries of every tenancy, in tenancy order,
+// through a rename so readers never see a partial file. Callers must hold d.mu.
+func (d *queryDump) write() {
+    tenancies := make([]string, 0, len(d.queries))
+    for t := range d.queries {
+        tenancies = append(tenancies, t)
+    }
+    sort.Strings(tenancies)
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    for _, t := range tenancies {
+        for _, q := range d.queries[t] {
+            enc.Encode(q)
+        }
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp*")
+    if err != nil {
+        log.Printf("Writing %s: %v", d.path, err)
+        return
+    }
+    defer os.Remove(tmp.Name())
+    _, err = tmp.Write(buf.Bytes())
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), d.path)
+    }
+    if err != nil {
+        log.Printf("Writing %s: %v", d.path, err)
+    }
+}
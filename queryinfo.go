@@ -0,0 +1,104 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// queryHash returns the short, stable hash of an MQL query used as the
+// query_hash label.
+func queryHash(query string) string {
+    sum := sha256.Sum256([]byte(query))
+    return hex.EncodeToString(sum[:6])
+}
+
+// queryInfo exports oci_query_info, mapping every query_hash label to the query
+// it stands for. A query is kept while at least one tenancy issued it in its
+// last completed cycle, so queries of removed entries disappear after the next
+// cycle of each tenancy that had them.
+type queryInfo struct {
+    info *prometheus.GaugeVec
+
+    mu sync.Mutex
+    // labels holds the label values of every exported hash.
+    labels map[string][]string
+    // current and pending are, per tenancy, the hashes of its last completed
+    // cycle and of the running one.
+    current, pending map[string]map[string]bool
+}
+
+func newQueryInfo(reg prometheus.Registerer) *queryInfo {
+    q := &queryInfo{
+        info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "oci_query_info",
+            Help: "MQL query behind a query_hash label, value is always 1.",
+        }, []string{"query_hash", "namespace", "query", "statistic", "resolution"}),
+        labels:  make(map[string][]string),
+        current: make(map[string]map[string]bool),
+        pending: make(map[string]map[string]bool),
+    }
+    reg.MustRegister(q.info)
+    return q
+}
+
+// Observe records that the tenancy issued query and returns its hash.
+func (q *queryInfo) Observe(tenancy string, ns MetricNamespace, query, resolution string) string {
+    hash := queryHash(query)
+    statistic := ns.statistic
+    if statistic == "" {
+        statistic = queryStatistic(query)
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.pending[tenancy] == nil {
+        q.pending[tenancy] = make(map[string]bool)
+    }
+    q.pending[tenancy][hash] = true
+    if _, ok := q.labels[hash]; !ok {
+        values := []string{hash, ns.Namespace, query, statistic, resolution}
+        q.labels[hash] = values
+        q.info.WithLabelValues(values...).Set(1)
+    }
+    return hash
+}
+
+// EndCycle makes the hashes observed since the tenancy's previous cycle its
+// current set and drops the queries no tenancy issues any more.
+func (q *queryInfo) EndCycle(tenancy string) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.current[tenancy] = q.pending[tenancy]
+    delete(q.pending, tenancy)
+    q.prune()
+}
+
+// forget drops the hashes of a removed tenancy.
+func (q *queryInfo) forget(tenancy string) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    delete(q.current, tenancy)
+    delete(q.pending, tenancy)
+    q.prune()
+}
+
+// prune deletes the info series of hashes no tenancy refers to. Callers must hold q.mu.
+func (q *queryInfo) prune() {
+    for hash, values := range q.labels {
+        used := false
+        for _, sets := range []map[string]map[string]bool{q.current, q.pending} {
+            for _, hashes := range sets {
+                if hashes[hash] {
+                    used = true
+                    break
+                }
+            }
+        }
+        if !used {
+            q.info.DeleteLabelValues(values...)
+            delete(q.labels, hash)
+        }
+    }
+}
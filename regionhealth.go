@@ -0,0 +1,135 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// regionFailureClasses are the error classes that mean the region's endpoint did
+// not answer properly, as opposed to a request it rejected.
+var regionFailureClasses = map[string]bool{
+    "server": true, errorClassDNS: true, "network": true,
+    "timeout": true, "connect_timeout": true, "tls_timeout": true, "header_timeout": true,
+}
+
+// regionMinResults is how many results a window needs before a region can be
+// judged unhealthy.
+const regionMinResults = 5
+
+type regionResult struct {
+    at     time.Time
+    failed bool
+}
+
+// regionHealth keeps, per tenancy and region, the share of SummarizeMetricsData
+// requests the region answered over a sliding window. When skipping is enabled
+// for a tenancy, a region below the threshold at the end of a cycle is put in a
+// cooldown during which the tenancy's cycles are skipped.
+type regionHealth struct {
+    window    time.Duration
+    threshold float64
+    cooldown  time.Duration
+    // skip is the -skip-unhealthy-regions default for tenancies without an override.
+    skip bool
+
+    ratio *prometheus.GaugeVec
+
+    mu      sync.Mutex
+    results map[string][]regionResult
+    until   map[string]time.Time
+}
+
+func newRegionHealth(window time.Duration, threshold float64, cooldown time.Duration, skip bool, reg prometheus.Registerer) *regionHealth {
+    h := &regionHealth{
+        window:    window,
+        threshold: threshold,
+        cooldown:  cooldown,
+        skip:      skip,
+        ratio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "oci_region_health",
+            Help: "Share of the tenancy's Monitoring requests the region answered without a server, network or timeout error over the -region-health-window.",
+        }, []string{"tenancy", "region"}),
+        results: make(map[string][]regionResult),
+        until:   make(map[string]time.Time),
+    }
+    reg.MustRegister(h.ratio)
+    return h
+}
+
+func regionKey(ten Tenancy) string {
+    return ten.Label + "\xff" + ten.Region
+}
+
+// record adds the outcome of one request of the tenancy.
+func (h *regionHealth) record(ten Tenancy, err error, now time.Time) {
+    failed := err != nil && regionFailureClasses[errorClass(err)]
+    key := regionKey(ten)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    results := append(h.results[key], regionResult{at: now, failed: failed})
+    cutoff := now.Add(-h.window)
+    i := 0
+    for i < len(results) && results[i].at.Before(cutoff) {
+        i++
+    }
+    results = results[i:]
+    h.results[key] = results
+    h.ratio.WithLabelValues(ten.Label, ten.Region).Set(okRatio(results))
+}
+
+func okRatio(results []regionResult) float64 {
+    ok := 0
+    for _, r := range results {
+        if !r.failed {
+            ok++
+        }
+    }
+    return float64(ok) / float64(len(results))
+}
+
+// skips reports whether unhealthy regions are skipped for the tenancy.
+func (h *regionHealth) skips(ten Tenancy) bool {
+    if ten.SkipUnhealthyRegion != nil {
+        return *ten.SkipUnhealthyRegion
+    }
+    return h.skip
+}
+
+// EndCycle starts a cooldown if the tenancy skips unhealthy regions and its
+// region's ratio is below the threshold. The window is cleared so the first
+// cycle after the cooldown is judged on fresh results.
+func (h *regionHealth) EndCycle(ten Tenancy, now time.Time) {
+    if !h.skips(ten) {
+        return
+    }
+    key := regionKey(ten)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    results := h.results[key]
+    if len(results) < regionMinResults || okRatio(results) >= h.threshold {
+        return
+    }
+    h.until[key] = now.Add(h.cooldown)
+    delete(h.results, key)
+    log.Printf("WARNING: region %s is unhealthy for tenancy %s (%.0f%% of requests answered), skipping it for %v",
+        ten.Region, ten.Name, okRatio(results)*100, h.cooldown)
+}
+
+// Cooling reports whether the tenancy's region is in a cooldown.
+func (h *regionHealth) Cooling(ten Tenancy, now time.Time) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return now.Before(h.until[regionKey(ten)])
+}
+
+// forget drops the state and series of the tenancy.
+func (h *regionHealth) forget(ten Tenancy) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    delete(h.results, regionKey(ten))
+    delete(h.until, regionKey(ten))
+    h.ratio.DeleteLabelValues(ten.Label, ten.Region)
+}
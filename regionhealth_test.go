@@ -0,0 +1,51 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegionHealthCooldown(t *testing.T) {
+    off := false
+    for _, tc := range []struct {
+        name string
+        skip bool
+        // override is the tenancy's skip_unhealthy_region.
+        override *bool
+        errs     []error
+        cooling  bool
+    }{
+        {"unhealthy", true, nil, []error{context.DeadlineExceeded, context.DeadlineExceeded, context.DeadlineExceeded, nil, nil}, true},
+        {"healthy", true, nil, []error{context.DeadlineExceeded, context.DeadlineExceeded, nil, nil, nil}, false},
+        {"too few results", true, nil, []error{context.DeadlineExceeded, context.DeadlineExceeded}, false},
+        {"rejected requests", true, nil, []error{errors.New("bad query"), errors.New("bad query"), errors.New("bad query"), nil, nil}, false},
+        {"skipping disabled", false, nil, []error{context.DeadlineExceeded, context.DeadlineExceeded, context.DeadlineExceeded, nil, nil}, false},
+        {"disabled for the tenancy", true, &off, []error{context.DeadlineExceeded, context.DeadlineExceeded, context.DeadlineExceeded, nil, nil}, false},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            h := newRegionHealth(time.Minute, 0.5, time.Minute, tc.skip, prometheus.NewRegistry())
+            ten := testTenancy("acme")
+            ten.SkipUnhealthyRegion = tc.override
+            now := time.Now()
+            for _, err := range tc.errs {
+                h.record(ten, err, now)
+            }
+            h.EndCycle(ten, now)
+            if got := h.Cooling(ten, now.Add(30*time.Second)); got != tc.cooling {
+                t.Errorf("cooling = %v, want %v", got, tc.cooling)
+            }
+            if h.Cooling(ten, now.Add(2*time.Minute)) {
+                t.Error("still cooling after the cooldown")
+            }
+            h.forget(ten)
+            if n := testutil.CollectAndCount(h.ratio); n != 0 {
+                t.Errorf("%d oci_region_health series after forget, want 0", n)
+            }
+        })
+    }
+}
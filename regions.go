@@ -0,0 +1,287 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "reflect"
+    "strings"
+    "sync"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/loadbalancer"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+// normalizeRegion turns a region key or alias such as "phx" into its region
+// identifier ("us-phoenix-1") using the SDK's region table. Unknown values are
+// returned lower-cased.
+func normalizeRegion(region string) string {
+    return string(common.StringToRegion(strings.ToLower(region)))
+}
+
+// knownRegion reports whether region, already normalized, is in the SDK's region
+// table or in extra, the regions listed in tenants.yaml that the SDK predates.
+func knownRegion(region string, extra []string) bool {
+    if _, err := common.Region(region).RealmID(); err == nil {
+        return true
+    }
+    for _, r := range extra {
+        if normalizeRegion(r) == region {
+            return true
+        }
+    }
+    return false
+}
+
+// ociClients are the OCI clients created from one set of credentials.
+type ociClients struct {
+    monitoring   monitoring.MonitoringClient
+    identity     identity.IdentityClient
+    loadBalancer loadbalancer.LoadBalancerClient
+}
+
+// regionClients builds one Monitoring client per region from a base client.
+// The region is normalized first and the endpoint override for the normalized
+// region, if any, is applied after SetRegion, so the two compose. Tenancies
+// with their own config_file or profile get theirs from a base created for
+// those credentials.
+type regionClients struct {
+    base monitoring.MonitoringClient
+    // baseErr is why base could not be created, when -on-client-error=skip kept
+    // the exporter running, until a retry succeeds.
+    baseErr error
+    // override, when set, replaces the endpoint of every region (-test-endpoint).
+    override string
+    // newProfile, when set, creates the clients of a config file and profile.
+    newProfile func(configFile, profile string) (ociClients, error)
+    // configPath is -config, read by tenancies with a profile but no config_file.
+    configPath string
+
+    mu        sync.Mutex
+    endpoints map[string]string
+    clients   map[string]monitoring.MonitoringClient
+    // profiles caches the clients of each config file and profile that could
+    // be created; failures are tried again on the next call.
+    profiles map[string]ociClients
+    // stamps holds, per cached profile, the credentialStamp it was created at.
+    stamps map[string]string
+}
+
+func newRegionClients(base monitoring.MonitoringClient, baseErr error) *regionClients {
+    return &regionClients{
+        base:     base,
+        baseErr:  baseErr,
+        clients:  make(map[string]monitoring.MonitoringClient),
+        profiles: make(map[string]ociClients),
+        stamps:   make(map[string]string),
+    }
+}
+
+// SetEndpoints replaces the endpoint overrides, keyed by normalized region.
+// Cached clients are rebuilt if the overrides changed.
+func (r *regionClients) SetEndpoints(endpoints map[string]string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if reflect.DeepEqual(endpoints, r.endpoints) {
+        return
+    }
+    r.endpoints = endpoints
+    r.clients = make(map[string]monitoring.MonitoringClient)
+}
+
+// Err returns why the base client could not be created, or nil.
+func (r *regionClients) Err() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.baseErr
+}
+
+// SetBase replaces a base client that could not be created with one that could.
+func (r *regionClients) SetBase(base monitoring.MonitoringClient) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.base, r.baseErr = base, nil
+    r.clients = make(map[string]monitoring.MonitoringClient)
+}
+
+// Endpoint returns the override for region, or "" when the SDK default is used.
+func (r *regionClients) Endpoint(region string) string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.endpoints[normalizeRegion(region)]
+}
+
+// Get returns the client for region, or why it cannot be created. The returned
+// value is a copy, safe to use from one goroutine without affecting others.
+func (r *regionClients) Get(region string) (monitoring.MonitoringClient, error) {
+    region = normalizeRegion(region)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.baseErr != nil {
+        return monitoring.MonitoringClient{}, r.baseErr
+    }
+    return r.regional("", r.base, region), nil
+}
+
+// For returns the Monitoring client of the tenancy's region, created from its
+// own config_file and profile if it sets them and from the base otherwise.
+func (r *regionClients) For(ten Tenancy) (monitoring.MonitoringClient, error) {
+    key := ten.credentialKey()
+    if key == "" {
+        return r.Get(ten.Region)
+    }
+    region := normalizeRegion(ten.Region)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    set, err := r.profile(ten)
+    if err != nil {
+        return monitoring.MonitoringClient{}, err
+    }
+    return r.regional(key, set.monitoring, region), nil
+}
+
+// Profile returns the clients created for the tenancy's own config_file and
+// profile by an earlier successful For, or false if it uses the base.
+func (r *regionClients) Profile(ten Tenancy) (ociClients, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    set, ok := r.profiles[ten.credentialKey()]
+    return set, ok && ten.credentialKey() != ""
+}
+
+// profile returns the cached clients of the tenancy's credentials or creates
+// them. Callers must hold r.mu.
+func (r *regionClients) profile(ten Tenancy) (ociClients, error) {
+    key := ten.credentialKey()
+    if set, ok := r.profiles[key]; ok {
+        return set, nil
+    }
+    if r.newProfile == nil {
+        return ociClients{}, fmt.Errorf("config_file and profile are not supported here")
+    }
+    stamp := r.credentialStamp(ten)
+    set, err := r.newProfile(ten.ConfigFile, ten.Profile)
+    if err != nil {
+        return ociClients{}, err
+    }
+    r.profiles[key] = set
+    r.stamps[key] = stamp
+    return set, nil
+}
+
+// credentialStamp identifies the version on disk of the tenancy's config file
+// and the key and token files it references, by their sizes and modification
+// times.
+func (r *regionClients) credentialStamp(ten Tenancy) string {
+    cfg := ten.ConfigFile
+    if cfg == "" {
+        cfg = r.configPath
+    }
+    var b strings.Builder
+    for _, path := range credentialFiles(cfg) {
+        if info, err := os.Stat(path); err == nil {
+            fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+        } else {
+            fmt.Fprintf(&b, "%s missing\n", path)
+        }
+    }
+    return b.String()
+}
+
+// Refresh drops the cached clients of every config file and profile that no
+// tenancy uses any more, or whose files changed on disk since the clients were
+// created, so the next For creates them again. It returns the credential keys
+// of the tenancies whose clients were dropped.
+func (r *regionClients) Refresh(tenancies []Tenancy) map[string]bool {
+    used := make(map[string]Tenancy)
+    for _, ten := range tenancies {
+        if key := ten.credentialKey(); key != "" {
+            used[key] = ten
+        }
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    changed := make(map[string]bool)
+    for key := range r.profiles {
+        ten, ok := used[key]
+        if ok && r.credentialStamp(ten) == r.stamps[key] {
+            continue
+        }
+        if ok {
+            changed[key] = true
+        }
+        delete(r.profiles, key)
+        delete(r.stamps, key)
+        for cacheKey := range r.clients {
+            if strings.HasPrefix(cacheKey, key+"\xfe") {
+                delete(r.clients, cacheKey)
+            }
+        }
+    }
+    return changed
+}
+
+// regional returns the cached client of the credentials key and region, or
+// derives it from base. Callers must hold r.mu.
+func (r *regionClients) regional(key string, base monitoring.MonitoringClient, region string) monitoring.MonitoringClient {
+    cacheKey := key + "\xfe" + region
+    if c, ok := r.clients[cacheKey]; ok {
+        return c
+    }
+    c := base
+    c.SetRegion(region)
+    if ep := r.endpoints[region]; ep != "" {
+        c.Host = ep
+    }
+    if r.override != "" {
+        c.Host = r.override
+    }
+    r.clients[cacheKey] = c
+    return c
+}
+
+// ocidRegionHint returns the realm and region parts of an OCID of the form
+// ocid1.<type>.<realm>.[region].<id>; region is "" for global resources such
+// as tenancies and compartments.
+func ocidRegionHint(ocid string) (realm, region string, ok bool) {
+    parts := strings.Split(ocid, ".")
+    if len(parts) < 5 || parts[0] != "ocid1" {
+        return "", "", false
+    }
+    return parts[2], parts[3], true
+}
+
+// checkOCIDRegions returns a problem for every tenancy whose tenancy or
+// compartment OCIDs belong to another realm or carry a region hint other than
+// the tenancy's region, a copy-paste mistake that otherwise only shows as
+// empty results.
+func checkOCIDRegions(tenants TenancyConfig) []string {
+    var problems []string
+    for _, ten := range tenants.Tenancies {
+        region := normalizeRegion(ten.Region)
+        wantRealm, realmErr := common.Region(region).RealmID()
+        ocids := append([]string{ten.TenancyID, ten.CompartmentID}, ten.CompartmentIDs...)
+        for _, ocid := range ocids {
+            realm, hint, ok := ocidRegionHint(ocid)
+            if !ok {
+                continue
+            }
+            if realmErr == nil && realm != wantRealm {
+                problems = append(problems, fmt.Sprintf("tenancy %s: %s is in realm %s, but region %s is in realm %s", ten.Name, ocid, realm, region, wantRealm))
+            } else if hint != "" && normalizeRegion(hint) != region {
+                problems = append(problems, fmt.Sprintf("tenancy %s: %s names region %s, but the tenancy's region is %s", ten.Name, ocid, hint, region))
+            }
+        }
+    }
+    return problems
+}
+
+// checkRegions returns the problems checkOCIDRegions finds as an error with
+// strict; otherwise they are config warnings, see configWarnings.
+func checkRegions(tenants TenancyConfig, strict bool) error {
+    if problems := checkOCIDRegions(tenants); strict && len(problems) > 0 {
+        return fmt.Errorf("invalid tenants.yaml (-strict-region): %s", strings.Join(problems, "; "))
+    }
+    return nil
+}
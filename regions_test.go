@@ -0,0 +1,212 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestNormalizeRegion(t *testing.T) {
+    for in, want := range map[string]string{
+        "phx":          "us-phoenix-1",
+        "PHX":          "us-phoenix-1",
+        "us-ashburn-1": "us-ashburn-1",
+        "iad":          "us-ashburn-1",
+        "xx-Nowhere-1": "xx-nowhere-1",
+    } {
+        if got := normalizeRegion(in); got != want {
+            t.Errorf("normalizeRegion(%q) = %q, want %q", in, got, want)
+        }
+    }
+}
+
+func TestRegionClientsEndpoint(t *testing.T) {
+    const custom = "https://telemetry.example.internal"
+    for _, tc := range []struct {
+        name      string
+        region    string
+        endpoints map[string]string
+        override  string
+        // host is the expected Host, or a substring of the SDK default.
+        host    string
+        exact   bool
+        reports string
+    }{
+        {name: "region key with custom endpoint", region: "phx", endpoints: map[string]string{"us-phoenix-1": custom}, host: custom, exact: true, reports: custom},
+        {name: "region identifier with custom endpoint", region: "us-phoenix-1", endpoints: map[string]string{"us-phoenix-1": custom}, host: custom, exact: true, reports: custom},
+        {name: "region key without endpoint", region: "phx", host: "us-phoenix-1"},
+        {name: "endpoint of another region", region: "phx", endpoints: map[string]string{"us-ashburn-1": custom}, host: "us-phoenix-1"},
+        {name: "test endpoint wins", region: "phx", endpoints: map[string]string{"us-phoenix-1": custom}, override: "http://127.0.0.1:1", host: "http://127.0.0.1:1", exact: true, reports: custom},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            clients := newRegionClients(newFakeClient(t, ""), nil)
+            clients.override = tc.override
+            clients.SetEndpoints(tc.endpoints)
+            ten := testTenancy("acme")
+            ten.Region = tc.region
+
+            client, err := clients.For(ten)
+            if err != nil {
+                t.Fatalf("For: %v", err)
+            }
+            if tc.exact && client.Host != tc.host || !tc.exact && (!strings.Contains(client.Host, tc.host) || client.Host == custom) {
+                t.Errorf("Host = %q, want %q", client.Host, tc.host)
+            }
+            if got := clients.Endpoint(tc.region); got != tc.reports {
+                t.Errorf("Endpoint(%q) = %q, want %q", tc.region, got, tc.reports)
+            }
+        })
+    }
+}
+
+func TestEndpointKeysNormalizedAtLoad(t *testing.T) {
+    inConfigDir(t, `endpoints:
+  phx: https://telemetry.example.internal
+  xx-nowhere-1: https://telemetry.nowhere.example
+tenancies:
+  - name: prod
+    tenancy_id: ocid1.tenancy.oc1..aaa
+    compartment_id: ocid1.compartment.oc1..aaa
+    region: PHX
+  - name: lab
+    tenancy_id: ocid1.tenancy.oc1..bbb
+    compartment_id: ocid1.compartment.oc1..bbb
+    region: xx-nowhere-1
+`, testMetricsYAML)
+
+    tenants, _, err := loadConfigs(labelSourceName)
+    if err != nil {
+        t.Fatalf("loadConfigs: %v", err)
+    }
+    if got := tenants.Endpoints["us-phoenix-1"]; got != "https://telemetry.example.internal" {
+        t.Errorf("endpoint of us-phoenix-1 = %q, want the one keyed phx", got)
+    }
+    if tenants.Tenancies[0].Region != "us-phoenix-1" {
+        t.Errorf("region = %q, want us-phoenix-1", tenants.Tenancies[0].Region)
+    }
+
+    clients := newRegionClients(newFakeClient(t, ""), nil)
+    clients.SetEndpoints(tenants.Endpoints)
+    for _, ten := range tenants.Tenancies {
+        client, err := clients.For(ten)
+        if err != nil {
+            t.Fatalf("For(%s): %v", ten.Name, err)
+        }
+        if want := tenants.Endpoints[ten.Region]; client.Host != want {
+            t.Errorf("%s Host = %q, want %q", ten.Name, client.Host, want)
+        }
+    }
+}
+
+func TestUnknownRegionWithoutEndpointRejected(t *testing.T) {
+    inConfigDir(t, `tenancies:
+  - name: lab
+    tenancy_id: ocid1.tenancy.oc1..bbb
+    compartment_id: ocid1.compartment.oc1..bbb
+    region: xx-nowhere-1
+`, testMetricsYAML)
+    if _, _, err := loadConfigs(labelSourceName); err == nil || !strings.Contains(err.Error(), "unknown region") {
+        t.Errorf("loadConfigs = %v, want the unknown region", err)
+    }
+}
+
+func TestRefreshRecreatesChangedProfiles(t *testing.T) {
+    dir := t.TempDir()
+    keyFile := filepath.Join(dir, "key.pem")
+    cfgFile := filepath.Join(dir, "team-a.config")
+    for path, content := range map[string]string{
+        keyFile: "key",
+        cfgFile: "[DEFAULT]\nkey_file=" + keyFile + "\n",
+    } {
+        if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    clients := newRegionClients(newFakeClient(t, ""), nil)
+    created := 0
+    clients.newProfile = func(configFile, profile string) (ociClients, error) {
+        created++
+        return ociClients{monitoring: newFakeClient(t, "")}, nil
+    }
+    ten := testTenancy("team-a")
+    ten.ConfigFile = cfgFile
+    other := testTenancy("team-b")
+    other.ConfigFile, other.Profile = cfgFile, "TEAM_B"
+    use := func(tenancies ...Tenancy) {
+        t.Helper()
+        for _, ten := range tenancies {
+            if _, err := clients.For(ten); err != nil {
+                t.Fatalf("For(%s): %v", ten.Name, err)
+            }
+        }
+    }
+
+    use(ten, other)
+    if changed := clients.Refresh([]Tenancy{ten, other}); len(changed) != 0 {
+        t.Errorf("unchanged files: Refresh = %v, want nothing", changed)
+    }
+    use(ten, other)
+    if created != 2 {
+        t.Fatalf("created %d profiles, want 2 while the files are unchanged", created)
+    }
+
+    // A rotated key changes the key file's modification time.
+    later := time.Now().Add(time.Hour)
+    if err := os.Chtimes(keyFile, later, later); err != nil {
+        t.Fatal(err)
+    }
+    changed := clients.Refresh([]Tenancy{ten, other})
+    if !changed[ten.credentialKey()] || !changed[other.credentialKey()] {
+        t.Errorf("after the key changed: Refresh = %v, want both profiles", changed)
+    }
+    use(ten, other)
+    if created != 4 {
+        t.Errorf("created %d profiles, want 4 after the key changed", created)
+    }
+
+    // A profile no tenancy uses is dropped without being reported.
+    if changed := clients.Refresh([]Tenancy{ten}); len(changed) != 0 {
+        t.Errorf("after team-b left: Refresh = %v, want nothing", changed)
+    }
+    if _, ok := clients.Profile(other); ok {
+        t.Error("team-b's profile is still cached")
+    }
+}
+
+func TestApplyRestartsLoopsOnCredentialChange(t *testing.T) {
+    _, url := startFake(t, nil)
+    cfgFile := filepath.Join(t.TempDir(), "team-a.config")
+    if err := os.WriteFile(cfgFile, []byte("[DEFAULT]\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    c, _ := newTestCollector(t)
+    m := newTestManager(t, c, time.Minute)
+    m.clients.newProfile = func(configFile, profile string) (ociClients, error) {
+        return ociClients{monitoring: newFakeClient(t, url)}, nil
+    }
+    ten := testTenancy("team-a")
+    ten.ConfigFile = cfgFile
+    tenants := TenancyConfig{Tenancies: []Tenancy{ten}, Endpoints: map[string]string{"us-ashburn-1": url}}
+    loop := func() *tenancyLoop {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        return m.loops["team-a"]
+    }
+
+    m.Apply(tenants, cpuConfig)
+    first := loop()
+    m.Apply(tenants, cpuConfig)
+    if loop() != first {
+        t.Error("reload without changes restarted the loop")
+    }
+    later := time.Now().Add(time.Hour)
+    if err := os.Chtimes(cfgFile, later, later); err != nil {
+        t.Fatal(err)
+    }
+    m.Apply(tenants, cpuConfig)
+    if loop() == first || loop() == nil {
+        t.Error("reload after the config file changed kept the loop")
+    }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "context"
+    "io/fs"
+    "log"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// fileState is what configWatcher compares between polls.
+type fileState struct {
+    size    int64
+    modTime time.Time
+}
+
+// configWatcher polls the YAML files under a directory and reports a change
+// once the whole set has settled, so a deploy that writes several files a few
+// seconds apart is reloaded once, as one set, instead of once per file.
+type configWatcher struct {
+    dir      string
+    interval time.Duration
+    // settle is how long the files must stay unchanged before a reload.
+    settle time.Duration
+    // maxDelay, when positive, forces a reload this long after the first change
+    // even if the files are still changing, at the risk of a partial set.
+    maxDelay time.Duration
+}
+
+// Run sends the changed paths on changes every time the set settles, until ctx
+// is done. The caller validates and applies the new set as a whole.
+func (w *configWatcher) Run(ctx context.Context, changes chan<- []string) {
+    applied := w.scan()
+    current := applied
+    var firstChange, lastChange time.Time
+    ticker := time.NewTicker(w.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        now := time.Now()
+        next := w.scan()
+        if !sameFiles(next, current) {
+            if firstChange.IsZero() {
+                firstChange = now
+            }
+            lastChange = now
+            current = next
+        }
+        if firstChange.IsZero() {
+            continue
+        }
+        settled := now.Sub(lastChange) >= w.settle
+        overdue := w.maxDelay > 0 && now.Sub(firstChange) >= w.maxDelay
+        if !settled && !overdue {
+            continue
+        }
+        if !settled {
+            log.Printf("Config files still changing %s after the first change, reloading anyway (-reload-max-delay)", now.Sub(firstChange).Round(time.Second))
+        }
+        changed := changedFiles(applied, current)
+        applied, firstChange = current, time.Time{}
+        if len(changed) == 0 {
+            // Changed and changed back.
+            continue
+        }
+        select {
+        case changes <- changed:
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// scan returns the state of every .yaml and .yml file under w.dir. Files that
+// cannot be read are left out, which shows as a removal.
+func (w *configWatcher) scan() map[string]fileState {
+    files := make(map[string]fileState)
+    filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return nil
+        }
+        if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+            return nil
+        }
+        if info, err := d.Info(); err == nil {
+            files[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+        }
+        return nil
+    })
+    return files
+}
+
+func sameFiles(a, b map[string]fileState) bool {
+    return len(changedFiles(a, b)) == 0
+}
+
+// changedFiles returns, sorted, the paths added, removed or modified from a to b.
+func changedFiles(a, b map[string]fileState) []string {
+    var changed []string
+    for path, st := range b {
+        if prev, ok := a[path]; !ok || prev.size != st.size || !prev.modTime.Equal(st.modTime) {
+            changed = append(changed, path)
+        }
+    }
+    for path := range a {
+        if _, ok := b[path]; !ok {
+            changed = append(changed, path)
+        }
+    }
+    sort.Strings(changed)
+    return changed
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "log"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// tombstone marks a removed tenancy: oci_tenancy_up drops to 0 with reason
+// "removed" and oci_tenancy_removed_timestamp_seconds records when, while its
+// last values stay exported for removalCycles intervals so alerts resolve and
+// dashboards show the shutdown. Callers must hold m.mu.
+func (m *collectionManager) tombstone(ten Tenancy) {
+    if m.removalCycles <= 0 {
+        m.purgeTenancy(ten)
+        return
+    }
+    m.collector.setTenancyUp(ten.Label, downRemoved)
+    m.collector.tenancyRemoved.WithLabelValues(ten.Label).Set(float64(time.Now().Unix()))
+    if t, ok := m.tombstones[ten.Label]; ok {
+        t.Stop()
+    }
+    var timer *time.Timer
+    timer = time.AfterFunc(time.Duration(m.removalCycles)*m.interval, func() {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        // A re-added or again removed tenancy replaced or dropped the timer.
+        if m.tombstones[ten.Label] != timer {
+            return
+        }
+        delete(m.tombstones, ten.Label)
+        m.purgeTenancy(ten)
+    })
+    m.tombstones[ten.Label] = timer
+    log.Printf("Tenancy %s removed, keeping its series for %d cycles", ten.Name, m.removalCycles)
+}
+
+// revive cancels the tombstone of a tenancy that is configured again. Callers
+// must hold m.mu.
+func (m *collectionManager) revive(label string) {
+    if t, ok := m.tombstones[label]; ok {
+        t.Stop()
+        delete(m.tombstones, label)
+        m.collector.tenancyRemoved.DeleteLabelValues(label)
+    }
+}
+
+// purgeTenancy deletes every series of a removed tenancy, its self-metrics
+// included.
+func (m *collectionManager) purgeTenancy(ten Tenancy) {
+    c := m.collector
+    c.throttles.forget(ten.Label)
+    n := c.store.DeleteTenancy(ten.Label) + c.histograms.DeleteTenancy(ten.Label) + c.self.forgetTenancy(ten.Label)
+    for _, s := range []*sampleStore{c.seriesState, c.coverage, c.resolution, c.resourceInfo, c.lbHealth, c.compat} {
+        if s != nil {
+            n += s.DeleteTenancy(ten.Label)
+        }
+    }
+    c.tenancyUp.DeletePartialMatch(prometheus.Labels{"tenancy": ten.Label})
+    c.tenancyRemoved.DeleteLabelValues(ten.Label)
+    log.Printf("Removed tenancy %s: deleted %d series", ten.Name, n)
+}
+
+// dropRemovedNamespaces deletes, right after a reload, every series of the
+// tenancy from a namespace it no longer collects, instead of leaving them
+// until they go stale.
+func (m *collectionManager) dropRemovedNamespaces(ten Tenancy, metrics MetricConfig) {
+    c := m.collector
+    keep := make(map[string]bool)
+    for _, ns := range metrics.Metrics {
+        keep[ns.Namespace] = true
+    }
+    n := c.store.DeleteNamespaces(ten.Label, keep) + c.histograms.DeleteNamespaces(ten.Label, keep)
+    for _, s := range []*sampleStore{c.seriesState, c.coverage, c.resolution, c.compat} {
+        if s != nil {
+            n += s.DeleteNamespaces(ten.Label, keep)
+        }
+    }
+    if prev, ok := c.collectingNamespaces.Load(ten.Label); ok {
+        for ns := range prev.(map[string]bool) {
+            if !keep[ns] {
+                c.collecting.DeleteLabelValues(ten.Label, ns)
+            }
+        }
+    }
+    if n > 0 {
+        log.Printf("Tenancy %s: deleted %d series of namespaces removed from the config", ten.Name, n)
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// collectOnce runs one cycle of every loop of an on-demand manager.
+func collectOnce(t *testing.T, m *collectionManager) {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    m.CollectNow(ctx)
+    if ctx.Err() != nil {
+        t.Fatal("cycle did not finish")
+    }
+}
+
+// tenancyFamilies returns the names of the gathered families that have a
+// series of the tenancy.
+func tenancyFamilies(t *testing.T, g prometheus.Gatherer, tenancy string) []string {
+    t.Helper()
+    families, err := g.Gather()
+    if err != nil {
+        t.Fatalf("Gather: %v", err)
+    }
+    var names []string
+    for _, mf := range families {
+        for _, metric := range mf.GetMetric() {
+            found := false
+            for _, l := range metric.GetLabel() {
+                found = found || l.GetName() == "tenancy" && l.GetValue() == tenancy
+            }
+            if found {
+                names = append(names, mf.GetName())
+                break
+            }
+        }
+    }
+    return names
+}
+
+func TestReloadRemovesSeries(t *testing.T) {
+    computeOnly := MetricConfig{Metrics: fixtureConfig.Metrics[:1]}
+    for _, tc := range []struct {
+        name        string
+        dropRemoved bool
+        // tenants and metrics are the config applied after the first cycle.
+        tenants TenancyConfig
+        metrics MetricConfig
+        // compute and streaming are the series of each namespace left right
+        // after the reload, out of 2 and 1.
+        compute, streaming int
+        up                 bool
+    }{
+        {
+            name:        "namespace removed",
+            dropRemoved: true,
+            tenants:     TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}},
+            metrics:     computeOnly,
+            compute:     2,
+            up:          true,
+        },
+        {
+            name:      "namespace removed, kept until stale",
+            tenants:   TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}},
+            metrics:   computeOnly,
+            compute:   2,
+            streaming: 1,
+            up:        true,
+        },
+        {
+            name:    "tenancy removed, no removal cycles",
+            metrics: fixtureConfig,
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            _, url := startFake(t, nil)
+            c, reg := newTestCollector(t)
+            m := newTestManager(t, c, time.Minute)
+            m.onDemand = true
+            m.dropRemoved = tc.dropRemoved
+            tenants := TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: map[string]string{"us-ashburn-1": url}}
+            m.Apply(tenants, fixtureConfig)
+            collectOnce(t, m)
+            if n := len(findSamples(c.store, map[string]string{"tenancy": "acme"})); n != 3 {
+                t.Fatalf("first cycle stored %d series, want 3", n)
+            }
+
+            tc.tenants.Endpoints = tenants.Endpoints
+            m.Apply(tc.tenants, tc.metrics)
+
+            if n := len(findSamples(c.store, map[string]string{"namespace": "oci_computeagent"})); n != tc.compute {
+                t.Errorf("%d oci_computeagent series after the reload, want %d", n, tc.compute)
+            }
+            if n := len(findSamples(c.store, map[string]string{"namespace": "oci_streaming"})); n != tc.streaming {
+                t.Errorf("%d oci_streaming series after the reload, want %d", n, tc.streaming)
+            }
+            collecting := 0
+            if tc.up {
+                collecting = 1
+                if tc.streaming > 0 {
+                    collecting = 2
+                }
+            }
+            if n := testutil.CollectAndCount(c.collecting); n != collecting {
+                t.Errorf("%d oci_namespace_collecting series after the reload, want %d", n, collecting)
+            }
+            if n := testutil.CollectAndCount(c.tenancyUp); n != 1 && tc.up || n != 0 && !tc.up {
+                t.Errorf("%d oci_tenancy_up series after the reload, want up=%v", n, tc.up)
+            }
+            if families := tenancyFamilies(t, reg, "acme"); !tc.up && len(families) > 0 {
+                t.Errorf("series of the removed tenancy left in %v", families)
+            }
+        })
+    }
+}
+
+func TestRemovedTenancyKeptForRemovalCycles(t *testing.T) {
+    _, url := startFake(t, nil)
+    c, reg := newTestCollector(t)
+    m := newTestManager(t, c, 50*time.Millisecond)
+    m.onDemand = true
+    m.removalCycles = 2
+    endpoints := map[string]string{"us-ashburn-1": url}
+    m.Apply(TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: endpoints}, cpuConfig)
+    collectOnce(t, m)
+
+    m.Apply(TenancyConfig{Endpoints: endpoints}, cpuConfig)
+    if n := len(c.store.Snapshot()); n != 2 {
+        t.Errorf("%d series right after the removal, want the 2 kept until the purge", n)
+    }
+    if got := testutil.ToFloat64(c.tenancyUp.WithLabelValues("acme", downRemoved)); got != 0 {
+        t.Errorf("oci_tenancy_up{reason=removed} = %v, want 0", got)
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for len(c.store.Snapshot()) > 0 && time.Now().Before(deadline) {
+        time.Sleep(20 * time.Millisecond)
+    }
+    if n := len(c.store.Snapshot()); n != 0 {
+        t.Errorf("%d series left after removalCycles, want 0", n)
+    }
+    if n := testutil.CollectAndCount(c.tenancyRemoved); n != 0 {
+        t.Errorf("%d oci_tenancy_removed_timestamp_seconds series after the purge, want 0", n)
+    }
+    if families := tenancyFamilies(t, reg, "acme"); len(families) > 0 {
+        t.Errorf("series of the removed tenancy left in %v", families)
+    }
+}
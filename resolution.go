@@ -0,0 +1,291 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+// resolutionAuto as an entry's resolution asks the exporter to detect each
+// metric's posting interval and size the query window to match.
+const resolutionAuto = "auto"
+
+const (
+    // detectionLookback is how much history is sampled to measure a metric's cadence.
+    detectionLookback = time.Hour
+    // inconclusiveRetry is how long a fallback result is used before detecting again.
+    inconclusiveRetry = time.Hour
+)
+
+// detectionWindows are the windows detection can pick, smallest first.
+var detectionWindows = []time.Duration{
+    time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour,
+}
+
+type detectedWindow struct {
+    window     time.Duration
+    conclusive bool
+    at         time.Time
+}
+
+// resolutionDetector picks query windows for entries with resolution: auto.
+// ListMetrics confirms the metric exists but says nothing about how often it posts,
+// so the cadence is measured from the gaps between an hour of 1m datapoints.
+// Results are cached per (namespace, metric); when detection is inconclusive the
+// default 1m window is used and detection is retried later.
+type resolutionDetector struct {
+    mu    sync.Mutex
+    cache map[string]detectedWindow
+}
+
+func newResolutionDetector() *resolutionDetector {
+    return &resolutionDetector{cache: make(map[string]detectedWindow)}
+}
+
+// window returns the query window for one metric of ns: the detected window for
+// resolution: auto entries, the entry's window or -metric-window otherwise.
+func (c *collector) window(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartmentID string, ns MetricNamespace, name string, observe attemptObserver) time.Duration {
+    if ns.Resolution != resolutionAuto {
+        return c.entryWindow(ns)
+    }
+    return c.resolutions.detect(ctx, client, ten, compartmentID, ns, name, observe, c.limiter, func() {
+        c.self.apiCalls.WithLabelValues(ten.Label, "ListMetrics").Inc()
+    })
+}
+
+// entryWindow returns the entry's window, or -metric-window when it sets none.
+// Entries are validated at load.
+func (c *collector) entryWindow(ns MetricNamespace) time.Duration {
+    def := c.metricWindow
+    if def == 0 {
+        def = queryWindow
+    }
+    w, err := ns.window(def)
+    if err != nil {
+        return def
+    }
+    return w
+}
+
+// requestResolution is the resolution sent with a query aggregated over window.
+// Entries with windows or resolutions and no explicit resolution get one
+// datapoint per window.
+func (ns MetricNamespace) requestResolution(window time.Duration) string {
+    if ns.Resolution == resolutionAuto || ns.Resolution == "" && (len(ns.Windows) > 0 || len(ns.Resolutions) > 0) {
+        return mqlInterval(window)
+    }
+    return ns.Resolution
+}
+
+// cached returns the detected window for a metric without querying OCI.
+func (d *resolutionDetector) cached(ns MetricNamespace, name string) (time.Duration, bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    res, ok := d.cache[ns.Namespace+"/"+name]
+    return res.window, ok
+}
+
+func (d *resolutionDetector) detect(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartmentID string, ns MetricNamespace, name string, observe attemptObserver, limiter *adaptiveLimiter, count func()) time.Duration {
+    key := ns.Namespace + "/" + name
+    d.mu.Lock()
+    res, ok := d.cache[key]
+    d.mu.Unlock()
+    if ok && (res.conclusive || time.Since(res.at) < inconclusiveRetry) {
+        return res.window
+    }
+
+    window, conclusive := measureCadence(ctx, client, ten, compartmentID, ns, name, observe, limiter, count)
+    if conclusive {
+        log.Printf("Detected %s window for %s in %s", mqlInterval(window), name, ns.Namespace)
+    } else {
+        log.Printf("Could not detect posting interval of %s in %s, using %s", name, ns.Namespace, mqlInterval(window))
+    }
+    d.mu.Lock()
+    d.cache[key] = detectedWindow{window: window, conclusive: conclusive, at: time.Now()}
+    d.mu.Unlock()
+    return window
+}
+
+// measureCadence returns the smallest detection window covering the typical gap
+// between the metric's datapoints, and whether enough data was seen to tell.
+// Both requests hold a slot of limiter while in flight; count is called for the
+// ListMetrics request, observe sees the SummarizeMetricsData one.
+func measureCadence(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartmentID string, ns MetricNamespace, name string, observe attemptObserver, limiter *adaptiveLimiter, count func()) (time.Duration, bool) {
+    if err := limiter.Acquire(ctx); err != nil {
+        return queryWindow, false
+    }
+    count()
+    listed, err := client.ListMetrics(ctx, monitoring.ListMetricsRequest{
+        CompartmentId:          common.String(compartmentID),
+        CompartmentIdInSubtree: common.Bool(inSubtree(ten, ns)),
+        Limit:                  common.Int(1),
+        ListMetricsDetails: monitoring.ListMetricsDetails{
+            Namespace: common.String(ns.Namespace),
+            Name:      common.String(name),
+        },
+    })
+    limiter.Release(isThrottled(err))
+    if err != nil || len(listed.Items) == 0 {
+        return queryWindow, false
+    }
+
+    end := time.Now().UTC()
+    startTime := common.SDKTime{Time: end.Add(-detectionLookback)}
+    endTime := common.SDKTime{Time: end}
+    req := monitoring.SummarizeMetricsDataRequest{
+        CompartmentId:          common.String(compartmentID),
+        CompartmentIdInSubtree: common.Bool(inSubtree(ten, ns)),
+        SummarizeMetricsDataDetails: monitoring.SummarizeMetricsDataDetails{
+            Namespace:  common.String(ns.Namespace),
+            Query:      common.String(name + "[1m].count()"),
+            StartTime:  &startTime,
+            EndTime:    &endTime,
+            Resolution: common.String("1m"),
+        },
+    }
+    if ns.ResourceGroup != "" {
+        req.SummarizeMetricsDataDetails.ResourceGroup = common.String(ns.ResourceGroup)
+    }
+    resp, err := summarizeWithRetry(ctx, client, req, observe, limiter)
+    if err != nil {
+        return queryWindow, false
+    }
+
+    var gaps []time.Duration
+    for _, item := range resp.Items {
+        var prev time.Time
+        for _, dp := range item.AggregatedDatapoints {
+            if dp.Timestamp == nil {
+                continue
+            }
+            if !prev.IsZero() {
+                gaps = append(gaps, dp.Timestamp.Time.Sub(prev))
+            }
+            prev = dp.Timestamp.Time
+        }
+    }
+    if len(gaps) == 0 {
+        return queryWindow, false
+    }
+    sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+    median := gaps[len(gaps)/2]
+    for _, w := range detectionWindows {
+        if median <= w {
+            return w, true
+        }
+    }
+    return detectionWindows[len(detectionWindows)-1], true
+}
+
+// resolutionsRefresh is how often entries with resolutions query every
+// resolution again, to find streams that appeared since.
+const resolutionsRefresh = time.Hour
+
+// resolutionChoice is, per stream, the index of the resolution it last had
+// datapoints at.
+type resolutionChoice struct {
+    streams map[string]int
+    full    time.Time
+}
+
+// resolutionCache remembers, per tenancy, query and compartment, which of an
+// entry's resolutions each stream was taken from, so later cycles only query the
+// resolutions their streams need.
+type resolutionCache struct {
+    mu      sync.Mutex
+    choices map[string]map[string]resolutionChoice
+}
+
+func newResolutionCache() *resolutionCache {
+    return &resolutionCache{choices: make(map[string]map[string]resolutionChoice)}
+}
+
+// forget drops the cached choices of a tenancy.
+func (r *resolutionCache) forget(tenancy string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.choices, tenancy)
+}
+
+// resolutionPass tracks the resolutions of one metric's queries in one cycle.
+type resolutionPass struct {
+    cache   *resolutionCache
+    tenancy string
+    key     string
+    last    int
+    known   map[string]int
+    full    bool
+    at      time.Time
+    // served maps each stream stored this cycle to its resolution's index.
+    served map[string]int
+    // pending is set when a stream came back without datapoints.
+    pending bool
+}
+
+// start begins a pass over resolutions 0 to last for one metric. Every resolution
+// is queried the first time, when nothing was found, and every resolutionsRefresh.
+func (r *resolutionCache) start(tenancy, namespace, name, compartmentID string, last int, now time.Time) *resolutionPass {
+    key := namespace + "/" + name + "/" + compartmentID
+    r.mu.Lock()
+    choice, ok := r.choices[tenancy][key]
+    r.mu.Unlock()
+    p := &resolutionPass{cache: r, tenancy: tenancy, key: key, last: last, known: choice.streams, at: choice.full, served: make(map[string]int)}
+    if !ok || len(choice.streams) == 0 || now.Sub(choice.full) >= resolutionsRefresh {
+        p.full, p.at = true, now
+    }
+    return p
+}
+
+// query reports whether resolution i must be queried: on a full pass, when a
+// stream is still without datapoints, or when a stream last taken at i or a
+// finer resolution has not been stored yet.
+func (p *resolutionPass) query(i int) bool {
+    if p.full || p.pending {
+        return true
+    }
+    for stream, j := range p.known {
+        if _, ok := p.served[stream]; !ok && j <= i {
+            return true
+        }
+    }
+    return false
+}
+
+// filter returns the items of resolution i to record: those with datapoints not
+// already stored from a finer resolution, and at the last resolution also the
+// remaining streams without them, so their state is still exported.
+func (p *resolutionPass) filter(i int, items []monitoring.MetricData) []monitoring.MetricData {
+    p.pending = false
+    kept := make([]monitoring.MetricData, 0, len(items))
+    for _, item := range items {
+        _, _, stream := labelKey(item.Dimensions)
+        if _, ok := p.served[stream]; ok {
+            continue
+        }
+        if n := len(item.AggregatedDatapoints); n == 0 || item.AggregatedDatapoints[n-1].Value == nil {
+            if i < p.last {
+                p.pending = true
+                continue
+            }
+        } else {
+            p.served[stream] = i
+        }
+        kept = append(kept, item)
+    }
+    return kept
+}
+
+// finish caches the resolutions the streams were taken from this cycle.
+func (p *resolutionPass) finish() {
+    p.cache.mu.Lock()
+    defer p.cache.mu.Unlock()
+    if p.cache.choices[p.tenancy] == nil {
+        p.cache.choices[p.tenancy] = make(map[string]resolutionChoice)
+    }
+    p.cache.choices[p.tenancy][p.key] = resolutionChoice{streams: p.served, full: p.at}
+}
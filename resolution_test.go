@@ -0,0 +1,101 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+
+    "oci-prom-exporter-multitenant/internal/fakemonitoring"
+)
+
+func TestResolutionSwitchVisible(t *testing.T) {
+    // The stream's value tells which resolution it was served at.
+    at := func(resolution string, value float64) []fakemonitoring.Series {
+        return []fakemonitoring.Series{{
+            Namespace:  "oci_computeagent",
+            Name:       "CpuUtilization",
+            Dimensions: map[string]string{"resourceId": "ocid1.instance.oc1.iad.r1"},
+            Resolution: resolution,
+            Values:     []*float64{&value},
+        }}
+    }
+    fake, url := startFake(t, at("5m", 5))
+    c, _ := newTestCollector(t)
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    ns.Resolutions = []string{"1m", "5m"}
+    config := MetricConfig{Metrics: []MetricNamespace{ns}}
+    client := newFakeClient(t, url)
+    match := map[string]string{"tenancy": "acme", "resource_id": "ocid1.instance.oc1.iad.r1"}
+    collect := func() (value, resolution float64) {
+        t.Helper()
+        if _, err := c.collectTenancy(context.Background(), client, ten, []string{ten.CompartmentID}, config); err != nil {
+            t.Fatalf("collectTenancy: %v", err)
+        }
+        if found := findSamples(c.store, map[string]string{"resolution": ""}); len(found) != 1 {
+            t.Fatalf("value series %v, want one without a resolution label", found)
+        }
+        return sampleValue(t, c.store, match), sampleValue(t, c.resolution, match)
+    }
+
+    if value, resolution := collect(); value != 5 || resolution != 300 {
+        t.Errorf("at 5m: value %v at resolution %vs, want 5 at 300s", value, resolution)
+    }
+    // The stream is still served at 5m, which the cached choice queries
+    // alone until every resolution is queried again.
+    fake.SetSeries(at("1m", 1))
+    if value, resolution := collect(); value != 1 || resolution != 300 {
+        t.Errorf("after switching to 1m: value %v at resolution %vs, want 1 at 300s", value, resolution)
+    }
+    c.resolutionChoices.forget("acme")
+    if value, resolution := collect(); value != 1 || resolution != 60 {
+        t.Errorf("after querying every resolution: value %v at resolution %vs, want 1 at 60s", value, resolution)
+    }
+    // The coarser datapoint replaces the finer one once it is at least as
+    // recent; either way the resolution describes the stored value.
+    fake.SetSeries(at("5m", 5))
+    if value, resolution := collect(); !(value == 1 && resolution == 60 || value == 5 && resolution == 300) {
+        t.Errorf("after switching back to 5m: value %v at resolution %vs", value, resolution)
+    }
+}
+
+func TestDetectionCountsAndLimitsListMetrics(t *testing.T) {
+    _, url := startFake(t, nil)
+    c, _ := newTestCollector(t)
+    c.limiter = newAdaptiveLimiter(1, 1, c.self)
+    ten := testTenancy("acme")
+    ns := cpuConfig.Metrics[0]
+    ns.Resolution = resolutionAuto
+    client := newFakeClient(t, url)
+
+    // Without a free slot, detection gives up before sending anything.
+    if err := c.limiter.Acquire(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    count := 0
+    if window, conclusive := measureCadence(ctx, client, ten, ten.CompartmentID, ns, "CpuUtilization", nil, c.limiter, func() { count++ }); window != queryWindow || conclusive || count != 0 {
+        t.Errorf("measureCadence without a slot = %v, %v after %d ListMetrics calls, want the fallback and none", window, conclusive, count)
+    }
+    c.limiter.Release(false)
+
+    if _, err := c.collectTenancy(context.Background(), client, ten, []string{ten.CompartmentID}, MetricConfig{Metrics: []MetricNamespace{ns}}); err != nil {
+        t.Fatalf("collectTenancy: %v", err)
+    }
+    if got := testutil.ToFloat64(c.self.apiCalls.WithLabelValues("acme", "ListMetrics")); got != 1 {
+        t.Errorf("ListMetrics calls = %v, want 1", got)
+    }
+    // The cadence measurement and the query itself.
+    if got := testutil.ToFloat64(c.self.apiCalls.WithLabelValues("acme", "SummarizeMetricsData")); got != 2 {
+        t.Errorf("SummarizeMetricsData calls = %v, want 2", got)
+    }
+    c.limiter.mu.Lock()
+    inFlight := c.limiter.inFlight
+    c.limiter.mu.Unlock()
+    if inFlight != 0 {
+        t.Errorf("%d limiter slots still held", inFlight)
+    }
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "reflect"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/loadbalancer"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// compartmentRefreshInterval is how often a loop re-runs compartment discovery.
+const compartmentRefreshInterval = time.Hour
+
+// clockJumpThreshold is how far the wall clock may drift from the monotonic clock
+// between two cycles before it is logged, e.g. after a suspend or a clock step.
+const clockJumpThreshold = time.Minute
+
+// wallClockJump returns how much further the wall clock moved than the monotonic
+// clock between prev and now, both taken with time.Now. Scheduling relies on the
+// monotonic clock and each cycle's query window has a fixed size ending at the
+// current wall time, so a jump only moves the window, never widens it.
+func wallClockJump(prev, now time.Time) time.Duration {
+    return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
+
+// tenancyLoop is the collection goroutine of one tenancy.
+type tenancyLoop struct {
+    ten      Tenancy
+    endpoint string
+    cancel   context.CancelFunc
+    done     chan struct{}
+    // trigger starts a cycle under -scrape-on-request; the cycle closes the
+    // channel it carries when it finishes. It is nil in timer mode.
+    trigger chan chan struct{}
+
+    mu           sync.Mutex
+    nextRun      time.Time
+    compartments []string
+    // failing is whether the last completed cycle failed.
+    failing bool
+    // sweep holds the namespaces whose series of outdated label sets are
+    // deleted after their next clean cycle, see sweepSchemas.
+    sweep map[string]bool
+    // last describes the last completed cycle, if any.
+    last         cycleStats
+    lastDuration time.Duration
+    lastFinished time.Time
+}
+
+// collectionManager runs an independent collection loop per tenancy, so a slow or
+// failing tenancy only delays its own data. Apply starts, stops and restarts loops
+// as the tenancy list changes; metric config changes are picked up by every loop
+// on its next cycle.
+type collectionManager struct {
+    clients      *regionClients
+    identity     identity.IdentityClient
+    loadBalancer loadbalancer.LoadBalancerClient
+    collector    *collector
+    interval     time.Duration
+
+    // metricsMu is separate from mu because Apply and Stop wait for loops while
+    // holding mu, and a loop reads the metric config at the start of every cycle.
+    metricsMu sync.RWMutex
+    metrics   MetricConfig
+
+    mu    sync.Mutex
+    loops map[string]*tenancyLoop
+    // skipped are the configured tenancies without a loop because their client could not be created.
+    skipped []Tenancy
+    // tombstones hold the purge timers of removed tenancies, by label.
+    tombstones map[string]*time.Timer
+    // removalCycles is how many intervals a removed tenancy's series are kept.
+    removalCycles int
+    // dropRemoved deletes the series of namespaces a reload removed.
+    dropRemoved bool
+    // wildcardRefresh and wildcardEmptyRatio configure each loop's wildcardCache.
+    wildcardRefresh    time.Duration
+    wildcardEmptyRatio float64
+    // collectionOrder is the -collection-order of every cycle's entries.
+    collectionOrder string
+    // idle, when set, stretches the interval while the metrics endpoint is not scraped.
+    idle *idleBackoff
+    // cycleSummary is the -cycle-summary level of the line logged per cycle.
+    cycleSummary string
+    // onDemand runs cycles when CollectNow asks instead of on the interval
+    // (-scrape-on-request).
+    onDemand bool
+    // rebuildClients, when set, creates the OCI clients again for RunClientRetry.
+    rebuildClients func() (monitoring.MonitoringClient, identity.IdentityClient, loadbalancer.LoadBalancerClient, error)
+}
+
+// Collection orders of -collection-order.
+const (
+    orderTenancy   = "tenancy"
+    orderNamespace = "namespace"
+)
+
+func newCollectionManager(clients *regionClients, identityClient identity.IdentityClient, lbClient loadbalancer.LoadBalancerClient, coll *collector, interval time.Duration) *collectionManager {
+    return &collectionManager{
+        clients:      clients,
+        identity:     identityClient,
+        loadBalancer: lbClient,
+        collector:    coll,
+        interval:     interval,
+        loops:        make(map[string]*tenancyLoop),
+        tombstones:   make(map[string]*time.Timer),
+    }
+}
+
+// Apply makes the running loops match the given config. Loops of tenancies that
+// are gone or whose settings changed are stopped; new or changed ones are started.
+func (m *collectionManager) Apply(tenants TenancyConfig, metrics MetricConfig) {
+    m.metricsMu.Lock()
+    m.metrics = metrics
+    m.metricsMu.Unlock()
+
+    m.clients.SetEndpoints(tenants.Endpoints)
+    // Tenancies whose config file or key changed on disk get new clients.
+    changed := m.clients.Refresh(tenants.Tenancies)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    wanted := make(map[string]Tenancy, len(tenants.Tenancies))
+    for _, ten := range tenants.Tenancies {
+        wanted[ten.Name] = ten
+    }
+    for name, loop := range m.loops {
+        ten, ok := wanted[name]
+        if ok && reflect.DeepEqual(ten, loop.ten) && m.clients.Endpoint(ten.Region) == loop.endpoint && !changed[ten.credentialKey()] {
+            continue
+        }
+        loop.stop()
+        delete(m.loops, name)
+        m.collector.self.cycleDurationRatio.DeleteLabelValues(loop.ten.Label)
+        m.collector.self.intervalDrift.DeleteLabelValues(loop.ten.Label)
+        m.collector.self.lastErrorRequestID.DeletePartialMatch(prometheus.Labels{"tenancy": loop.ten.Label})
+        m.collector.collecting.DeletePartialMatch(prometheus.Labels{"tenancy": loop.ten.Label})
+        m.collector.collectingNamespaces.Delete(loop.ten.Label)
+        if m.collector.alarms != nil {
+            m.collector.alarms.forget(loop.ten.Label)
+        }
+        m.collector.regions.forget(loop.ten)
+        m.collector.lastErrors.forget(loop.ten.Label)
+        m.collector.resolutionChoices.forget(loop.ten.Label)
+        m.collector.budgets.forget(loop.ten.Label)
+        m.collector.pacers.forget(loop.ten.Label)
+        if m.collector.queryInfo != nil {
+            m.collector.queryInfo.forget(loop.ten.Label)
+        }
+        if m.collector.queryDump != nil {
+            m.collector.queryDump.forget(loop.ten.Label)
+        }
+        if m.collector.backoff != nil {
+            m.collector.backoff.forget(loop.ten.Label)
+        }
+        if m.collector.active != nil {
+            m.collector.active.forget(loop.ten.Label)
+        }
+        log.Printf("Stopped collection for tenancy %s", name)
+        if !ok {
+            m.tombstone(loop.ten)
+        }
+    }
+    // Rebuilt from wanted so removed tenancies drop out.
+    m.collector.tenancyInfo.Reset()
+    for _, ten := range wanted {
+        m.collector.tenancyInfo.WithLabelValues(ten.Label, ten.TenancyID, ten.Region, ten.CompartmentID).Set(1)
+        m.revive(ten.Label)
+        m.collector.setTenancyUp(ten.Label, "")
+        if m.dropRemoved {
+            m.dropRemovedNamespaces(ten, ten.metrics(metrics))
+        }
+    }
+    m.collector.self.clientInitFailed.Reset()
+    m.skipped = nil
+    for name, ten := range wanted {
+        if _, ok := m.loops[name]; ok {
+            m.collector.self.clientInitFailed.WithLabelValues(ten.Label).Set(0)
+            continue
+        }
+        m.startLoop(ten)
+    }
+    if m.dropRemoved {
+        for name, ten := range wanted {
+            if loop, ok := m.loops[name]; ok {
+                loop.markSweep(ten.metrics(metrics))
+            }
+        }
+    }
+}
+
+// startLoop starts the loop of ten or, if its client cannot be created, marks
+// it down and skipped until RunClientRetry gets one. Callers must hold m.mu.
+func (m *collectionManager) startLoop(ten Tenancy) {
+    client, err := m.clients.For(ten)
+    if err != nil {
+        log.Printf("Warning: skipping tenancy %s, its client could not be created: %v", ten.Name, err)
+        m.collector.self.clientInitFailed.WithLabelValues(ten.Label).Set(1)
+        m.collector.setTenancyUp(ten.Label, downClientError)
+        m.skipped = append(m.skipped, ten)
+        return
+    }
+    m.collector.self.clientInitFailed.WithLabelValues(ten.Label).Set(0)
+    m.collector.setTenancyUp(ten.Label, "")
+    m.loops[ten.Name] = m.start(ten, client)
+    log.Printf("Started collection for tenancy %s (%s)", ten.Name, ten.Region)
+}
+
+// Bounds of the backoff between attempts to create the clients of skipped tenancies.
+const (
+    clientRetryMin = 30 * time.Second
+    clientRetryMax = 10 * time.Minute
+)
+
+// RunClientRetry tries again, with exponential backoff, to create the clients
+// of skipped tenancies and starts their loops once it succeeds, so fixing a
+// broken key file or OCI config heals them without a restart. It returns when
+// ctx is done.
+func (m *collectionManager) RunClientRetry(ctx context.Context) {
+    delay := clientRetryMin
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delay):
+        }
+        if m.retrySkipped() {
+            delay = clientRetryMin
+        } else {
+            delay = min(2*delay, clientRetryMax)
+        }
+    }
+}
+
+// retrySkipped rebuilds the OCI clients of -config if they could not be
+// created and starts the loops of skipped tenancies, creating the clients of
+// those with their own config_file or profile again. It reports whether none is left.
+func (m *collectionManager) retrySkipped() bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if len(m.skipped) == 0 {
+        return true
+    }
+    rebuilt := true
+    if m.clients.Err() != nil && m.rebuildClients != nil {
+        client, identityClient, lbClient, err := m.rebuildClients()
+        if err != nil {
+            log.Printf("Creating the OCI clients of -config failed again: %v", err)
+            rebuilt = false
+        } else {
+            m.clients.SetBase(client)
+            m.identity, m.loadBalancer = identityClient, lbClient
+            log.Printf("Created the OCI clients of -config, starting the skipped tenancies")
+        }
+    }
+    skipped := m.skipped
+    m.skipped = nil
+    for _, ten := range skipped {
+        // Tenancies with their own credentials do not depend on -config.
+        if !rebuilt && ten.credentialKey() == "" {
+            m.skipped = append(m.skipped, ten)
+            continue
+        }
+        m.startLoop(ten)
+    }
+    return len(m.skipped) == 0
+}
+
+// CollectNow runs a cycle of every running loop under -scrape-on-request and
+// returns once all have finished, or when ctx is done. A loop still busy with
+// an earlier cycle starts the new one after it.
+func (m *collectionManager) CollectNow(ctx context.Context) {
+    m.mu.Lock()
+    loops := make([]*tenancyLoop, 0, len(m.loops))
+    for _, loop := range m.loops {
+        loops = append(loops, loop)
+    }
+    m.mu.Unlock()
+    var wg sync.WaitGroup
+    for _, loop := range loops {
+        wg.Add(1)
+        go func(loop *tenancyLoop) {
+            defer wg.Done()
+            done := make(chan struct{})
+            select {
+            case loop.trigger <- done:
+            case <-ctx.Done():
+                return
+            case <-loop.done:
+                return
+            }
+            select {
+            case <-done:
+            case <-ctx.Done():
+            case <-loop.done:
+            }
+        }(loop)
+    }
+    wg.Wait()
+}
+
+// Plan returns what each running loop will query on its next cycle.
+func (m *collectionManager) Plan() []tenancyPlan {
+    global := m.currentMetrics()
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    plans := make([]tenancyPlan, 0, len(m.loops))
+    for _, loop := range m.loops {
+        loop.mu.Lock()
+        compartments, nextRun := loop.compartments, loop.nextRun
+        loop.mu.Unlock()
+        if compartments == nil {
+            compartments = loop.ten.queryCompartments(nil)
+        }
+        metrics := loop.ten.metrics(global)
+        metrics.Metrics = append([]MetricNamespace(nil), metrics.Metrics...)
+        m.order(metrics.Metrics, false)
+        plans = append(plans, m.collector.plan(loop.ten, compartments, metrics, nextRun))
+    }
+    return plans
+}
+
+// Stop stops every loop and waits for in-flight cycles to return.
+func (m *collectionManager) Stop() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for name, loop := range m.loops {
+        loop.stop()
+        delete(m.loops, name)
+    }
+}
+
+// RunHeartbeat increments oci_exporter_heartbeat_total every interval until ctx
+// is done. It runs apart from the tenancy loops and never calls OCI, so it keeps
+// counting while every tenancy fails and only stops when the process does.
+func (m *collectionManager) RunHeartbeat(ctx context.Context) {
+    ticker := time.NewTicker(m.interval)
+    defer ticker.Stop()
+    for {
+        m.collector.self.heartbeats.Inc()
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (m *collectionManager) currentMetrics() MetricConfig {
+    m.metricsMu.RLock()
+    defer m.metricsMu.RUnlock()
+    return m.metrics
+}
+
+// allMetrics returns the global entries followed by the own entries of every
+// running tenancy, in tenancy name order.
+func (m *collectionManager) allMetrics() MetricConfig {
+    all := MetricConfig{Metrics: append([]MetricNamespace(nil), m.currentMetrics().Metrics...)}
+    m.mu.Lock()
+    names := make([]string, 0, len(m.loops))
+    for name := range m.loops {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        all.Metrics = append(all.Metrics, m.loops[name].ten.Metrics...)
+    }
+    m.mu.Unlock()
+    return all
+}
+
+func (m *collectionManager) start(ten Tenancy, client monitoring.MonitoringClient) *tenancyLoop {
+    ctx, cancel := context.WithCancel(context.Background())
+    loop := &tenancyLoop{ten: ten, endpoint: m.clients.Endpoint(ten.Region), cancel: cancel, done: make(chan struct{})}
+    if m.onDemand {
+        loop.trigger = make(chan chan struct{})
+    }
+
+    identityClient, lbClient := m.identity, m.loadBalancer
+    if set, ok := m.clients.Profile(ten); ok {
+        identityClient, lbClient = set.identity, set.loadBalancer
+    }
+    identityClient.SetRegion(ten.Region)
+    lbClient.SetRegion(ten.Region)
+
+    go func() {
+        defer close(loop.done)
+        ticker := time.NewTicker(m.interval)
+        defer ticker.Stop()
+        tick := ticker.C
+        if m.onDemand {
+            ticker.Stop()
+            tick = nil
+        }
+        // cycleDone is closed when the cycle a CollectNow asked for ends.
+        var cycleDone chan struct{}
+        // next waits for the next cycle and reports false once the loop stops.
+        next := func() bool {
+            if cycleDone != nil {
+                close(cycleDone)
+                cycleDone = nil
+            }
+            select {
+            case <-ctx.Done():
+                return false
+            case <-tick:
+            case cycleDone = <-loop.trigger:
+            }
+            return true
+        }
+        var discovered []string
+        var discoveredAt, lastStart, lastTick time.Time
+        first := true
+        wild := newWildcardCache(m.wildcardRefresh, m.wildcardEmptyRatio)
+        for {
+            // The ticker keeps its schedule whatever the cycles take, so the
+            // spacing only deviates by scheduling latency or dropped ticks.
+            now := time.Now()
+            if !lastTick.IsZero() && !m.onDemand {
+                m.collector.self.intervalDrift.WithLabelValues(ten.Label).Set((now.Sub(lastTick) - m.interval).Seconds())
+            }
+            lastTick = now
+            m.collector.throttles.refresh(ten.Label, now)
+            if ten.DiscoverCompartments && time.Since(discoveredAt) >= compartmentRefreshInterval {
+                ids, err := discoverCompartments(ctx, identityClient, ten)
+                if err != nil {
+                    log.Printf("Compartment discovery for tenancy %s failed, using previous result: %v", ten.Name, err)
+                } else {
+                    discovered, discoveredAt = ids, time.Now()
+                }
+            }
+            compartments := ten.queryCompartments(discovered)
+            loop.mu.Lock()
+            if !m.onDemand {
+                loop.nextRun = time.Now().Add(m.interval)
+            }
+            loop.compartments = compartments
+            loop.mu.Unlock()
+            started := time.Now()
+            m.collector.self.heartbeat.Set(float64(started.UnixNano()) / 1e9)
+            if m.idle != nil && !lastStart.IsZero() && m.idle.Skip(started.Sub(lastStart), m.interval) {
+                if !next() {
+                    return
+                }
+                continue
+            }
+            if !lastStart.IsZero() {
+                if jump := wallClockJump(lastStart, started); jump > clockJumpThreshold || jump < -clockJumpThreshold {
+                    log.Printf("Notice: wall clock moved %v relative to elapsed time since the last cycle of tenancy %s (suspend or clock change); query windows keep their configured size", jump.Round(time.Second), ten.Name)
+                }
+            }
+            lastStart = started
+            if m.collector.regions.Cooling(ten, started) {
+                if !next() {
+                    return
+                }
+                continue
+            }
+            // Namespaces marked while the cycle runs wait for the next one,
+            // which is the first to use the reloaded config.
+            loop.mu.Lock()
+            sweep := loop.sweep
+            loop.sweep = nil
+            loop.mu.Unlock()
+            stats, err := m.runCycle(ctx, client, ten, compartments, first, wild)
+            first = false
+            if m.collector.lbHealth != nil && ctx.Err() == nil {
+                m.collector.collectLBHealth(ctx, lbClient, ten, compartments)
+            }
+            if m.collector.alarms != nil && ctx.Err() == nil {
+                m.collector.collectAlarmSuppressions(ctx, client, ten, compartments)
+            }
+            if ctx.Err() == nil {
+                m.collector.regions.EndCycle(ten, time.Now())
+                elapsed := time.Since(started)
+                m.collector.self.cycleDuration.WithLabelValues(ten.Label).Set(elapsed.Seconds())
+                m.collector.self.cycleDurationRatio.WithLabelValues(ten.Label).Set(elapsed.Seconds() / m.interval.Seconds())
+                loop.mu.Lock()
+                loop.failing = err != nil
+                loop.last, loop.lastDuration, loop.lastFinished = stats, elapsed, time.Now()
+                if len(sweep) > 0 && err == nil {
+                    m.collector.sweepSchemas(ten, sweep, stats)
+                }
+                loop.requeueSweep(sweep)
+                loop.mu.Unlock()
+                m.collector.heartbeat.CycleDone(err == nil && len(stats.Errors) == 0)
+                switch m.cycleSummary {
+                case summaryInfo:
+                    log.Printf("Cycle %s", stats.summary(ten, elapsed, err))
+                case summaryDebug:
+                    debugf("Cycle %s", stats.summary(ten, elapsed, err))
+                }
+            }
+            if !next() {
+                return
+            }
+        }
+    }()
+    return loop
+}
+
+// runCycle collects one tenancy once and reports whether the cycle failed. A panic
+// is logged, contained to this tenancy and counted as a failure. The first cycle
+// of a loop collects entries by priority, high first, so that after a start or
+// restart the metrics that matter most appear first; later cycles keep config order.
+// Wildcard entries are expanded in compartments through wild.
+func (m *collectionManager) runCycle(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartments []string, first bool, wild *wildcardCache) (stats cycleStats, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Printf("Collection for tenancy %s panicked: %v", ten.Name, r)
+            err = fmt.Errorf("panic: %v", r)
+        }
+    }()
+    configured := ten.metrics(m.currentMetrics())
+    metrics := wild.Expand(ctx, m.collector, client, ten, compartments, configured)
+    m.order(metrics.Metrics, first)
+    stats, err = m.collector.collectTenancy(ctx, client, ten, compartments, metrics)
+    wild.Observe(configured, stats)
+    return stats, err
+}
+
+// order sorts a cycle's entries in collection order. With the namespace order,
+// entries are sorted by namespace, so the concurrently running loops of every
+// tenancy walk the namespaces in the same sequence, keeping them on one
+// namespace at a time; otherwise they keep config order, and each tenancy's
+// cycle stays one coherent pass. The first cycle after startup puts higher
+// priorities first either way.
+func (m *collectionManager) order(entries []MetricNamespace, first bool) {
+    if m.collectionOrder == orderNamespace {
+        sort.SliceStable(entries, func(i, j int) bool { return entries[i].Namespace < entries[j].Namespace })
+    }
+    if first {
+        sort.SliceStable(entries, func(i, j int) bool {
+            return entries[i].priorityWeight() > entries[j].priorityWeight()
+        })
+    }
+}
+
+// Failing returns how many configured tenancies are failing, out of total. A
+// tenancy is failing when its client could not be created or its last cycle
+// failed; one that has not finished a cycle yet is not counted as failing.
+func (m *collectionManager) Failing() (failing, total int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    failing, total = len(m.skipped), len(m.skipped)+len(m.loops)
+    for _, loop := range m.loops {
+        loop.mu.Lock()
+        if loop.failing {
+            failing++
+        }
+        loop.mu.Unlock()
+    }
+    return failing, total
+}
+
+// Stats returns the state and last cycle of every configured tenancy.
+func (m *collectionManager) Stats() []tenancyStats {
+    global := m.currentMetrics()
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := make([]tenancyStats, 0, len(m.loops)+len(m.skipped))
+    for _, ten := range m.skipped {
+        out = append(out, tenancyStats{
+            Tenancy:          ten.Label,
+            Region:           ten.Region,
+            MetricEntries:    len(ten.metrics(global).Metrics),
+            State:            stateClientInitFailed,
+            ClientInitFailed: true,
+        })
+    }
+    for _, loop := range m.loops {
+        loop.mu.Lock()
+        st := tenancyStats{
+            Tenancy:       loop.ten.Label,
+            Region:        loop.ten.Region,
+            MetricEntries: len(loop.ten.metrics(global).Metrics),
+            State:         stateWaiting,
+        }
+        if !loop.nextRun.IsZero() {
+            next := loop.nextRun.UTC()
+            st.NextRun = &next
+        }
+        if !loop.lastFinished.IsZero() {
+            finished := loop.lastFinished.UTC()
+            last := loop.last
+            st.LastCycle = &last
+            st.LastCycle.Finished = &finished
+            st.LastCycle.DurationSeconds = loop.lastDuration.Seconds()
+            st.State = stateOK
+            if loop.failing {
+                st.State = stateFailing
+            }
+        }
+        loop.mu.Unlock()
+        st.LastErrors = m.collector.lastErrors.List(loop.ten.Label)
+        out = append(out, st)
+    }
+    return out
+}
+
+func (l *tenancyLoop) stop() {
+    l.cancel()
+    <-l.done
+}
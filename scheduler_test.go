@@ -0,0 +1,313 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/identity"
+    "github.com/oracle/oci-go-sdk/v65/loadbalancer"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cpuConfig collects one fixture metric, a single query per cycle.
+var cpuConfig = MetricConfig{Metrics: []MetricNamespace{{Namespace: "oci_computeagent", Names: []string{"CpuUtilization"}}}}
+
+// newTestManager returns a manager of c whose base client is created for the
+// test credentials, stopped between queries when the test ends.
+func newTestManager(t testing.TB, c *collector, interval time.Duration) *collectionManager {
+    t.Helper()
+    if c.limiter == nil {
+        c.limiter = newAdaptiveLimiter(64, 64, c.self)
+    }
+    clients := newRegionClients(newFakeClient(t, ""), nil)
+    m := newCollectionManager(clients, identity.IdentityClient{}, loadbalancer.LoadBalancerClient{}, c, interval)
+    t.Cleanup(func() { stopBetweenQueries(t, m) })
+    return m
+}
+
+// stopBetweenQueries stops m once no query holds a slot of its collector's
+// limiter. The SDK's Retry races with its own attempt when a query is
+// cancelled in flight, which the race detector reports.
+func stopBetweenQueries(t testing.TB, m *collectionManager) {
+    t.Helper()
+    l := m.collector.limiter
+    l.mu.Lock()
+    l.limit, l.max = 0, 0
+    l.mu.Unlock()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        l.mu.Lock()
+        inFlight := l.inFlight
+        l.mu.Unlock()
+        if inFlight == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d queries still in flight", inFlight)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    m.Stop()
+}
+
+// loopState returns whether the tenancy's loop finished a cycle and whether
+// that cycle failed.
+func loopState(m *collectionManager, name string) (finished, failing bool) {
+    m.mu.Lock()
+    loop := m.loops[name]
+    m.mu.Unlock()
+    if loop == nil {
+        return false, false
+    }
+    loop.mu.Lock()
+    defer loop.mu.Unlock()
+    return !loop.lastFinished.IsZero(), loop.failing
+}
+
+func TestLoopsIsolateFailingTenancy(t *testing.T) {
+    for _, tc := range []struct {
+        name string
+        // handler answers every request of the bad tenancy's region.
+        handler func(release chan struct{}) http.HandlerFunc
+        // finishes is whether the bad tenancy completes a failed cycle.
+        finishes bool
+    }{
+        {
+            name: "hanging",
+            handler: func(release chan struct{}) http.HandlerFunc {
+                return func(w http.ResponseWriter, r *http.Request) {
+                    select {
+                    case <-r.Context().Done():
+                    case <-release:
+                    }
+                }
+            },
+        },
+        {
+            name: "server error",
+            handler: func(chan struct{}) http.HandlerFunc {
+                return func(w http.ResponseWriter, r *http.Request) {
+                    http.Error(w, `{"code":"InternalServerError","message":"down"}`, http.StatusInternalServerError)
+                }
+            },
+            finishes: true,
+        },
+        {
+            name: "not found",
+            handler: func(chan struct{}) http.HandlerFunc {
+                return func(w http.ResponseWriter, r *http.Request) {
+                    http.Error(w, `{"code":"NotAuthorizedOrNotFound","message":"no"}`, http.StatusNotFound)
+                }
+            },
+            finishes: true,
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            good, goodURL := startFake(t, nil)
+            release := make(chan struct{})
+            bad := httptest.NewServer(tc.handler(release))
+            t.Cleanup(bad.Close)
+
+            c, _ := newTestCollector(t)
+            m := newTestManager(t, c, 100*time.Millisecond)
+            // Answer the hanging query before the manager is stopped.
+            t.Cleanup(func() { close(release) })
+            healthy, failing := testTenancy("healthy"), testTenancy("failing")
+            failing.Region = "us-phoenix-1"
+            m.Apply(TenancyConfig{
+                Tenancies: []Tenancy{healthy, failing},
+                Endpoints: map[string]string{"us-ashburn-1": goodURL, "us-phoenix-1": bad.URL},
+            }, cpuConfig)
+
+            deadline := time.Now().Add(5 * time.Second)
+            for len(good.Requests()) < 4 && time.Now().Before(deadline) {
+                time.Sleep(20 * time.Millisecond)
+            }
+            if n := len(good.Requests()); n < 4 {
+                t.Fatalf("healthy tenancy sent %d queries, want at least 4 cycles' worth", n)
+            }
+            if got := sampleValue(t, c.store, map[string]string{"tenancy": "healthy", "resource_id": "ocid1.instance.oc1.iad.redacted0002"}); got != 70.75 {
+                t.Errorf("healthy tenancy's value = %v, want 70.75", got)
+            }
+            if found := findSamples(c.store, map[string]string{"tenancy": "failing"}); len(found) != 0 {
+                t.Errorf("failing tenancy stored %v", found)
+            }
+            finished, failed := loopState(m, "failing")
+            if finished != tc.finishes || tc.finishes && !failed {
+                t.Errorf("failing tenancy finished=%v failing=%v, want finished=%v and failing", finished, failed, tc.finishes)
+            }
+            if finished, failed := loopState(m, "healthy"); !finished || failed {
+                t.Errorf("healthy tenancy finished=%v failing=%v, want a successful cycle", finished, failed)
+            }
+        })
+    }
+}
+
+func TestTenanciesShareTheLimiter(t *testing.T) {
+    fake, _ := startFake(t, nil)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(20 * time.Millisecond)
+        fake.ServeHTTP(w, r)
+    }))
+    t.Cleanup(srv.Close)
+
+    c, _ := newTestCollector(t)
+    c.pacers = nil
+    c.limiter = newAdaptiveLimiter(1, 1, c.self)
+    m := newTestManager(t, c, 100*time.Millisecond)
+    // The busy tenancy has 20 queries per cycle, the quiet one a single query.
+    busy, quiet := testTenancy("busy"), testTenancy("quiet")
+    busy.CompartmentID, quiet.CompartmentID = "ocid1.compartment.oc1..busy", "ocid1.compartment.oc1..quiet"
+    busy.Metrics = []MetricNamespace{{
+        Namespace:  "oci_computeagent",
+        Names:      []string{"CpuUtilization", "MemoryUtilization"},
+        Statistics: []string{"mean", "max", "min", "sum", "count"},
+        Windows:    []string{"1m", "5m"},
+    }}
+    m.Apply(TenancyConfig{Tenancies: []Tenancy{busy, quiet}, Endpoints: map[string]string{"us-ashburn-1": srv.URL}}, cpuConfig)
+
+    count := func() (busy, quiet int) {
+        for _, r := range fake.Requests() {
+            if r.CompartmentID == "ocid1.compartment.oc1..quiet" {
+                quiet++
+            } else {
+                busy++
+            }
+        }
+        return busy, quiet
+    }
+    // The quiet tenancy waits for at most the busy one's request in flight
+    // and keeps its interval while the busy one overruns its own.
+    waitFor(t, "both tenancies to progress", func() bool {
+        b, q := count()
+        return b >= 20 && q >= 5
+    })
+}
+
+func TestPacersArePerTenancy(t *testing.T) {
+    p := newTenancyPacers(20)
+    start := time.Now()
+    for i := 0; i < 3; i++ {
+        if err := p.wait(context.Background(), "busy"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+        t.Errorf("three queries of one tenancy took %v, want at least 100ms at 20 per second", elapsed)
+    }
+    start = time.Now()
+    if err := p.wait(context.Background(), "quiet"); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+        t.Errorf("another tenancy's first query waited %v, want no wait", elapsed)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err := p.wait(ctx, "busy"); err == nil {
+        t.Error("wait with a cancelled context succeeded while the tenancy is paced")
+    }
+    // -tenancy-query-rate 0 disables the pacing.
+    unpaced := newTenancyPacers(0)
+    for i := 0; i < 3; i++ {
+        if err := unpaced.wait(ctx, "busy"); err != nil {
+            t.Errorf("unpaced wait: %v", err)
+        }
+    }
+}
+
+func TestCollectionOrder(t *testing.T) {
+    entries := func() []MetricNamespace {
+        return []MetricNamespace{
+            {Namespace: "oci_vcn"},
+            {Namespace: "oci_computeagent", Priority: priorityLow},
+            {Namespace: "oci_lbaas", Priority: priorityHigh},
+        }
+    }
+    for _, tc := range []struct {
+        order string
+        first bool
+        want  []string
+    }{
+        {orderTenancy, false, []string{"oci_vcn", "oci_computeagent", "oci_lbaas"}},
+        {orderTenancy, true, []string{"oci_lbaas", "oci_vcn", "oci_computeagent"}},
+        {orderNamespace, false, []string{"oci_computeagent", "oci_lbaas", "oci_vcn"}},
+        {orderNamespace, true, []string{"oci_lbaas", "oci_vcn", "oci_computeagent"}},
+    } {
+        m := &collectionManager{collectionOrder: tc.order}
+        got := entries()
+        m.order(got, tc.first)
+        var names []string
+        for _, ns := range got {
+            names = append(names, ns.Namespace)
+        }
+        if !reflect.DeepEqual(names, tc.want) {
+            t.Errorf("%s order, first cycle %v: %v, want %v", tc.order, tc.first, names, tc.want)
+        }
+    }
+}
+
+func TestTickerKeepsSchedule(t *testing.T) {
+    const (
+        interval = 200 * time.Millisecond
+        // Each cycle takes most of the interval; sleeping the interval after
+        // each cycle would space them interval+delay apart.
+        delay  = 120 * time.Millisecond
+        cycles = 8
+    )
+    fake, _ := startFake(t, nil)
+    var mu sync.Mutex
+    var starts []time.Time
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        starts = append(starts, time.Now())
+        mu.Unlock()
+        time.Sleep(delay)
+        fake.ServeHTTP(w, r)
+    }))
+    t.Cleanup(srv.Close)
+
+    c, _ := newTestCollector(t)
+    m := newTestManager(t, c, interval)
+    m.Apply(TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: map[string]string{"us-ashburn-1": srv.URL}}, cpuConfig)
+    waitFor(t, "the cycles", func() bool {
+        mu.Lock()
+        defer mu.Unlock()
+        return len(starts) >= cycles
+    })
+    stopBetweenQueries(t, m)
+
+    mu.Lock()
+    spacing := starts[cycles-1].Sub(starts[0]) / (cycles - 1)
+    mu.Unlock()
+    if spacing < interval*9/10 || spacing > interval*5/4 {
+        t.Errorf("cycles started %v apart on average, want about the %v interval", spacing, interval)
+    }
+    if drift := testutil.ToFloat64(c.self.intervalDrift.WithLabelValues("acme")); drift > (interval/4).Seconds() || drift < -(interval/4).Seconds() {
+        t.Errorf("interval drift = %vs, want about 0", drift)
+    }
+    if ratio := testutil.ToFloat64(c.self.cycleDurationRatio.WithLabelValues("acme")); ratio < 0.5 || ratio >= 1 {
+        t.Errorf("cycle duration ratio = %v, want the delay's share of the interval", ratio)
+    }
+}
+
+func TestWallClockJump(t *testing.T) {
+    prev := time.Now()
+    for _, tc := range []struct {
+        name string
+        now  time.Time
+    }{
+        {"monotonic", prev.Add(10 * time.Minute)},
+        {"wall clock only", prev.Round(0).Add(10 * time.Minute)},
+        {"other zone", prev.Add(10 * time.Minute).In(time.FixedZone("", -5*3600))},
+    } {
+        if jump := wallClockJump(prev, tc.now); jump != 0 {
+            t.Errorf("%s: jump = %v, want 0", tc.name, jump)
+        }
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "log"
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// labelSchemas records, by namespace and metric, the label-name sets a cycle
+// wrote series with.
+type labelSchemas map[string]map[string]map[string]bool
+
+// add records the label names of one series.
+func (s labelSchemas) add(namespace, metric string, labels prometheus.Labels) {
+    names, _, _ := labelKey(labels)
+    if s[namespace] == nil {
+        s[namespace] = make(map[string]map[string]bool)
+    }
+    if s[namespace][metric] == nil {
+        s[namespace][metric] = make(map[string]bool)
+    }
+    s[namespace][metric][strings.Join(names, "\xff")] = true
+}
+
+// oldSchema reports whether a series of the tenancy and namespace belongs to a
+// metric the cycle wrote, but with label names it no longer writes.
+func oldSchema(names, values []string, tenancy, namespace string, written map[string]map[string]bool) bool {
+    if labelValue(names, values, "tenancy") != tenancy || labelValue(names, values, "namespace") != namespace {
+        return false
+    }
+    schemas := written[labelValue(names, values, "metric")]
+    return schemas != nil && !schemas[strings.Join(names, "\xff")]
+}
+
+// DeleteOldSchemas removes the tenancy's series of namespace that oldSchema
+// matches against written and returns how many it removed.
+func (s *sampleStore) DeleteOldSchemas(tenancy, namespace string, written map[string]map[string]bool) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for key, smp := range s.samples {
+        if oldSchema(smp.names, smp.values, tenancy, namespace, written) {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteOldSchemas removes the tenancy's series of namespace that oldSchema
+// matches against written and returns how many it removed.
+func (h *histogramStore) DeleteOldSchemas(tenancy, namespace string, written map[string]map[string]bool) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    n := 0
+    for key, hs := range h.series {
+        if oldSchema(hs.names, hs.values, tenancy, namespace, written) {
+            delete(h.series, key)
+            n++
+        }
+    }
+    return n
+}
+
+// markSweep adds the namespaces of metrics to those swept after the loop's
+// next clean cycle.
+func (loop *tenancyLoop) markSweep(metrics MetricConfig) {
+    loop.mu.Lock()
+    defer loop.mu.Unlock()
+    if loop.sweep == nil {
+        loop.sweep = make(map[string]bool)
+    }
+    for _, ns := range metrics.Metrics {
+        loop.sweep[ns.Namespace] = true
+    }
+}
+
+// requeueSweep adds back the namespaces a cycle could not sweep. Callers must
+// hold loop.mu.
+func (loop *tenancyLoop) requeueSweep(namespaces map[string]bool) {
+    for ns := range namespaces {
+        if loop.sweep == nil {
+            loop.sweep = make(map[string]bool)
+        }
+        loop.sweep[ns] = true
+    }
+}
+
+// sweepSchemas deletes, for each namespace in pending that the cycle collected
+// without a failed query, the tenancy's series whose labels its entries no
+// longer produce, such as those from before a reload that added statistics or
+// switched aggregation_scope. Swept namespaces are removed from pending; the
+// others are tried again after the next cycle. Only metrics that wrote series
+// in the cycle are swept, so a metric that returned nothing keeps its series.
+func (c *collector) sweepSchemas(ten Tenancy, pending map[string]bool, stats cycleStats) {
+    n := 0
+    for ns := range pending {
+        if stats.failed[ns] > 0 || len(stats.schemas[ns]) == 0 {
+            continue
+        }
+        delete(pending, ns)
+        written := stats.schemas[ns]
+        n += c.store.DeleteOldSchemas(ten.Label, ns, written) + c.histograms.DeleteOldSchemas(ten.Label, ns, written)
+        for _, s := range []*sampleStore{c.seriesState, c.coverage, c.resolution, c.compat} {
+            if s != nil {
+                n += s.DeleteOldSchemas(ten.Label, ns, written)
+            }
+        }
+    }
+    if n > 0 {
+        log.Printf("Tenancy %s: deleted %d series whose labels the reloaded config no longer produces", ten.Name, n)
+    }
+}
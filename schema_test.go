@@ -0,0 +1,135 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestSweepSchemas(t *testing.T) {
+    ten := testTenancy("acme")
+    old := prometheus.Labels{"tenancy": "acme", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": "r1"}
+    current := prometheus.Labels{"tenancy": "acme", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": "r1", "statistic": "max"}
+    // Another metric of the namespace that returned nothing this cycle.
+    quiet := prometheus.Labels{"tenancy": "acme", "namespace": "oci_computeagent", "metric": "DiskBytesRead", "resource_id": "r1"}
+    for _, tc := range []struct {
+        name   string
+        failed int
+        // left are the series left and swept whether the namespace was swept.
+        left  int
+        swept bool
+    }{
+        {"clean cycle", 0, 2, true},
+        {"failed query", 1, 3, false},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            c, _ := newTestCollector(t)
+            for _, labels := range []prometheus.Labels{old, current, quiet} {
+                c.store.Set(labels, 1)
+            }
+            stats := cycleStats{failed: map[string]int{"oci_computeagent": tc.failed}, schemas: make(labelSchemas)}
+            stats.schemas.add("oci_computeagent", "CpuUtilization", current)
+            pending := map[string]bool{"oci_computeagent": true}
+
+            c.sweepSchemas(ten, pending, stats)
+
+            if n := len(c.store.Snapshot()); n != tc.left {
+                t.Errorf("%d series left, want %d", n, tc.left)
+            }
+            if len(findSamples(c.store, current)) != 1 || len(findSamples(c.store, quiet)) != 1 {
+                t.Error("swept a series of the current schema or of a metric without series this cycle")
+            }
+            if pending["oci_computeagent"] == tc.swept {
+                t.Errorf("namespace pending = %v, want %v", pending["oci_computeagent"], !tc.swept)
+            }
+        })
+    }
+}
+
+func TestReloadChangesSchemaUnderScrapes(t *testing.T) {
+    cpu := cpuConfig.Metrics[0]
+    withStatistics, byCompartment, withWindows := cpu, cpu, cpu
+    withStatistics.Statistics = []string{"mean", "max"}
+    byCompartment.AggregationScope = scopeCompartment
+    withWindows.Windows = []string{"1m", "5m"}
+    for _, tc := range []struct {
+        name   string
+        reload MetricNamespace
+        // label is set on every series after the reload, and series how
+        // many there are.
+        label  string
+        series int
+    }{
+        {"statistics added", withStatistics, "statistic", 4},
+        {"aggregation scope switched", byCompartment, "compartment_id", 1},
+        {"windows added", withWindows, "window", 4},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            _, url := startFake(t, nil)
+            c, reg := newTestCollector(t)
+            m := newTestManager(t, c, 50*time.Millisecond)
+            m.dropRemoved = true
+            tenants := TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: map[string]string{"us-ashburn-1": url}}
+            m.Apply(tenants, cpuConfig)
+
+            // Scrape the way /metrics does for the whole test.
+            handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorHandling: promhttp.HTTPErrorOnError})
+            stop := make(chan struct{})
+            errs := make(chan string, 100)
+            var wg sync.WaitGroup
+            for i := 0; i < 4; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    for {
+                        select {
+                        case <-stop:
+                            return
+                        default:
+                        }
+                        rec := httptest.NewRecorder()
+                        handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+                        if rec.Code != http.StatusOK {
+                            select {
+                            case errs <- rec.Body.String():
+                            default:
+                            }
+                        }
+                    }
+                }()
+            }
+            defer func() {
+                close(stop)
+                wg.Wait()
+                close(errs)
+                for err := range errs {
+                    t.Errorf("scrape failed: %s", err)
+                }
+            }()
+
+            waitFor(t, "the first cycle", func() bool { return len(c.store.Snapshot()) == 2 })
+            m.Apply(tenants, MetricConfig{Metrics: []MetricNamespace{tc.reload}})
+            waitFor(t, "the old series to be swept", func() bool {
+                all := c.store.Snapshot()
+                return len(all) == tc.series && len(findSamples(c.store, map[string]string{tc.label: ""})) == 0
+            })
+        })
+    }
+}
+
+// waitFor polls cond until it holds, failing the test after 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
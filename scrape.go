@@ -0,0 +1,66 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+)
+
+// scrapeGatherer runs a cycle of every tenancy before each gather of inner
+// (-scrape-on-request), so a scrape returns values queried for it. A gather
+// that arrives while a round is in flight waits for that round instead of
+// starting another, so concurrent scrapes do not multiply the API load. A
+// round that outlasts the timeout is left running and the scrape gets the
+// values stored so far.
+type scrapeGatherer struct {
+    inner    prometheus.Gatherer
+    manager  *collectionManager
+    timeout  time.Duration
+    timeouts prometheus.Counter
+
+    mu sync.Mutex
+    // round is closed when the round in flight ends; nil when there is none.
+    round chan struct{}
+}
+
+func newScrapeGatherer(inner prometheus.Gatherer, manager *collectionManager, timeout time.Duration, self *selfMetrics) *scrapeGatherer {
+    return &scrapeGatherer{
+        inner:    inner,
+        manager:  manager,
+        timeout:  timeout,
+        timeouts: self.counterVec("scrape_collection_timeouts_total", "Scrapes under -scrape-on-request served before the collection round finished, after -scrape-timeout.").WithLabelValues(),
+    }
+}
+
+func (g *scrapeGatherer) Gather() ([]*dto.MetricFamily, error) {
+    g.mu.Lock()
+    round := g.round
+    if round == nil {
+        round = make(chan struct{})
+        g.round = round
+        go func() {
+            // Not bound to the scrape, so a round that times out still
+            // finishes and fills the store for the next scrape.
+            g.manager.CollectNow(context.Background())
+            g.mu.Lock()
+            g.round = nil
+            g.mu.Unlock()
+            close(round)
+        }()
+    }
+    g.mu.Unlock()
+
+    timer := time.NewTimer(g.timeout)
+    defer timer.Stop()
+    select {
+    case <-round:
+    case <-timer.C:
+        g.timeouts.Inc()
+        log.Printf("Warning: collection round still running after -scrape-timeout %v, serving the values stored so far", g.timeout)
+    }
+    return g.inner.Gather()
+}
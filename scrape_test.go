@@ -0,0 +1,68 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeGathererCollects(t *testing.T) {
+    fake, url := startFake(t, nil)
+    c, reg := newTestCollector(t)
+    m := newTestManager(t, c, time.Minute)
+    m.onDemand = true
+    m.Apply(TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: map[string]string{"us-ashburn-1": url}}, cpuConfig)
+    g := newScrapeGatherer(reg, m, 10*time.Second, c.self)
+    // A loop runs its first cycle when it starts, then waits for scrapes.
+    waitFor(t, "the first cycle", func() bool {
+        finished, _ := loopState(m, "acme")
+        return finished
+    })
+
+    for scrape := 1; scrape <= 2; scrape++ {
+        families, err := g.Gather()
+        if err != nil {
+            t.Fatalf("scrape %d: %v", scrape, err)
+        }
+        if n := len(fake.Requests()) - 1; n != scrape {
+            t.Errorf("scrape %d: %d queries sent, want one per scrape", scrape, n)
+        }
+        found := false
+        for _, f := range families {
+            found = found || f.GetName() == valueMetricName && len(f.GetMetric()) == 2
+        }
+        if !found {
+            t.Errorf("scrape %d did not return the cycle's 2 value series", scrape)
+        }
+    }
+}
+
+func TestScrapeGathererTimeout(t *testing.T) {
+    fake, _ := startFake(t, nil)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(300 * time.Millisecond)
+        fake.ServeHTTP(w, r)
+    }))
+    t.Cleanup(srv.Close)
+    c, reg := newTestCollector(t)
+    m := newTestManager(t, c, time.Minute)
+    m.onDemand = true
+    m.Apply(TenancyConfig{Tenancies: []Tenancy{testTenancy("acme")}, Endpoints: map[string]string{"us-ashburn-1": srv.URL}}, cpuConfig)
+    g := newScrapeGatherer(reg, m, 50*time.Millisecond, c.self)
+
+    start := time.Now()
+    if _, err := g.Gather(); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+        t.Errorf("scrape waited %v for a slow round, want about the 50ms timeout", elapsed)
+    }
+    if got := testutil.ToFloat64(g.timeouts); got != 1 {
+        t.Errorf("scrape_collection_timeouts_total = %v, want 1", got)
+    }
+    // The round keeps running and fills the store for the next scrape.
+    waitFor(t, "the round", func() bool { return len(findSamples(c.store, map[string]string{"tenancy": "acme"})) == 2 })
+}
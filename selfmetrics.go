@@ -0,0 +1,147 @@
+package main
+
+import (
+    "regexp"
+    "runtime"
+    "runtime/debug"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultSelfMetricsPrefix is the default -self-metrics-prefix.
+const defaultSelfMetricsPrefix = "oci_exporter_"
+
+// selfMetricsPrefixPattern matches the metric name prefixes -self-metrics-prefix accepts.
+var selfMetricsPrefixPattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// validSelfMetricsPrefix reports whether prefix starts valid metric names.
+func validSelfMetricsPrefix(prefix string) bool {
+    return selfMetricsPrefixPattern.MatchString(prefix)
+}
+
+// selfMetrics are the exporter's own operational metrics. Optional ones are nil
+// unless enabled. Every self-metric is created through its helpers, so all
+// carry the configured prefix and end up in the same registry.
+type selfMetrics struct {
+    reg    prometheus.Registerer
+    prefix string
+
+    clientInitFailed   *prometheus.GaugeVec
+    cycleDurationRatio *prometheus.GaugeVec
+    intervalDrift      *prometheus.GaugeVec
+    configWarnings     prometheus.Gauge
+    resources          *prometheus.GaugeVec
+    oversizedResponses *prometheus.CounterVec
+    heartbeat          prometheus.Gauge
+    heartbeats         prometheus.Counter
+    lastErrorRequestID *prometheus.GaugeVec
+    apiCalls           *prometheus.CounterVec
+    throttled          *prometheus.CounterVec
+    retries            *prometheus.CounterVec
+    queryErrors        *prometheus.CounterVec
+    cycleDuration      *prometheus.GaugeVec
+    datapoints         *prometheus.CounterVec
+    streamsReturned    *prometheus.CounterVec
+    streamsExported    *prometheus.CounterVec
+    streamsSkipped     *prometheus.CounterVec
+    truncatedLabels    *prometheus.CounterVec
+    estimatedCost      *prometheus.CounterVec
+    // costPerMillion is the -estimated-cost-per-million-datapoints rate.
+    costPerMillion float64
+    // tenancyVecs are the vectors with a tenancy label, whose series
+    // forgetTenancy deletes.
+    tenancyVecs []*prometheus.MetricVec
+}
+
+func newSelfMetrics(reg prometheus.Registerer, prefix string) *selfMetrics {
+    s := &selfMetrics{reg: reg, prefix: prefix}
+    s.clientInitFailed = s.gaugeVec("client_init_failed", "1 if the tenancy's OCI client could not be created and the tenancy is skipped.", "tenancy")
+    s.oversizedResponses = s.counterVec("oversized_responses_total", "SummarizeMetricsData responses with more items than -max-response-items, truncated to the limit.", "tenancy", "namespace")
+    s.heartbeat = s.gaugeVec("heartbeat_timestamp_seconds", "Unix time of the last scheduler tick of any tenancy loop, set whatever the collection outcome.").WithLabelValues()
+    s.heartbeats = s.counterVec("heartbeat_total", "Incremented every collection interval by the exporter itself, whether or not any OCI call succeeds.").WithLabelValues()
+    s.lastErrorRequestID = s.gaugeVec("last_error_request_id", "opc-request-id of the last failed OCI service call of the tenancy and namespace, value is always 1.", "tenancy", "namespace", "request_id")
+    s.apiCalls = s.counterVec("api_calls_total", "OCI API requests sent, retries included, by operation.", "tenancy", "operation")
+    s.throttled = s.counterVec("throttled_requests_total", "Monitoring API requests answered with 429.", "tenancy")
+    s.retries = s.counterVec("retries_total", "SummarizeMetricsData requests sent again after being throttled.", "tenancy")
+    s.queryErrors = s.counterVec("query_errors_total", "SummarizeMetricsData queries that failed after retries, by error class as in /stats.", "tenancy", "namespace", "class")
+    s.datapoints = s.counterVec("datapoints_retrieved_total", "Datapoints returned by SummarizeMetricsData, before any truncation.", "tenancy")
+    s.streamsReturned = s.counterVec("streams_returned_total", "Streams returned by successful SummarizeMetricsData responses, after -max-response-items truncation.", "tenancy", "namespace")
+    s.streamsExported = s.counterVec("streams_exported_total", "Returned streams whose latest datapoint was stored as a series.", "tenancy", "namespace")
+    s.streamsSkipped = s.counterVec("streams_skipped_total", "Returned streams not exported, by reason: no_datapoints, nil_value, filtered (lifecycle_states), collision (same labels as an earlier stream of the response) or stale (older than the stored datapoint of the same labels).", "tenancy", "namespace", "reason")
+    s.truncatedLabels = s.counterVec("truncated_label_values_total", "Label values cut to -max-label-length, by label.", "tenancy", "namespace", "label")
+    s.gaugeVec("gomaxprocs", "GOMAXPROCS in effect.").WithLabelValues().Set(float64(runtime.GOMAXPROCS(0)))
+    s.gaugeVec("gomemlimit_bytes", "GOMEMLIMIT in effect, math.MaxInt64 when unset.").WithLabelValues().Set(float64(debug.SetMemoryLimit(-1)))
+    s.cycleDuration = s.gaugeVec("cycle_duration_seconds", "Duration of the tenancy's last collection cycle.", "tenancy")
+    s.cycleDurationRatio = s.gaugeVec("cycle_duration_ratio", "Duration of the tenancy's last collection cycle divided by the collection interval; above 1 the exporter is not keeping up.", "tenancy")
+    s.intervalDrift = s.gaugeVec("interval_drift_seconds", "Time between the tenancy loop's last two ticks minus the collection interval; a multiple of the interval when a cycle overran and ticks were dropped.", "tenancy")
+    s.configWarnings = s.gaugeVec("config_warnings", "Warnings logged for the running config: settings that are ignored or collect nothing, which do not stop it from loading.").WithLabelValues()
+    return s
+}
+
+// gaugeVec creates and registers a self-metric gauge vector.
+func (s *selfMetrics) gaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+    g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: s.prefix + name, Help: help}, labels)
+    s.reg.MustRegister(g)
+    s.track(g.MetricVec, labels)
+    return g
+}
+
+// counterVec creates and registers a self-metric counter vector.
+func (s *selfMetrics) counterVec(name, help string, labels ...string) *prometheus.CounterVec {
+    c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: s.prefix + name, Help: help}, labels)
+    s.reg.MustRegister(c)
+    s.track(c.MetricVec, labels)
+    return c
+}
+
+// track adds v to tenancyVecs if it has a tenancy label. Vectors are only
+// created before collection starts, so tenancyVecs needs no lock.
+func (s *selfMetrics) track(v *prometheus.MetricVec, labels []string) {
+    for _, l := range labels {
+        if l == "tenancy" {
+            s.tenancyVecs = append(s.tenancyVecs, v)
+            return
+        }
+    }
+}
+
+// forgetTenancy deletes every self-metric series of a removed tenancy and
+// returns how many it deleted.
+func (s *selfMetrics) forgetTenancy(tenancy string) int {
+    n := 0
+    for _, v := range s.tenancyVecs {
+        n += v.DeletePartialMatch(prometheus.Labels{"tenancy": tenancy})
+    }
+    return n
+}
+
+// gaugeFunc creates and registers a self-metric gauge whose value fn returns.
+func (s *selfMetrics) gaugeFunc(name, help string, fn func() float64) {
+    s.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: s.prefix + name, Help: help}, fn))
+}
+
+// enableResourceCounts turns on oci_exporter_resources_total.
+func (s *selfMetrics) enableResourceCounts() {
+    s.resources = s.gaugeVec("resources_total", "Distinct resourceIds returned for a metric in the last collection cycle.", "tenancy", "namespace", "metric")
+}
+
+// enableCostEstimate turns on oci_exporter_estimated_retrieval_cost_total at the
+// given price per million retrieved datapoints.
+func (s *selfMetrics) enableCostEstimate(perMillion float64) {
+    s.costPerMillion = perMillion
+    s.estimatedCost = s.counterVec("estimated_retrieval_cost_total", "ESTIMATE of the Monitoring retrieval cost of the tenancy's datapoints at -estimated-cost-per-million-datapoints, ignoring the free tier; not a billing figure.", "tenancy")
+}
+
+// countRetrieval adds the datapoints of one response to the retrieval counters.
+func (s *selfMetrics) countRetrieval(tenancy string, datapoints int) {
+    s.datapoints.WithLabelValues(tenancy).Add(float64(datapoints))
+    if s.estimatedCost != nil {
+        s.estimatedCost.WithLabelValues(tenancy).Add(float64(datapoints) * s.costPerMillion / 1e6)
+    }
+}
+
+// setLastErrorRequestID replaces the last failed request ID of the tenancy and namespace.
+func (s *selfMetrics) setLastErrorRequestID(tenancy, namespace, requestID string) {
+    s.lastErrorRequestID.DeletePartialMatch(prometheus.Labels{"tenancy": tenancy, "namespace": namespace})
+    s.lastErrorRequestID.WithLabelValues(tenancy, namespace, requestID).Set(1)
+}
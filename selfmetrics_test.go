@@ -0,0 +1,32 @@
+package main
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSelfMetricsPrefix(t *testing.T) {
+    reg := prometheus.NewRegistry()
+    self := newSelfMetrics(reg, "obs_oci_exporter_")
+    self.apiCalls.WithLabelValues("acme", "SummarizeMetricsData").Inc()
+    families, err := reg.Gather()
+    if err != nil {
+        t.Fatalf("Gather: %v", err)
+    }
+    if len(families) == 0 {
+        t.Fatal("no self-metrics gathered")
+    }
+    for _, mf := range families {
+        if !strings.HasPrefix(mf.GetName(), "obs_oci_exporter_") {
+            t.Errorf("self-metric %s lacks the prefix", mf.GetName())
+        }
+    }
+
+    for prefix, want := range map[string]bool{"oci_exporter_": true, "obs:": true, "": false, "1st_": false, "oci-exporter_": false} {
+        if got := validSelfMetricsPrefix(prefix); got != want {
+            t.Errorf("validSelfMetricsPrefix(%q) = %v, want %v", prefix, got, want)
+        }
+    }
+}
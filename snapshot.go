@@ -0,0 +1,59 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// snapshotFile is the content of -snapshot-file.
+type snapshotFile struct {
+    Written time.Time        `json:"written"`
+    Samples []snapshotSample `json:"samples"`
+}
+
+// writeSnapshot saves the store's samples to path. The file is written next to
+// path and renamed into place, so an interrupted write never leaves a torn file.
+func writeSnapshot(path string, store *sampleStore) (int, error) {
+    snap := snapshotFile{Written: time.Now().UTC(), Samples: store.Snapshot()}
+    data, err := json.Marshal(snap)
+    if err != nil {
+        return 0, err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return 0, err
+    }
+    if err := tmp.Close(); err != nil {
+        return 0, err
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return 0, err
+    }
+    return len(snap.Samples), nil
+}
+
+// loadSnapshot restores the samples saved at path into store. A missing file is
+// not an error: there is simply nothing to restore.
+func loadSnapshot(path string, store *sampleStore) (int, time.Time, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return 0, time.Time{}, nil
+    }
+    if err != nil {
+        return 0, time.Time{}, err
+    }
+    var snap snapshotFile
+    if err := json.Unmarshal(data, &snap); err != nil {
+        return 0, time.Time{}, fmt.Errorf("%s: %v", path, err)
+    }
+    store.Restore(snap.Samples)
+    return len(snap.Samples), snap.Written, nil
+}
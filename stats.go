@@ -0,0 +1,194 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+)
+
+// cycleStats describes one collection cycle of a tenancy.
+type cycleStats struct {
+    Finished        *time.Time `json:"finished,omitempty"`
+    DurationSeconds float64    `json:"duration_seconds"`
+    // Requests counts every SummarizeMetricsData attempt, retries included.
+    Requests  int `json:"requests"`
+    Throttled int `json:"throttled"`
+    // BackedOff counts queries not sent because they are backing off after failures.
+    BackedOff int `json:"backed_off"`
+    // Series is the number of series stored by the cycle.
+    Series int `json:"series"`
+    // Errors counts failed queries by errorClass.
+    Errors map[string]int `json:"errors"`
+
+    // queried and empty count, by namespace, the successful queries and those
+    // that returned no series; stored counts the series stored and failed the
+    // failed queries.
+    queried, empty, stored, failed map[string]int
+    // schemas are the label names of the series the cycle wrote.
+    schemas labelSchemas
+    // returned counts the streams of successful responses, retries the requests
+    // sent again after throttling; added and removed count the value series the
+    // cycle created and deleted.
+    returned, retries, added, removed int
+}
+
+// Levels of -cycle-summary.
+const (
+    summaryInfo  = "info"
+    summaryDebug = "debug"
+    summaryOff   = "off"
+)
+
+// summary formats the cycle as one line of key=value fields. Fields named like
+// a self-metric, without its prefix, hold the cycle's share of it.
+func (s cycleStats) summary(ten Tenancy, elapsed time.Duration, err error) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "tenancy=%s cycle_duration_seconds=%.3f api_calls_total=%d retries_total=%d throttled_requests_total=%d backed_off=%d streams_returned_total=%d streams_exported_total=%d series_added=%d series_removed=%d",
+        ten.Label, elapsed.Seconds(), s.Requests, s.retries, s.Throttled, s.BackedOff, s.returned, s.Series, s.added, s.removed)
+    failed := 0
+    classes := make([]string, 0, len(s.Errors))
+    for class, n := range s.Errors {
+        failed += n
+        classes = append(classes, class)
+    }
+    sort.Strings(classes)
+    fmt.Fprintf(&b, " query_errors_total=%d", failed)
+    for i, class := range classes {
+        sep := ","
+        if i == 0 {
+            sep = " class="
+        }
+        fmt.Fprintf(&b, "%s%s:%d", sep, class, s.Errors[class])
+    }
+    if err != nil {
+        fmt.Fprintf(&b, " error=%q", err.Error())
+    }
+    return b.String()
+}
+
+// Tenancy states reported by /stats.
+const (
+    stateOK               = "ok"
+    stateFailing          = "failing"
+    stateWaiting          = "waiting_for_first_cycle"
+    stateClientInitFailed = "client_init_failed"
+)
+
+// tenancyStats is the /stats entry of one tenancy.
+type tenancyStats struct {
+    Tenancy          string      `json:"tenancy"`
+    Region           string      `json:"region"`
+    MetricEntries    int         `json:"metric_entries"`
+    State            string      `json:"state"`
+    ClientInitFailed bool        `json:"client_init_failed"`
+    LastCycle        *cycleStats `json:"last_cycle,omitempty"`
+    // NextRun is when the tenancy's next cycle is scheduled; every entry of
+    // the tenancy is collected in that cycle.
+    NextRun *time.Time `json:"next_run,omitempty"`
+    // LastErrors are the tenancy's failing entries, see /debug/errors.
+    LastErrors []entryError `json:"last_errors,omitempty"`
+}
+
+// errorClassDNS is the class of requests whose endpoint host could not be resolved,
+// usually because of a misspelled region or a wrong endpoint override.
+const errorClassDNS = "dns"
+
+// errorClass groups a failed request by cause, for counting: the HTTP status
+// family of OCI service errors, or dns, timeout, canceled or network otherwise.
+// Timeouts of the transport phases are told apart as connect_timeout,
+// tls_timeout and header_timeout.
+func errorClass(err error) string {
+    if serr, ok := common.IsServiceError(err); ok {
+        switch code := serr.GetHTTPStatusCode(); {
+        case code == http.StatusTooManyRequests:
+            return "throttled"
+        case code == http.StatusUnauthorized || code == http.StatusForbidden:
+            return "auth"
+        case code == http.StatusNotFound:
+            return "not_found"
+        case code >= 500:
+            return "server"
+        default:
+            return "client"
+        }
+    }
+    var dnsErr *net.DNSError
+    var netErr net.Error
+    switch {
+    case errors.As(err, &dnsErr):
+        return errorClassDNS
+    case strings.Contains(err.Error(), "TLS handshake timeout"):
+        return "tls_timeout"
+    case strings.Contains(err.Error(), "timeout awaiting response headers"):
+        return "header_timeout"
+    case errors.Is(err, context.DeadlineExceeded):
+        return "timeout"
+    case errors.Is(err, context.Canceled):
+        return "canceled"
+    case errors.As(err, &netErr):
+        var opErr *net.OpError
+        if netErr.Timeout() && errors.As(err, &opErr) && opErr.Op == "dial" {
+            return "connect_timeout"
+        }
+        if netErr.Timeout() {
+            return "timeout"
+        }
+        return "network"
+    case isThrottled(err):
+        return "throttled"
+    }
+    return "other"
+}
+
+// requestID returns the opc-request-id of a failed OCI service call, or "" when
+// err did not come from the service.
+func requestID(err error) string {
+    if serr, ok := common.IsServiceError(err); ok {
+        return serr.GetOpcRequestID()
+    }
+    return ""
+}
+
+// stateRank orders tenancy states for display, least healthy first.
+var stateRank = map[string]int{stateClientInitFailed: 0, stateFailing: 1, stateWaiting: 2, stateOK: 3}
+
+// sortStats orders tenancies by health, least healthy first, then by label.
+func sortStats(stats []tenancyStats) {
+    sort.Slice(stats, func(i, j int) bool {
+        if ri, rj := stateRank[stats[i].State], stateRank[stats[j].State]; ri != rj {
+            return ri < rj
+        }
+        return stats[i].Tenancy < stats[j].Tenancy
+    })
+}
+
+// statsHandler serves GET /stats: per tenancy, its configured entries, state and
+// what its last cycle did, so the load each tenancy causes can be compared.
+func statsHandler(manager *collectionManager) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        stats := manager.Stats()
+        sortStats(stats)
+        out := struct {
+            Tenancies []tenancyStats `json:"tenancies"`
+        }{Tenancies: stats}
+        w.Header().Set("Content-Type", "application/json")
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(out); err != nil {
+            log.Printf("Writing /stats: %v", err)
+        }
+    }
+}
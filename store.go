@@ -0,0 +1,437 @@
+package main
+
+import (
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// sample is the latest value of one exported series.
+type sample struct {
+    // name, when set, replaces the store's metric name for this series.
+    name   string
+    names  []string
+    values []string
+    value  float64
+    at     time.Time
+    // restored marks a sample read from a snapshot; it is exposed with its
+    // original timestamp until a fresh datapoint replaces it.
+    restored bool
+}
+
+// sampleStore holds the latest value of every exported series and exposes them
+// as const metrics. Unlike a GaugeVec it does not fix the label set up front, so
+// entries that export different labels can share one metric name.
+type sampleStore struct {
+    name string
+    help string
+
+    mu      sync.Mutex
+    samples map[string]sample
+    descs   map[string]*prometheus.Desc
+    // named holds the metric names passed to SetNamedAt.
+    named map[string]bool
+    // quarantined holds the names SetNamedAt no longer stores, see Quarantine.
+    quarantined map[string]bool
+}
+
+func newSampleStore(name, help string) *sampleStore {
+    return &sampleStore{
+        name:        name,
+        help:        help,
+        samples:     make(map[string]sample),
+        descs:       make(map[string]*prometheus.Desc),
+        named:       make(map[string]bool),
+        quarantined: make(map[string]bool),
+    }
+}
+
+// labelKey returns the sorted label names, their values and a key identifying the series.
+func labelKey(labels prometheus.Labels) ([]string, []string, string) {
+    names := make([]string, 0, len(labels))
+    for name := range labels {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    values := make([]string, len(names))
+    for i, name := range names {
+        values[i] = labels[name]
+    }
+    return names, values, strings.Join(names, "\xff") + "\xfe" + strings.Join(values, "\xff")
+}
+
+// Set records v for the series identified by labels, replacing any previous value.
+func (s *sampleStore) Set(labels prometheus.Labels, v float64) {
+    s.SetAt(labels, v, time.Time{})
+}
+
+// SetAt records the datapoint v taken at ts for the series identified by labels.
+// The store keeps one datapoint per series, keyed by its labels, so a datapoint
+// returned twice by overlapping queries, such as a compartment and its parent
+// queried with its subtree, is stored once. A datapoint older than the stored one
+// is dropped so the series never moves back in time; one with the same timestamp
+// replaces it, since OCI revises the latest aggregate as late data arrives.
+// Writing the same datapoint again, as a retried or repeated query does, is
+// therefore harmless whatever the order. It reports whether the datapoint was
+// stored and whether the series is new.
+func (s *sampleStore) SetAt(labels prometheus.Labels, v float64, ts time.Time) (stored, added bool) {
+    return s.SetNamedAt("", labels, v, ts)
+}
+
+// SetNamedAt is SetAt for a series exported under name instead of the store's
+// metric name; "" means the store's name.
+func (s *sampleStore) SetNamedAt(name string, labels prometheus.Labels, v float64, ts time.Time) (stored, added bool) {
+    names, values, key := labelKey(labels)
+    if name != "" {
+        key = name + "\xfd" + key
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.quarantined[name] {
+        return false, false
+    }
+    prev, ok := s.samples[key]
+    if ok && !ts.IsZero() && ts.Before(prev.at) {
+        return false, false
+    }
+    s.samples[key] = sample{name: name, names: names, values: values, value: v, at: ts}
+    if name != "" {
+        s.named[name] = true
+    }
+    return true, !ok
+}
+
+// HasName reports whether series were ever stored under name with SetNamedAt.
+func (s *sampleStore) HasName(name string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.named[name]
+}
+
+// Quarantine deletes the series stored under name with SetNamedAt, returns how
+// many there were, and stops storing new ones.
+func (s *sampleStore) Quarantine(name string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.quarantined[name] = true
+    n := 0
+    for key, smp := range s.samples {
+        if smp.name == name {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteResources removes the tenancy's series whose resource_id is in ids and
+// returns how many it removed.
+func (s *sampleStore) DeleteResources(tenancy string, ids map[string]bool) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for key, smp := range s.samples {
+        if matchesResource(smp.names, smp.values, tenancy, ids) {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteMetricResources removes the tenancy's series of one metric of namespace
+// whose resource_id is in ids and returns how many it removed.
+func (s *sampleStore) DeleteMetricResources(tenancy, namespace, metric string, ids map[string]bool) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for key, smp := range s.samples {
+        if matchesMetricResource(smp.names, smp.values, tenancy, namespace, metric, ids) {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteTenancy removes every series of the tenancy and returns how many it removed.
+func (s *sampleStore) DeleteTenancy(tenancy string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for key, smp := range s.samples {
+        if labelValue(smp.names, smp.values, "tenancy") == tenancy {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteNamespaces removes the tenancy's series whose namespace is not in keep
+// and returns how many it removed. Series without a namespace label are kept.
+func (s *sampleStore) DeleteNamespaces(tenancy string, keep map[string]bool) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for key, smp := range s.samples {
+        if outsideNamespaces(smp.names, smp.values, tenancy, keep) {
+            delete(s.samples, key)
+            n++
+        }
+    }
+    return n
+}
+
+// labelValue returns the value of the named label, or "".
+func labelValue(names, values []string, name string) string {
+    for i, n := range names {
+        if n == name {
+            return values[i]
+        }
+    }
+    return ""
+}
+
+// outsideNamespaces reports whether a series belongs to the tenancy and has a
+// namespace label not in keep.
+func outsideNamespaces(names, values []string, tenancy string, keep map[string]bool) bool {
+    ns := labelValue(names, values, "namespace")
+    return ns != "" && !keep[ns] && labelValue(names, values, "tenancy") == tenancy
+}
+
+// matchesResource reports whether a series belongs to the tenancy and has a
+// resource_id in ids.
+func matchesResource(names, values []string, tenancy string, ids map[string]bool) bool {
+    return labelValue(names, values, "tenancy") == tenancy && ids[labelValue(names, values, "resource_id")]
+}
+
+// matchesMetricResource reports whether a series of the tenancy is of the
+// namespace and metric and has a resource_id in ids.
+func matchesMetricResource(names, values []string, tenancy, namespace, metric string, ids map[string]bool) bool {
+    return matchesResource(names, values, tenancy, ids) &&
+        labelValue(names, values, "namespace") == namespace && labelValue(names, values, "metric") == metric
+}
+
+// Describe sends nothing, which makes the store an unchecked collector: its
+// label sets are only known once samples arrive.
+func (s *sampleStore) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect emits every stored sample as a gauge.
+func (s *sampleStore) Collect(ch chan<- prometheus.Metric) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, smp := range s.samples {
+        d := s.desc(smp.name, smp.names)
+        m, err := prometheus.NewConstMetric(d, prometheus.GaugeValue, smp.value, smp.values...)
+        if err != nil {
+            m = prometheus.NewInvalidMetric(d, err)
+        } else if smp.restored && !smp.at.IsZero() {
+            m = prometheus.NewMetricWithTimestamp(smp.at, m)
+        }
+        ch <- m
+    }
+}
+
+// snapshotSample is the on-disk form of one stored sample.
+type snapshotSample struct {
+    Labels    map[string]string `json:"labels"`
+    Value     float64           `json:"value"`
+    Timestamp time.Time         `json:"timestamp,omitempty"`
+}
+
+// Snapshot returns every stored sample.
+func (s *sampleStore) Snapshot() []snapshotSample {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    out := make([]snapshotSample, 0, len(s.samples))
+    for _, smp := range s.samples {
+        labels := make(map[string]string, len(smp.names))
+        for i, name := range smp.names {
+            labels[name] = smp.values[i]
+        }
+        out = append(out, snapshotSample{Labels: labels, Value: smp.value, Timestamp: smp.at})
+    }
+    return out
+}
+
+// Restore adds snapshot samples for series the store does not have yet, marked
+// as restored.
+func (s *sampleStore) Restore(samples []snapshotSample) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, snap := range samples {
+        names, values, key := labelKey(snap.Labels)
+        if _, ok := s.samples[key]; ok {
+            continue
+        }
+        s.samples[key] = sample{names: names, values: values, value: snap.Value, at: snap.Timestamp, restored: true}
+    }
+}
+
+// desc returns the cached Desc for a metric name, "" for the store's, and a
+// label-name set. Callers must hold s.mu.
+func (s *sampleStore) desc(name string, names []string) *prometheus.Desc {
+    key := name + "\xfe" + strings.Join(names, "\xff")
+    d, ok := s.descs[key]
+    if !ok {
+        if name == "" {
+            name = s.name
+        }
+        d = prometheus.NewDesc(name, s.help, names, nil)
+        s.descs[key] = d
+    }
+    return d
+}
+
+// histogramSeries is the cumulative distribution of one series' datapoints.
+type histogramSeries struct {
+    names   []string
+    values  []string
+    bounds  []float64
+    counts  []uint64 // per bucket, not cumulative
+    count   uint64
+    sum     float64
+    lastObs time.Time
+}
+
+// histogramStore accumulates datapoint values into histograms, one per series,
+// for entries that configure buckets. Like sampleStore it is an unchecked
+// collector, so label sets may differ between entries.
+type histogramStore struct {
+    name string
+    help string
+
+    mu     sync.Mutex
+    series map[string]*histogramSeries
+    descs  map[string]*prometheus.Desc
+}
+
+func newHistogramStore(name, help string) *histogramStore {
+    return &histogramStore{
+        name:   name,
+        help:   help,
+        series: make(map[string]*histogramSeries),
+        descs:  make(map[string]*prometheus.Desc),
+    }
+}
+
+// Observe adds every datapoint newer than the last one observed for the series.
+// If the series' bounds changed since it was created, it starts over.
+func (h *histogramStore) Observe(labels prometheus.Labels, bounds []float64, points []monitoring.AggregatedDatapoint) {
+    names, values, key := labelKey(labels)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    hs, ok := h.series[key]
+    if !ok || !equalBounds(hs.bounds, bounds) {
+        hs = &histogramSeries{names: names, values: values, bounds: bounds, counts: make([]uint64, len(bounds))}
+        h.series[key] = hs
+    }
+    for _, dp := range points {
+        if dp.Value == nil || dp.Timestamp == nil || !dp.Timestamp.Time.After(hs.lastObs) {
+            continue
+        }
+        hs.lastObs = dp.Timestamp.Time
+        hs.count++
+        hs.sum += *dp.Value
+        if i := sort.SearchFloat64s(bounds, *dp.Value); i < len(bounds) {
+            hs.counts[i]++
+        }
+    }
+}
+
+// DeleteResources removes the tenancy's series whose resource_id is in ids.
+func (h *histogramStore) DeleteResources(tenancy string, ids map[string]bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for key, hs := range h.series {
+        if matchesResource(hs.names, hs.values, tenancy, ids) {
+            delete(h.series, key)
+        }
+    }
+}
+
+// DeleteMetricResources removes the tenancy's series of one metric of namespace
+// whose resource_id is in ids.
+func (h *histogramStore) DeleteMetricResources(tenancy, namespace, metric string, ids map[string]bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for key, hs := range h.series {
+        if matchesMetricResource(hs.names, hs.values, tenancy, namespace, metric, ids) {
+            delete(h.series, key)
+        }
+    }
+}
+
+// DeleteTenancy removes every series of the tenancy and returns how many it removed.
+func (h *histogramStore) DeleteTenancy(tenancy string) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    n := 0
+    for key, hs := range h.series {
+        if labelValue(hs.names, hs.values, "tenancy") == tenancy {
+            delete(h.series, key)
+            n++
+        }
+    }
+    return n
+}
+
+// DeleteNamespaces removes the tenancy's series whose namespace is not in keep
+// and returns how many it removed.
+func (h *histogramStore) DeleteNamespaces(tenancy string, keep map[string]bool) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    n := 0
+    for key, hs := range h.series {
+        if outsideNamespaces(hs.names, hs.values, tenancy, keep) {
+            delete(h.series, key)
+            n++
+        }
+    }
+    return n
+}
+
+func (h *histogramStore) Describe(ch chan<- *prometheus.Desc) {}
+
+func (h *histogramStore) Collect(ch chan<- prometheus.Metric) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for _, hs := range h.series {
+        key := strings.Join(hs.names, "\xff")
+        d, ok := h.descs[key]
+        if !ok {
+            d = prometheus.NewDesc(h.name, h.help, hs.names, nil)
+            h.descs[key] = d
+        }
+        buckets := make(map[float64]uint64, len(hs.bounds))
+        var cumulative uint64
+        for i, b := range hs.bounds {
+            cumulative += hs.counts[i]
+            buckets[b] = cumulative
+        }
+        m, err := prometheus.NewConstHistogram(d, hs.count, hs.sum, buckets, hs.values...)
+        if err != nil {
+            m = prometheus.NewInvalidMetric(d, err)
+        }
+        ch <- m
+    }
+}
+
+func equalBounds(a, b []float64) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
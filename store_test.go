@@ -0,0 +1,53 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSampleStoreSetAt(t *testing.T) {
+    t0 := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+    labels := prometheus.Labels{"tenancy": "acme", "metric": "CpuUtilization", "resource_id": "r1"}
+    for _, tc := range []struct {
+        name   string
+        at     time.Time
+        stored bool
+        want   float64
+    }{
+        {"newer datapoint", t0.Add(time.Minute), true, 2},
+        {"same timestamp replaces the revised aggregate", t0, true, 2},
+        {"older datapoint is dropped", t0.Add(-time.Minute), false, 1},
+        {"no timestamp always replaces", time.Time{}, true, 2},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            s := newSampleStore(valueMetricName, "")
+            if stored, added := s.SetAt(labels, 1, t0); !stored || !added {
+                t.Fatalf("first SetAt = %v, %v, want stored and added", stored, added)
+            }
+            stored, added := s.SetAt(labels, 2, tc.at)
+            if stored != tc.stored || added {
+                t.Errorf("second SetAt = %v, %v, want stored=%v and not added", stored, added, tc.stored)
+            }
+            if got := sampleValue(t, s, labels); got != tc.want {
+                t.Errorf("value = %v, want %v", got, tc.want)
+            }
+        })
+    }
+}
+
+func BenchmarkSampleStoreSetAt(b *testing.B) {
+    labels := make([]prometheus.Labels, benchStreams)
+    for i := range labels {
+        labels[i] = prometheus.Labels{"tenancy": "acme", "namespace": "oci_computeagent", "metric": "CpuUtilization", "resource_id": fmt.Sprintf("ocid1.instance.oc1.iad.%08d", i)}
+    }
+    s := newSampleStore(valueMetricName, "")
+    t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        s.SetAt(labels[i%benchStreams], float64(i), t0.Add(time.Duration(i/benchStreams)*time.Minute))
+    }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// rateLimitHeaders are the response headers read for quota information, in
+// order of preference. Monitoring does not document any, but some OCI services
+// and gateways send them.
+var rateLimitHeaders = struct{ limit, remaining []string }{
+    limit:     []string{"opc-ratelimit-limit", "x-ratelimit-limit", "ratelimit-limit"},
+    remaining: []string{"opc-ratelimit-remaining", "x-ratelimit-remaining", "ratelimit-remaining"},
+}
+
+// attemptObserver is told the outcome of every SummarizeMetricsData attempt.
+type attemptObserver func(resp monitoring.SummarizeMetricsDataResponse, err error)
+
+type attempt struct {
+    at        time.Time
+    throttled bool
+}
+
+// throttleTracker keeps, per tenancy, the ratio of 429 responses to all requests
+// over a sliding window, the best available proxy for quota pressure, and logs
+// when it crosses the warning threshold.
+type throttleTracker struct {
+    window    time.Duration
+    threshold float64
+
+    ratio     *prometheus.GaugeVec
+    limit     *prometheus.GaugeVec
+    remaining *prometheus.GaugeVec
+
+    mu       sync.Mutex
+    attempts map[string][]attempt
+    warned   map[string]bool
+}
+
+func newThrottleTracker(window time.Duration, threshold float64, self *selfMetrics) *throttleTracker {
+    return &throttleTracker{
+        window:    window,
+        threshold: threshold,
+        ratio:     self.gaugeVec("throttle_ratio", "Share of OCI Monitoring requests answered with 429 over the -throttle-window.", "tenancy"),
+        limit:     self.gaugeVec("ratelimit_limit", "Request limit reported by OCI rate-limit response headers, when present.", "tenancy"),
+        remaining: self.gaugeVec("ratelimit_remaining", "Remaining requests reported by OCI rate-limit response headers, when present.", "tenancy"),
+        attempts:  make(map[string][]attempt),
+        warned:    make(map[string]bool),
+    }
+}
+
+// observer returns the attemptObserver recording attempts of one tenancy.
+func (t *throttleTracker) observer(tenancy string) attemptObserver {
+    return func(resp monitoring.SummarizeMetricsDataResponse, err error) {
+        t.record(tenancy, isThrottled(err), time.Now())
+        if resp.RawResponse != nil {
+            t.readHeaders(tenancy, resp.RawResponse.Header)
+        }
+    }
+}
+
+func (t *throttleTracker) record(tenancy string, throttled bool, now time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.attempts[tenancy] = append(t.attempts[tenancy], attempt{at: now, throttled: throttled})
+    t.update(tenancy, now)
+}
+
+// refresh drops the tenancy's attempts that left the window, so the ratio
+// decays while the tenancy sends nothing and is 0 once the window is empty.
+// Tenancy loops call it on every tick.
+func (t *throttleTracker) refresh(tenancy string, now time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if _, ok := t.attempts[tenancy]; ok {
+        t.update(tenancy, now)
+    }
+}
+
+// update recomputes the tenancy's ratio over the window ending at now. t.mu
+// must be held.
+func (t *throttleTracker) update(tenancy string, now time.Time) {
+    attempts := t.attempts[tenancy]
+    cutoff := now.Add(-t.window)
+    i := 0
+    for i < len(attempts) && attempts[i].at.Before(cutoff) {
+        i++
+    }
+    attempts = attempts[i:]
+    t.attempts[tenancy] = attempts
+
+    n := 0
+    for _, a := range attempts {
+        if a.throttled {
+            n++
+        }
+    }
+    var ratio float64
+    if len(attempts) > 0 {
+        ratio = float64(n) / float64(len(attempts))
+    }
+    t.ratio.WithLabelValues(tenancy).Set(ratio)
+
+    switch over := ratio > t.threshold; {
+    case over && !t.warned[tenancy]:
+        log.Printf("WARNING: %.0f%% of requests for tenancy %s were throttled over the last %v; lower the request rate or widen collection intervals",
+            ratio*100, tenancy, t.window)
+        t.warned[tenancy] = true
+    case !over && t.warned[tenancy]:
+        log.Printf("Throttling for tenancy %s is back below %.0f%%", tenancy, t.threshold*100)
+        t.warned[tenancy] = false
+    }
+}
+
+// forget drops the state and gauges of a removed tenancy.
+func (t *throttleTracker) forget(tenancy string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.attempts, tenancy)
+    delete(t.warned, tenancy)
+    t.ratio.DeleteLabelValues(tenancy)
+    t.limit.DeleteLabelValues(tenancy)
+    t.remaining.DeleteLabelValues(tenancy)
+}
+
+func (t *throttleTracker) readHeaders(tenancy string, h http.Header) {
+    if v, ok := headerFloat(h, rateLimitHeaders.limit); ok {
+        t.limit.WithLabelValues(tenancy).Set(v)
+    }
+    if v, ok := headerFloat(h, rateLimitHeaders.remaining); ok {
+        t.remaining.WithLabelValues(tenancy).Set(v)
+    }
+}
+
+func headerFloat(h http.Header, names []string) (float64, bool) {
+    for _, name := range names {
+        if v := h.Get(name); v != "" {
+            if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+                return f, true
+            }
+        }
+    }
+    return 0, false
+}
+
+// isThrottled reports whether err is an OCI 429 response.
+func isThrottled(err error) bool {
+    return err != nil && strings.Contains(err.Error(), "TooManyRequests")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestThrottleRatioDecaysWhenIdle(t *testing.T) {
+    tr := newThrottleTracker(time.Minute, 0.1, newSelfMetrics(prometheus.NewRegistry(), defaultSelfMetricsPrefix))
+    start := time.Now()
+    tr.record("acme", true, start)
+    tr.record("acme", false, start.Add(30*time.Second))
+    ratio := func() float64 { return testutil.ToFloat64(tr.ratio.WithLabelValues("acme")) }
+    if got := ratio(); got != 0.5 {
+        t.Fatalf("ratio = %v, want 0.5", got)
+    }
+
+    // The throttled attempt leaves the window while nothing is sent.
+    tr.refresh("acme", start.Add(70*time.Second))
+    if got := ratio(); got != 0 {
+        t.Errorf("ratio after the 429 left the window = %v, want 0", got)
+    }
+    if tr.warned["acme"] {
+        t.Error("warning still raised after the 429 left the window")
+    }
+    tr.record("acme", true, start.Add(80*time.Second))
+    tr.refresh("acme", start.Add(3*time.Minute))
+    if got := ratio(); got != 0 {
+        t.Errorf("ratio over an empty window = %v, want 0", got)
+    }
+    if tr.warned["acme"] {
+        t.Error("warning still raised over an empty window")
+    }
+
+    tr.refresh("other", start)
+    if n := testutil.CollectAndCount(tr.ratio); n != 1 {
+        t.Errorf("%d ratio series, want only the tenancy that sent requests", n)
+    }
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "time"
+)
+
+// newTransport returns a copy of the default HTTP transport with the given
+// phase timeouts. dial bounds name resolution and the TCP connect, tlsHandshake
+// the TLS handshake, and responseHeader the wait for OCI to start answering
+// once the request is sent. Zero disables a timeout.
+func newTransport(dial, tlsHandshake, responseHeader time.Duration) *http.Transport {
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    t.DialContext = (&net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}).DialContext
+    t.TLSHandshakeTimeout = tlsHandshake
+    t.ResponseHeaderTimeout = responseHeader
+    return t
+}
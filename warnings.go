@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "log"
+)
+
+// configWarnings returns the problems of a loaded config that do not stop it
+// from being applied: settings that are ignored or collect nothing, OCIDs that
+// do not match their tenancy's region, and renamed duplicate tenancy names. Errors are left to loadConfigs.
+func configWarnings(tenants TenancyConfig, global MetricConfig) []string {
+    warnings := checkOCIDRegions(tenants)
+    for i, p := range warnings {
+        warnings[i] = p + "; queries will likely return nothing"
+    }
+    for _, p := range renamedTenancies(tenants) {
+        warnings = append(warnings, "WARNING: "+p+"; give every tenancy a unique name")
+    }
+    warnings = append(warnings, entryWarnings("metrics.yaml", global.Metrics)...)
+    for _, ten := range tenants.Tenancies {
+        if ten.ownsMetrics() {
+            warnings = append(warnings, entryWarnings("tenancy "+ten.Name, ten.Metrics)...)
+        }
+        if len(ten.metrics(global).Metrics) == 0 {
+            warnings = append(warnings, fmt.Sprintf("tenancy %s has no enabled metric entries and collects nothing", ten.Name))
+        }
+        if ten.AuditProfile != "" && ten.auditTenancy().credentialKey() == ten.credentialKey() {
+            warnings = append(warnings, fmt.Sprintf("tenancy %s: audit_profile is the tenancy's own profile, so -audit-profiles compares it with itself", ten.Name))
+        }
+        if ten.CompartmentID != "" && len(ten.CompartmentIDs) > 0 && !contains(ten.CompartmentIDs, ten.CompartmentID) {
+            warnings = append(warnings, fmt.Sprintf("tenancy %s: compartment_id is ignored because compartment_ids is set; add it to compartment_ids or remove it", ten.Name))
+        }
+    }
+    return warnings
+}
+
+// entryWarnings returns the warnings of the metric entries from source.
+func entryWarnings(source string, entries []MetricNamespace) []string {
+    var warnings []string
+    for _, ns := range entries {
+        if len(ns.Names) == 0 {
+            warnings = append(warnings, fmt.Sprintf("%s: namespace %s: entry has no names and collects nothing", source, ns.Namespace))
+        }
+        seen := make(map[string]bool, len(ns.Names))
+        for _, name := range ns.Names {
+            if seen[name] {
+                warnings = append(warnings, fmt.Sprintf("%s: namespace %s: metric %s is listed twice and queried twice", source, ns.Namespace, name))
+            }
+            seen[name] = true
+        }
+    }
+    return warnings
+}
+
+// contains reports whether list has s.
+func contains(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// logConfigWarnings logs the warnings of a loaded config and returns how many
+// there are, for oci_exporter_config_warnings.
+func logConfigWarnings(tenants TenancyConfig, global MetricConfig) int {
+    warnings := configWarnings(tenants, global)
+    for _, w := range warnings {
+        log.Printf("Config warning: %s", w)
+    }
+    return len(warnings)
+}
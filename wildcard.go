@@ -0,0 +1,155 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math/rand"
+    "sort"
+    "time"
+
+    "github.com/oracle/oci-go-sdk/v65/common"
+    "github.com/oracle/oci-go-sdk/v65/monitoring"
+)
+
+// wildcardName, as an entry's only name, stands for every metric the namespace
+// publishes in the tenancy.
+const wildcardName = "*"
+
+// isWildcard reports whether the entry collects every metric of its namespace.
+func (ns MetricNamespace) isWildcard() bool {
+    return len(ns.Names) == 1 && ns.Names[0] == wildcardName
+}
+
+type wildcardExpansion struct {
+    names []string
+    // next is when the expansion is refreshed.
+    next time.Time
+}
+
+// wildcardCache holds the expansions of one tenancy loop's wildcard entries.
+// Each is refreshed with ListMetrics after about interval, jittered so the
+// namespaces of a tenancy do not all refresh in the same cycle, or on the next
+// cycle when more than emptyRatio of its queries returned nothing, a sign that
+// the metric set changed. It is only used by its loop's goroutine.
+type wildcardCache struct {
+    interval   time.Duration
+    emptyRatio float64
+    entries    map[string]*wildcardExpansion
+}
+
+func newWildcardCache(interval time.Duration, emptyRatio float64) *wildcardCache {
+    return &wildcardCache{interval: interval, emptyRatio: emptyRatio, entries: make(map[string]*wildcardExpansion)}
+}
+
+func wildcardKey(ns MetricNamespace) string {
+    return ns.Namespace + "\xff" + ns.ResourceGroup
+}
+
+// Expand returns config with the names of wildcard entries replaced by their
+// expansion in compartments, refreshing the ones that are due. An entry that
+// has never been expanded successfully, or expands to nothing, is left out.
+func (w *wildcardCache) Expand(ctx context.Context, c *collector, client monitoring.MonitoringClient, ten Tenancy, compartments []string, config MetricConfig) MetricConfig {
+    queryIn, keep := c.rootScope(ten, compartments)
+    now := time.Now()
+    out := config
+    out.Metrics = make([]MetricNamespace, 0, len(config.Metrics))
+    for _, ns := range config.Metrics {
+        if !ns.isWildcard() {
+            out.Metrics = append(out.Metrics, ns)
+            continue
+        }
+        key := wildcardKey(ns)
+        e := w.entries[key]
+        if e == nil || !now.Before(e.next) {
+            ns.rootQuery = keep != nil
+            names, err := listMetricNames(ctx, client, ten, queryIn, ns, c.limiter, func() {
+                c.self.apiCalls.WithLabelValues(ten.Label, "ListMetrics").Inc()
+            })
+            if err != nil {
+                log.Printf("Expanding %s for tenancy %s failed, using previous result: %v", ns.Namespace, ten.Name, err)
+            } else {
+                if e == nil {
+                    e = &wildcardExpansion{}
+                    w.entries[key] = e
+                }
+                e.names = names
+                e.next = now.Add(time.Duration(float64(w.interval) * (0.75 + 0.5*rand.Float64())))
+                log.Printf("Expanded %s for tenancy %s to %d metrics", ns.Namespace, ten.Name, len(names))
+            }
+        }
+        if e == nil || len(e.names) == 0 {
+            continue
+        }
+        ns.Names = e.names
+        out.Metrics = append(out.Metrics, ns)
+    }
+    return out
+}
+
+// Observe schedules an immediate refresh of the wildcard entries whose
+// namespace returned nothing for more than emptyRatio of its queries in stats.
+func (w *wildcardCache) Observe(config MetricConfig, stats cycleStats) {
+    for _, ns := range config.Metrics {
+        if !ns.isWildcard() {
+            continue
+        }
+        e := w.entries[wildcardKey(ns)]
+        queried := stats.queried[ns.Namespace]
+        if e == nil || queried == 0 {
+            continue
+        }
+        if ratio := float64(stats.empty[ns.Namespace]) / float64(queried); ratio > w.emptyRatio {
+            log.Printf("%.0f%% of the %s queries returned nothing, refreshing its expansion", ratio*100, ns.Namespace)
+            e.next = time.Time{}
+        }
+    }
+}
+
+// listMetricNames returns the distinct metric names ns publishes in any of
+// compartments, each with or without its subtree as inSubtree decides,
+// following every page. Each request holds a slot of limiter while in flight
+// and count is called for it.
+func listMetricNames(ctx context.Context, client monitoring.MonitoringClient, ten Tenancy, compartments []string, ns MetricNamespace, limiter *adaptiveLimiter, count func()) ([]string, error) {
+    seen := make(map[string]bool)
+    for _, compartmentID := range compartments {
+        var page *string
+        for {
+            req := monitoring.ListMetricsRequest{
+                CompartmentId:          common.String(compartmentID),
+                CompartmentIdInSubtree: common.Bool(inSubtree(ten, ns)),
+                Page:                   page,
+                ListMetricsDetails: monitoring.ListMetricsDetails{
+                    Namespace: common.String(ns.Namespace),
+                    GroupBy:   []string{"name"},
+                },
+            }
+            if ns.ResourceGroup != "" {
+                req.ListMetricsDetails.ResourceGroup = common.String(ns.ResourceGroup)
+            }
+            if err := limiter.Acquire(ctx); err != nil {
+                return nil, err
+            }
+            count()
+            resp, err := client.ListMetrics(ctx, req)
+            limiter.Release(isThrottled(err))
+            if err != nil {
+                return nil, err
+            }
+            for _, m := range resp.Items {
+                if m.Name != nil {
+                    seen[*m.Name] = true
+                }
+            }
+            if resp.OpcNextPage == nil || *resp.OpcNextPage == "" {
+                break
+            }
+            page = resp.OpcNextPage
+        }
+    }
+    names := make([]string, 0, len(seen))
+    for name := range seen {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names, nil
+}